@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+// audit_logCmd respresents the audit_log command
+var audit_logCmd = &cobra.Command{
+	Use:   "audit_log",
+	Short: "Show the audit log of administrative actions",
+	Long:  `Show the audit log of administrative actions, oldest first.  Times are RFC3339, eg 2015-12-01T15:04:05Z`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		urlVal := resolveSecretFlag(cmd, "admin_url")
+		if urlVal == "" {
+			log.Printf("ERROR: Missing: --admin_url.\n  %v", cmd.UsageString())
+			return
+		}
+
+		query := deepstylelib.AuditQuery{
+			AffectedId: cmd.Flag("id").Value.String(),
+			Action:     cmd.Flag("action").Value.String(),
+		}
+
+		var err error
+		if since := cmd.Flag("since").Value.String(); since != "" {
+			if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+				log.Printf("ERROR: Invalid --since: %v", err)
+				return
+			}
+		}
+		if until := cmd.Flag("until").Value.String(); until != "" {
+			if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+				log.Printf("ERROR: Invalid --until: %v", err)
+				return
+			}
+		}
+
+		auditDocs, err := deepstylelib.QueryAuditLog(urlVal, query)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return
+		}
+
+		for _, auditDoc := range auditDocs {
+			fmt.Printf(
+				"%v\t%v\t%v\t%v\t%v\n",
+				auditDoc.Timestamp.Format(time.RFC3339),
+				auditDoc.Actor,
+				auditDoc.Action,
+				strings.Join(auditDoc.AffectedIds, ","),
+				auditDoc.Details,
+			)
+		}
+
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(audit_logCmd)
+
+	audit_logCmd.PersistentFlags().String("admin_url", "", "Sync Gateway Admin URL (or secret reference, eg env:SG_ADMIN_URL)")
+	audit_logCmd.PersistentFlags().String("id", "", "Only show actions that affected this doc id")
+	audit_logCmd.PersistentFlags().String("action", "", "Only show this action, eg RESET_STUCK_JOB")
+	audit_logCmd.PersistentFlags().String("since", "", "Only show actions at or after this time")
+	audit_logCmd.PersistentFlags().String("until", "", "Only show actions at or before this time")
+
+}
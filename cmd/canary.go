@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+var (
+	canaryInterval         *time.Duration
+	canaryTimeout          *time.Duration
+	canaryFailureThreshold *int
+	canaryCloudWatch       *bool
+)
+
+// canaryCmd respresents the canary command
+var canaryCmd = &cobra.Command{
+	Use:   "canary",
+	Short: "Periodically run a tiny job end to end and alert if it fails",
+	Long:  `Periodically submit a tiny job, check that the result comes back intact within the timeout, and publish CanarySuccess and CanaryLatency metrics to CloudWatch.  Alerts are posted to --alert-webhook when the canary starts failing and when it recovers.  AWS keys will be taken from environment variables or ~/.aws/.`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		urlVal := resolveSecretFlag(cmd, "url")
+		if urlVal == "" {
+			log.Printf("ERROR: Missing: --url.\n  %v", cmd.UsageString())
+			return
+		}
+
+		db, err := deepstylelib.GetDbConnection(urlVal)
+		if err != nil {
+			log.Panicf("Error connecting to db: %v", err)
+		}
+
+		options := deepstylelib.CanaryOptions{
+			Interval:         *canaryInterval,
+			Timeout:          *canaryTimeout,
+			Owner:            cmd.Flag("owner").Value.String(),
+			ExpectedHash:     cmd.Flag("expected-hash").Value.String(),
+			FailureThreshold: *canaryFailureThreshold,
+			CloudWatch:       *canaryCloudWatch,
+		}
+		if webhookUrl := resolveSecretFlag(cmd, "alert-webhook"); webhookUrl != "" {
+			options.AlertHooks = append(options.AlertHooks, deepstylelib.WebhookAlertHook{Url: webhookUrl})
+		}
+
+		deepstylelib.RunCanary(db, options)
+
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(canaryCmd)
+
+	canaryCmd.PersistentFlags().String("url", "", "Sync Gateway URL (or secret reference, eg env:SG_URL)")
+	canaryCmd.PersistentFlags().String("owner", "canary", "Owner of the canary jobs")
+	canaryCmd.PersistentFlags().String("expected-hash", "", "Expected sha256 of the result, if the engine is deterministic")
+	canaryCmd.PersistentFlags().String("alert-webhook", "", "Post alerts as json to this url (or secret reference)")
+
+	canaryInterval = canaryCmd.PersistentFlags().Duration("interval", 15*time.Minute, "How often to run the canary")
+	canaryTimeout = canaryCmd.PersistentFlags().Duration("timeout", 30*time.Minute, "Fail the canary if the job takes longer than this")
+	canaryFailureThreshold = canaryCmd.PersistentFlags().Int("failure-threshold", 2, "Alert after this many failures in a row")
+	canaryCloudWatch = canaryCmd.PersistentFlags().Bool("cloudwatch", true, "Publish canary metrics to CloudWatch")
+
+}
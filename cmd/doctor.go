@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+// doctorCmd respresents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Validate the deployment and suggest fixes",
+	Long:  `Validate the deployment end-to-end: database reachability and auth, design docs installed, engine runnable, GPU visible and notifications configured.  Exits with a non-zero status if any check fails (warnings don't count).`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		options := deepstylelib.DoctorOptions{
+			SyncGatewayUrl:      resolveSecretFlag(cmd, "url"),
+			SyncGatewayAdminUrl: resolveSecretFlag(cmd, "admin_url"),
+			UniqushURL:          resolveSecretFlag(cmd, "uniqush-url"),
+			ProcessJobs:         *doctorProcessJobs,
+		}
+		if options.SyncGatewayUrl == "" {
+			log.Printf("ERROR: Missing: --url.\n  %v", cmd.UsageString())
+			return
+		}
+
+		numFailed := 0
+		for _, check := range deepstylelib.RunDoctor(options) {
+			if check.Ok() {
+				fmt.Printf("[OK]   %v\n", check.Name)
+				continue
+			}
+			if check.Warning {
+				fmt.Printf("[WARN] %v\n", check.Name)
+			} else {
+				numFailed += 1
+				fmt.Printf("[FAIL] %v\n", check.Name)
+			}
+			fmt.Printf("       %v\n", check.Err)
+			fmt.Printf("       -> %v\n", check.Remediation)
+		}
+
+		if numFailed > 0 {
+			fmt.Printf("%v check(s) failed\n", numFailed)
+			os.Exit(1)
+		}
+
+	},
+}
+
+var doctorProcessJobs *bool
+
+func init() {
+	RootCmd.AddCommand(doctorCmd)
+
+	doctorCmd.PersistentFlags().String("url", "", "Sync Gateway URL (or secret reference, eg env:SG_URL)")
+	doctorCmd.PersistentFlags().String("admin_url", "", "Sync Gateway Admin URL, to check design docs")
+	doctorCmd.PersistentFlags().String("uniqush-url", "", "Uniqush URL, to check push notifications")
+
+	doctorProcessJobs = doctorCmd.PersistentFlags().BoolP("process-jobs", "p", false, "Check this machine can process jobs (engine + GPU)")
+
+}
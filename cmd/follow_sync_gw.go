@@ -2,15 +2,22 @@ package cmd
 
 import (
 	"log"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/tleyden/deepstyle/deepstylelib"
 )
 
 var (
-	processJobs       *bool
-	sendNotifications *bool
-	since             *string
+	processJobs        *bool
+	sendNotifications  *bool
+	since              *string
+	resultSinks        *[]string
+	hangTimeout        *time.Duration
+	resultVariants     *[]string
+	maxPhotoMegapixels *int
+	notificationWindow *time.Duration
+	interactiveReserve *float64
 )
 
 var follow_sync_gwCmd = &cobra.Command{
@@ -27,8 +34,8 @@ var follow_sync_gwCmd = &cobra.Command{
 
 		// Sync Gateway URL
 		urlFlag := cmd.Flag("url")
-		urlVal := urlFlag.Value.String()
-		log.Printf("url val: %v", urlVal)
+		log.Printf("url val: %v", urlFlag.Value.String())
+		urlVal := resolveSecretFlag(cmd, "url")
 		if urlVal == "" {
 			log.Printf("ERROR: Missing: --url.\n  %v", cmd.UsageString())
 
@@ -37,8 +44,8 @@ var follow_sync_gwCmd = &cobra.Command{
 
 		// Uniqush URL
 		uniqushUrlFlag := cmd.Flag("uniqush-url")
-		uniqushUrlVal := uniqushUrlFlag.Value.String()
-		log.Printf("uniqush url val: %v", uniqushUrlVal)
+		log.Printf("uniqush url val: %v", uniqushUrlFlag.Value.String())
+		uniqushUrlVal := resolveSecretFlag(cmd, "uniqush-url")
 
 		shouldProcessJobs := *processJobs
 		shouldSendNotifications := *sendNotifications
@@ -58,7 +65,45 @@ var follow_sync_gwCmd = &cobra.Command{
 		}
 
 		changesFollower.ProcessJobs = shouldProcessJobs
+		changesFollower.HangTimeout = *hangTimeout
+		changesFollower.ResultVariants = *resultVariants
+		changesFollower.MaxPhotoMegapixels = *maxPhotoMegapixels
 		changesFollower.SendNotifications = shouldSendNotifications
+		changesFollower.NotificationWindow = *notificationWindow
+
+		// Result sinks, eg archive=s3://bucket/path
+		changesFollower.ResultSinks = deepstylelib.ResultSinks{}
+		for _, spec := range *resultSinks {
+			name, sink, err := deepstylelib.ParseResultSinkSpec(spec)
+			if err != nil {
+				log.Panicf("%v", err)
+			}
+			changesFollower.ResultSinks[name] = sink
+		}
+		changesFollower.ResultSinks.VerifyLifecyclePolicies()
+
+		// Keep some workers free for interactive jobs
+		if *interactiveReserve > 0 {
+			capacity, err := deepstylelib.NewCapacityReservation(changesFollower.Database, changesFollower.WorkerId, *interactiveReserve)
+			if err != nil {
+				log.Panicf("%v", err)
+			}
+			changesFollower.Capacity = capacity
+		}
+
+		// Follow worker rollouts
+		if publicKeyVal := cmd.Flag("rollout-public-key").Value.String(); publicKeyVal != "" {
+			publicKey, err := deepstylelib.ParseRolloutPublicKey(publicKeyVal)
+			if err != nil {
+				log.Panicf("%v", err)
+			}
+			updater, err := deepstylelib.NewWorkerUpdater(changesFollower.Database, changesFollower.WorkerId, publicKey)
+			if err != nil {
+				log.Panicf("Error setting up worker updates: %v", err)
+			}
+			changesFollower.Updater = updater
+			log.Printf("Worker %v running version %v, following rollouts", changesFollower.WorkerId, deepstylelib.Version)
+		}
 
 		// Set uniqush url if one was passed in
 		if uniqushUrlVal != "" {
@@ -78,17 +123,31 @@ func init() {
 	// Here you will define your flags and configuration settings
 
 	// Cobra supports Persistent Flags which will work for this command and all subcommands
-	follow_sync_gwCmd.PersistentFlags().String("url", "", "Sync Gateway URL")
+	follow_sync_gwCmd.PersistentFlags().String("url", "", "Sync Gateway URL (or secret reference, eg env:SG_URL)")
 	follow_sync_gwCmd.MarkPersistentFlagRequired("url")
 
-	follow_sync_gwCmd.PersistentFlags().String("uniqush-url", "", "Uniqush URL (push notifications)")
+	follow_sync_gwCmd.PersistentFlags().String("uniqush-url", "", "Uniqush URL (push notifications, or secret reference)")
 
 	processJobs = follow_sync_gwCmd.PersistentFlags().BoolP("process-jobs", "p", false, "Process DeepStyle jobs (requires deps + GPU)")
 
 	sendNotifications = follow_sync_gwCmd.Flags().BoolP("send-notifications", "s", false, "Send push notifications (requires Uniqush url)")
 
+	notificationWindow = follow_sync_gwCmd.PersistentFlags().Duration("notification-window", 0, "Coalesce each user's notifications over this window into one, eg \"12 of your images are ready\" (0 to send one per job)")
+
 	since = follow_sync_gwCmd.PersistentFlags().String("since", "", "Since value to start changes feed at (defaults to last sequence)")
 
+	resultSinks = follow_sync_gwCmd.PersistentFlags().StringSlice("result-sink", []string{}, "Also deliver results to name=url, where url is s3://bucket/path, sftp://user@host/path or file:///path (repeatable)")
+
+	hangTimeout = follow_sync_gwCmd.PersistentFlags().Duration("hang-timeout", 10*time.Minute, "Kill the engine and retry the job on another worker if it produces no output for this long (0 to disable)")
+
+	resultVariants = follow_sync_gwCmd.PersistentFlags().StringSlice("result-variants", []string{}, "Result sizes to produce for jobs that don't ask for specific ones: full, medium, thumbnail")
+
+	maxPhotoMegapixels = follow_sync_gwCmd.PersistentFlags().Int("max-photo-megapixels", deepstylelib.DefaultMaxPhotoMegapixels, "Fail jobs with larger photos, with a PHOTO_TOO_LARGE error code (0 for no limit)")
+
+	interactiveReserve = follow_sync_gwCmd.PersistentFlags().Float64("interactive-reserve", 0, "Fraction of the fleet's workers kept for interactive jobs, batch jobs (eg from import) only run on the rest, eg 0.25")
+
+	follow_sync_gwCmd.PersistentFlags().String("rollout-public-key", "", "Update to new versions published with publish_rollout and signed by this key (from rollout_keygen)")
+
 	// Cobra supports local flags which will only run when this command is called directly
 	// follow_sync_gwCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle" )
 
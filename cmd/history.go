@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+// historyCmd respresents the history command
+var historyCmd = &cobra.Command{
+	Use:   "history <job id>",
+	Short: "Show a job's history, and what it looked like at a given time",
+	Long:  `Show a job's state changes along with any admin actions on it from the audit log, oldest first.  With --at, only up to that time, followed by the job's state and error as of then.  Times are RFC3339, eg 2015-12-01T15:04:05Z`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		urlVal := resolveSecretFlag(cmd, "admin_url")
+		if urlVal == "" || len(args) != 1 {
+			log.Printf("ERROR: Missing: --admin_url or job id.\n  %v", cmd.UsageString())
+			return
+		}
+		jobId := args[0]
+
+		at := time.Now().UTC()
+		atSet := false
+		if atVal := cmd.Flag("at").Value.String(); atVal != "" {
+			var err error
+			if at, err = time.Parse(time.RFC3339, atVal); err != nil {
+				log.Printf("ERROR: Invalid --at: %v", err)
+				return
+			}
+			atSet = true
+		}
+
+		db, err := deepstylelib.GetDbConnection(urlVal)
+		if err != nil {
+			log.Panicf("Error connecting to db: %v.  Err: %v", urlVal, err)
+		}
+
+		jobDoc := deepstylelib.JobDocument{}
+		if err := db.Retrieve(jobId, &jobDoc); err != nil {
+			log.Printf("ERROR: Retrieving job %v: %v", jobId, err)
+			return
+		}
+
+		auditDocs, err := deepstylelib.QueryAuditLog(urlVal, deepstylelib.AuditQuery{AffectedId: jobId, Until: at})
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return
+		}
+
+		type historyLine struct {
+			timestamp time.Time
+			line      string
+		}
+		lines := []historyLine{}
+		for _, entry := range jobDoc.History {
+			if entry.Timestamp.After(at) {
+				continue
+			}
+			lines = append(lines, historyLine{
+				entry.Timestamp,
+				fmt.Sprintf("%v\t%v\t%v\t%v", entry.State, entry.Worker, entry.ErrorCode, entry.ErrorMessage),
+			})
+		}
+		for _, auditDoc := range auditDocs {
+			lines = append(lines, historyLine{
+				auditDoc.Timestamp,
+				fmt.Sprintf("%v\t%v\t%v", auditDoc.Action, auditDoc.Actor, auditDoc.Details),
+			})
+		}
+		sort.SliceStable(lines, func(i, j int) bool {
+			return lines[i].timestamp.Before(lines[j].timestamp)
+		})
+
+		for _, line := range lines {
+			fmt.Printf("%v\t%v\n", line.timestamp.Format(time.RFC3339), line.line)
+		}
+
+		if !atSet {
+			return
+		}
+
+		jobDocAt, err := jobDoc.StateAt(at)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return
+		}
+		fmt.Printf("\nAt %v job %v was %v\n", at.Format(time.RFC3339), jobId, jobDocAt.State)
+		if jobDocAt.ErrorCode != "" || jobDocAt.ErrorMessage != "" {
+			fmt.Printf("Error: %v %v\n", jobDocAt.ErrorCode, jobDocAt.ErrorMessage)
+		}
+		fmt.Printf("Now it is %v\n", jobDoc.State)
+
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(historyCmd)
+
+	historyCmd.PersistentFlags().String("admin_url", "", "Sync Gateway Admin URL (or secret reference, eg env:SG_ADMIN_URL)")
+	historyCmd.PersistentFlags().String("at", "", "Reconstruct the job as it was at this time")
+
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+// importCmd respresents the import command
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Create jobs for all photos in a directory",
+	Long:  `Create jobs for all photos in a directory, eg: deepstyle import --url http://localhost:4984/deepstyle/ --dir ./photos --style starry_night.  Imported photos are recorded in a checkpoint file, so re-running after an interruption resumes where it left off.`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		urlVal := resolveSecretFlag(cmd, "url")
+		dirVal := cmd.Flag("dir").Value.String()
+		styleVal := cmd.Flag("style").Value.String()
+		if urlVal == "" || dirVal == "" || styleVal == "" {
+			log.Printf("ERROR: --url, --dir and --style are required.\n  %v", cmd.UsageString())
+			return
+		}
+
+		styleImagePath, styleName, err := deepstylelib.ResolveStyleImage(styleVal, cmd.Flag("styles-dir").Value.String())
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return
+		}
+
+		db, err := deepstylelib.GetDbConnection(urlVal)
+		if err != nil {
+			log.Printf("ERROR: connecting to db: %v", err)
+			return
+		}
+
+		options := deepstylelib.ImportOptions{
+			Dir:            dirVal,
+			StyleImagePath: styleImagePath,
+			StyleName:      styleName,
+			Owner:          cmd.Flag("owner").Value.String(),
+			Concurrency:    *importConcurrency,
+			CheckpointPath: cmd.Flag("checkpoint").Value.String(),
+			Priority:       cmd.Flag("priority").Value.String(),
+		}
+
+		report, err := deepstylelib.ImportImages(db, options)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return
+		}
+
+		fmt.Printf("Created: %v\n", report.Created)
+		fmt.Printf("Skipped (already imported): %v\n", report.Skipped)
+		fmt.Printf("Failed: %v\n", report.Failed)
+
+		failedPaths := []string{}
+		for photoPath := range report.Failures {
+			failedPaths = append(failedPaths, photoPath)
+		}
+		sort.Strings(failedPaths)
+		for _, photoPath := range failedPaths {
+			fmt.Printf("  %v: %v\n", photoPath, report.Failures[photoPath])
+		}
+
+	},
+}
+
+var importConcurrency *int
+
+func init() {
+	RootCmd.AddCommand(importCmd)
+
+	importCmd.PersistentFlags().String("url", "", "Sync Gateway URL (or secret reference, eg env:SG_URL)")
+	importCmd.PersistentFlags().String("dir", "", "Directory of photos to import")
+	importCmd.PersistentFlags().String("style", "", "Style image path, or name of an image in --styles-dir")
+	importCmd.PersistentFlags().String("styles-dir", "styles", "Directory to look for named styles in")
+	importCmd.PersistentFlags().String("owner", "", "Owner of the created jobs")
+	importCmd.PersistentFlags().String("checkpoint", ".deepstyle-import.checkpoint", "File recording photos already imported")
+	importCmd.PersistentFlags().String("priority", deepstylelib.PriorityBatch, "Priority of the created jobs, batch or interactive (see follow_sync_gw --interactive-reserve)")
+
+	importConcurrency = importCmd.PersistentFlags().Int("concurrency", 4, "Max number of jobs to create at once")
+
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+var (
+	maintenanceRevsLimit     *int
+	maintenanceDeleteJobLogs *bool
+	maintenanceCompact       *bool
+	maintenanceInterval      *time.Duration
+)
+
+// maintenanceCmd respresents the maintenance command
+var maintenanceCmd = &cobra.Command{
+	Use:   "maintenance",
+	Short: "Limit and prune revision history",
+	Long:  `Set (and keep enforcing) the database's revs_limit, delete the job logs of completed jobs, and compact the database after jobs complete, so revision history doesn't bloat replication to mobile clients.  Runs once, or every --interval.`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		urlVal := resolveSecretFlag(cmd, "admin_url")
+		if urlVal == "" {
+			log.Printf("ERROR: Missing: --admin_url.\n  %v", cmd.UsageString())
+			return
+		}
+
+		options := deepstylelib.MaintenanceOptions{
+			RevsLimit:     *maintenanceRevsLimit,
+			DeleteJobLogs: *maintenanceDeleteJobLogs,
+			Compact:       *maintenanceCompact,
+			Interval:      *maintenanceInterval,
+		}
+
+		if err := deepstylelib.RunMaintenance(urlVal, options); err != nil {
+			log.Printf("ERROR: %v", err)
+			return
+		}
+
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(maintenanceCmd)
+
+	maintenanceCmd.PersistentFlags().String("admin_url", "", "Sync Gateway Admin URL (or secret reference, eg env:SG_ADMIN_URL)")
+
+	maintenanceRevsLimit = maintenanceCmd.PersistentFlags().Int("revs-limit", 20, "Revisions Sync Gateway keeps per doc (0 to leave it alone)")
+	maintenanceDeleteJobLogs = maintenanceCmd.PersistentFlags().Bool("delete-job-logs", true, "Delete the job logs of completed jobs")
+	maintenanceCompact = maintenanceCmd.PersistentFlags().Bool("compact", true, "Compact the database when jobs have completed since the last compaction")
+	maintenanceInterval = maintenanceCmd.PersistentFlags().Duration("interval", 0, "Run every interval, eg 1h (default is to run once)")
+
+}
@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os/exec"
-	"path"
+	"path/filepath"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -65,17 +65,17 @@ type item struct {
 
 func (i item) OutputImagePath(outputPath string) string {
 
-	_, paintingFileName := path.Split(i.Painting)
-	_, photoFileName := path.Split(i.Photo)
+	_, paintingFileName := filepath.Split(i.Painting)
+	_, photoFileName := filepath.Split(i.Photo)
 
 	log.Printf("painting: %v, photo: %v", paintingFileName, photoFileName)
 
 	paintingNoExt := strings.Split(paintingFileName, ".")[0]
 	photoNoExt := strings.Split(photoFileName, ".")[0]
-	extension := path.Ext(paintingFileName)
+	extension := filepath.Ext(paintingFileName)
 
 	outputFilename := fmt.Sprintf("%v--%v%v", paintingNoExt, photoNoExt, extension)
-	return path.Join(outputPath, outputFilename)
+	return filepath.Join(outputPath, outputFilename)
 
 }
 
@@ -19,9 +19,7 @@ var publish_cloudwatch_metricsCmd = &cobra.Command{
 			return
 		}
 
-		urlFlag := cmd.Flag("admin_url")
-
-		urlVal := urlFlag.Value.String()
+		urlVal := resolveSecretFlag(cmd, "admin_url")
 		if urlVal == "" {
 			log.Printf("ERROR: Missing: --url.\n  %v", cmd.UsageString())
 			return
@@ -43,7 +41,7 @@ func init() {
 
 	// Cobra supports Persistent Flags which will work for this command and all subcommands
 
-	publish_cloudwatch_metricsCmd.PersistentFlags().String("admin_url", "", "Sync Gateway Admin URL")
+	publish_cloudwatch_metricsCmd.PersistentFlags().String("admin_url", "", "Sync Gateway Admin URL (or secret reference, eg env:SG_ADMIN_URL)")
 
 	// Cobra supports local flags which will only run when this command is called directly
 	// publish_cloudwatch_metricsCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle" )
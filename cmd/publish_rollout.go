@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+var (
+	rolloutBinaries       *[]string
+	rolloutMaxUnavailable *int
+)
+
+// publish_rolloutCmd respresents the publish_rollout command
+var publish_rolloutCmd = &cobra.Command{
+	Use:   "publish_rollout",
+	Short: "Publish a new worker version for workers to update to",
+	Long:  `Sign the binaries for a new worker version and publish the worker_rollout doc.  Workers started with --rollout-public-key update to it, max-unavailable at a time.  Upload the binaries to --base-url first.`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		urlVal := resolveSecretFlag(cmd, "admin_url")
+		if urlVal == "" {
+			log.Printf("ERROR: Missing: --admin_url.\n  %v", cmd.UsageString())
+			return
+		}
+		version := cmd.Flag("version").Value.String()
+		baseUrl := cmd.Flag("base-url").Value.String()
+		if version == "" || baseUrl == "" || len(*rolloutBinaries) == 0 {
+			log.Printf("ERROR: --version, --base-url and --binary are required.\n  %v", cmd.UsageString())
+			return
+		}
+
+		signingKey, err := deepstylelib.ParseRolloutSigningKey(resolveSecretFlag(cmd, "signing-key"))
+		if err != nil {
+			log.Panicf("%v", err)
+		}
+
+		binaries := map[string]deepstylelib.RolloutBinary{}
+		for _, spec := range *rolloutBinaries {
+			parts := strings.SplitN(spec, "=", 2)
+			if len(parts) != 2 {
+				log.Panicf("Invalid --binary %v, expected platform=path, eg linux/amd64=dist/deepstyle-linux-amd64", spec)
+			}
+			platform, binaryPath := parts[0], parts[1]
+			binaryUrl := strings.TrimSuffix(baseUrl, "/") + "/" + filepath.Base(binaryPath)
+			binary, err := deepstylelib.SignRolloutBinary(signingKey, version, platform, binaryPath, binaryUrl)
+			if err != nil {
+				log.Panicf("Error signing %v: %v", binaryPath, err)
+			}
+			binaries[platform] = binary
+		}
+
+		db, err := deepstylelib.GetDbConnection(urlVal)
+		if err != nil {
+			log.Panicf("Error connecting to db: %v", err)
+		}
+
+		rollout, err := deepstylelib.PublishWorkerRollout(db, version, binaries, *rolloutMaxUnavailable)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return
+		}
+
+		log.Printf("Published worker rollout of %v (rev %v)", rollout.Version, rollout.Revision)
+
+	},
+}
+
+// rollout_keygenCmd respresents the rollout_keygen command
+var rollout_keygenCmd = &cobra.Command{
+	Use:   "rollout_keygen",
+	Short: "Generate a key pair for signing worker rollouts",
+	Long:  `Generate an ed25519 key pair for signing worker rollouts.  Give the public key to workers with --rollout-public-key, and keep the signing key secret (eg, pass it to publish_rollout as a secret reference).`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		publicKey, privateKey, err := deepstylelib.GenerateRolloutKeys()
+		if err != nil {
+			log.Panicf("%v", err)
+		}
+		fmt.Printf("public key:  %v\n", publicKey)
+		fmt.Printf("signing key: %v\n", privateKey)
+
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(publish_rolloutCmd)
+	RootCmd.AddCommand(rollout_keygenCmd)
+
+	publish_rolloutCmd.PersistentFlags().String("admin_url", "", "Sync Gateway Admin URL (or secret reference)")
+	publish_rolloutCmd.PersistentFlags().String("version", "", "The version being rolled out, as built into the binaries with -ldflags")
+	publish_rolloutCmd.PersistentFlags().String("base-url", "", "Where the binaries can be downloaded from, eg https://releases.example.com/deepstyle/1.2.0/")
+	publish_rolloutCmd.PersistentFlags().String("signing-key", "", "Signing key from rollout_keygen (or secret reference, eg vault:secret/deepstyle#rollout_key)")
+
+	rolloutBinaries = publish_rolloutCmd.PersistentFlags().StringSlice("binary", []string{}, "platform=path of a binary to sign, eg linux/amd64=dist/deepstyle-linux-amd64 (repeatable)")
+	rolloutMaxUnavailable = publish_rolloutCmd.PersistentFlags().Int("max-unavailable", 1, "Max number of workers updating at once")
+
+}
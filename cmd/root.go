@@ -17,13 +17,23 @@ package cmd
 
 import (
 	"fmt"
+	"log"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/tleyden/deepstyle/deepstylelib"
 )
 
-var cfgFile string
+var (
+	cfgFile          string
+	tlsConfig        deepstylelib.TLSConfig
+	fieldNaming      string
+	envelopeFields   *[]string
+	filenameTemplate string
+	externalStoreUrl string
+)
 
 // This represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
@@ -50,23 +60,108 @@ func init() {
 
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.deepstyle.yaml)")
 
+	RootCmd.PersistentFlags().StringVar(&deepstylelib.AuditActor, "actor", deepstylelib.AuditActor, "Who to record as the actor of admin actions in the audit log")
+
+	RootCmd.PersistentFlags().StringVar(&tlsConfig.CertFile, "tls-cert", "", "Client certificate for mutual TLS (reloaded when changed on disk)")
+	RootCmd.PersistentFlags().StringVar(&tlsConfig.KeyFile, "tls-key", "", "Private key for --tls-cert")
+	RootCmd.PersistentFlags().StringVar(&tlsConfig.CAFile, "tls-ca", "", "CA bundle used to verify the server certificate")
+
+	RootCmd.PersistentFlags().StringVar(&fieldNaming, "field-naming", "snake_case", "Field naming of documents stored in Sync Gateway: snake_case or camelCase")
+	envelopeFields = RootCmd.PersistentFlags().StringSlice("envelope", []string{}, "Add a name=value field to every document stored in Sync Gateway, eg for the sync function (repeatable)")
+	RootCmd.PersistentFlags().StringVar(&externalStoreUrl, "external-store", "", "Put attachments too large for Sync Gateway here and read them back from here: s3://bucket/path or file:///path")
+	RootCmd.PersistentFlags().StringVar(&filenameTemplate, "filename-template", deepstylelib.DefaultFilenameTemplate, "Name of delivered and downloaded files, using {job_id}, {attachment}, {style_name} and {timestamp}, eg {style_name}/{job_id}")
+
 	// Cobra also supports local flags which will only run when this action is called directly
 	RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 
 }
 
+// The value of a flag or, when it isn't passed, the setting of the same name
+// in the config file (eg admin_url: vault:secret/data/deepstyle#admin_url) or
+// environment (eg DEEPSTYLE_ADMIN_URL).
+func configValue(cmd *cobra.Command, name string) string {
+	flag := cmd.Flag(name)
+	if !flag.Changed && viper.IsSet(name) {
+		return viper.GetString(name)
+	}
+	return flag.Value.String()
+}
+
+// Resolve a flag value (or config setting, see configValue) that may be a
+// secret reference (eg, vault:secret/data/deepstyle#url).  Don't log the
+// return value, it might contain credentials.
+func resolveSecretFlag(cmd *cobra.Command, name string) string {
+	value, err := deepstylelib.ResolveSecret(configValue(cmd, name))
+	if err != nil {
+		log.Panicf("Error resolving --%v: %v", name, err)
+	}
+	return value
+}
+
 // Read in config file and ENV variables if set.
 func initConfig() {
 	if cfgFile != "" { // enable ability to specify config file via flag
 		viper.SetConfigFile(cfgFile)
+	} else {
+		// SetConfigName would override the --config file
+		viper.SetConfigName(".deepstyle") // name of config file (without extension)
+		viper.AddConfigPath("$HOME")      // adding home directory as first search path
 	}
-
-	viper.SetConfigName(".deepstyle") // name of config file (without extension)
-	viper.AddConfigPath("$HOME")      // adding home directory as first search path
-	viper.AutomaticEnv()              // read in environment variables that match
+	viper.SetEnvPrefix("deepstyle")   // eg DEEPSTYLE_ADMIN_URL for --admin_url
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
+
+	// these can be secret references too, which ConfigureTLS resolves
+	tlsConfig.CertFile = configValue(RootCmd, "tls-cert")
+	tlsConfig.KeyFile = configValue(RootCmd, "tls-key")
+	tlsConfig.CAFile = configValue(RootCmd, "tls-ca")
+
+	if err := deepstylelib.ConfigureTLS(tlsConfig); err != nil {
+		log.Panicf("Error configuring TLS: %v", err)
+	}
+
+	configureDocumentHooks()
+
+	if err := deepstylelib.SetFilenameTemplate(filenameTemplate); err != nil {
+		log.Panicf("Invalid --filename-template: %v", err)
+	}
+
+	if externalStoreUrl != "" {
+		store, err := deepstylelib.NewExternalStore(externalStoreUrl)
+		if err != nil {
+			log.Panicf("Invalid --external-store: %v", err)
+		}
+		deepstylelib.SetExternalStore(store)
+	}
+}
+
+// Register the document hooks for --field-naming and --envelope
+func configureDocumentHooks() {
+
+	switch fieldNaming {
+	case "snake_case":
+	case "camelCase":
+		deepstylelib.RegisterDocumentHooks(deepstylelib.CamelCaseFieldNameHooks())
+	default:
+		log.Panicf("Invalid --field-naming %v, expected snake_case or camelCase", fieldNaming)
+	}
+
+	if len(*envelopeFields) == 0 {
+		return
+	}
+	envelope := map[string]interface{}{}
+	for _, field := range *envelopeFields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			log.Panicf("Invalid --envelope %v, expected name=value", field)
+		}
+		envelope[parts[0]] = parts[1]
+	}
+	deepstylelib.RegisterDocumentHooks(deepstylelib.EnvelopeHooks(envelope))
+
 }
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+var (
+	lifecycleResultSinks *[]string
+)
+
+// s3_lifecycleCmd respresents the s3_lifecycle command
+var s3_lifecycleCmd = &cobra.Command{
+	Use:   "s3_lifecycle",
+	Short: "Set the lifecycle policies of S3 result sinks",
+	Long:  `Add (or update) the lifecycle rule of each S3 result sink with ia_days, glacier_days or expire_days in its bucket, leaving other rules alone.  Pass the same --result-sink values as the workers.`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		if len(*lifecycleResultSinks) == 0 {
+			log.Printf("ERROR: Missing: --result-sink.\n  %v", cmd.UsageString())
+			return
+		}
+
+		sinks := deepstylelib.ResultSinks{}
+		for _, spec := range *lifecycleResultSinks {
+			name, sink, err := deepstylelib.ParseResultSinkSpec(spec)
+			if err != nil {
+				log.Panicf("%v", err)
+			}
+			sinks[name] = sink
+		}
+
+		if err := sinks.EnsureLifecyclePolicies(); err != nil {
+			log.Printf("ERROR: %v", err)
+			return
+		}
+
+		log.Printf("Lifecycle policies are in place")
+
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(s3_lifecycleCmd)
+
+	lifecycleResultSinks = s3_lifecycleCmd.PersistentFlags().StringSlice("result-sink", []string{}, "name=s3://bucket/path?expire_days=365 of a result sink to set the lifecycle policy of (repeatable)")
+
+}
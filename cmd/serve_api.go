@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/spf13/cobra"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+var (
+	apiCacheMB         *int
+	apiServerTLSConfig deepstylelib.TLSConfig
+)
+
+// serve_apiCmd respresents the serve_api command
+var serve_apiCmd = &cobra.Command{
+	Use:   "serve_api",
+	Short: "Serve the DeepStyle API in front of Sync Gateway",
+	Long:  `Serve the DeepStyle API in front of Sync Gateway.  Callers' credentials are passed through to Sync Gateway, so its access control applies.`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		urlVal := resolveSecretFlag(cmd, "url")
+		if urlVal == "" {
+			log.Printf("ERROR: Missing: --url.\n  %v", cmd.UsageString())
+			return
+		}
+		listenVal := cmd.Flag("listen").Value.String()
+
+		apiServer := deepstylelib.NewAPIServer(urlVal, int64(*apiCacheMB)*1024*1024)
+
+		// Admin endpoints, eg the audit log
+		apiServer.AdminUrl = resolveSecretFlag(cmd, "admin_url")
+		apiServer.AdminToken = resolveSecretFlag(cmd, "admin-token")
+		if apiServer.AdminUrl != "" && apiServer.AdminToken == "" {
+			log.Printf("ERROR: --admin_url needs an --admin-token for callers of the admin endpoints.\n  %v", cmd.UsageString())
+			return
+		}
+		server := &http.Server{
+			Addr:    listenVal,
+			Handler: apiServer,
+		}
+
+		if apiServerTLSConfig.CertFile == "" {
+			log.Printf("Serving API on http://%v", listenVal)
+			log.Fatal(server.ListenAndServe())
+		}
+
+		tlsConfig, err := deepstylelib.NewServerTLSConfig(apiServerTLSConfig)
+		if err != nil {
+			log.Panicf("Error configuring TLS: %v", err)
+		}
+		server.TLSConfig = tlsConfig
+
+		log.Printf("Serving API on https://%v", listenVal)
+		log.Fatal(server.ListenAndServeTLS("", ""))
+
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(serve_apiCmd)
+
+	serve_apiCmd.PersistentFlags().String("url", "", "Sync Gateway URL (or secret reference, eg env:SG_URL)")
+	serve_apiCmd.PersistentFlags().String("listen", ":8080", "Address to listen on")
+	serve_apiCmd.PersistentFlags().String("admin_url", "", "Sync Gateway Admin URL, to serve the admin endpoints (or secret reference)")
+	serve_apiCmd.PersistentFlags().String("admin-token", "", "Bearer token required by the admin endpoints (or secret reference, eg env:DEEPSTYLE_ADMIN_TOKEN)")
+
+	apiCacheMB = serve_apiCmd.PersistentFlags().Int("cache-mb", 64, "Max size of the resized image cache in MB")
+
+	serve_apiCmd.PersistentFlags().StringVar(&apiServerTLSConfig.CertFile, "tls-server-cert", "", "Serve over TLS with this certificate (reloaded when changed on disk)")
+	serve_apiCmd.PersistentFlags().StringVar(&apiServerTLSConfig.KeyFile, "tls-server-key", "", "Private key for --tls-server-cert")
+	serve_apiCmd.PersistentFlags().StringVar(&apiServerTLSConfig.CAFile, "tls-client-ca", "", "Require client certificates signed by this CA (mutual TLS)")
+
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+var (
+	watchStates *[]string
+	watchTags   *[]string
+)
+
+// watch_jobsCmd respresents the watch_jobs command
+var watch_jobsCmd = &cobra.Command{
+	Use:   "watch_jobs",
+	Short: "Print job events as they happen",
+	Long:  `Print created, state_changed, progress and completed events for jobs matching the filters, one per line.`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if err := cmd.ParseFlags(args); err != nil {
+			log.Printf("err: %v", err)
+			return
+		}
+
+		urlVal := resolveSecretFlag(cmd, "url")
+		if urlVal == "" {
+			log.Printf("ERROR: Missing: --url.\n  %v", cmd.UsageString())
+			return
+		}
+
+		client, err := deepstylelib.NewClient(urlVal)
+		if err != nil {
+			log.Panicf("%v", err)
+		}
+
+		filter := deepstylelib.JobFilter{
+			Owner:  cmd.Flag("owner").Value.String(),
+			States: *watchStates,
+			Tags:   *watchTags,
+			Since:  cmd.Flag("since").Value.String(),
+		}
+
+		events, err := client.WatchJobs(context.Background(), filter)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return
+		}
+
+		for event := range events {
+			switch event.Type {
+			case deepstylelib.JobStateChanged:
+				fmt.Printf("%v\t%v\t%v -> %v\n", event.Type, event.Job.Id, event.OldState, event.Job.State)
+			case deepstylelib.JobProgress:
+				fmt.Printf("%v\t%v\t%.0f%%\n", event.Type, event.Job.Id, event.Progress*100)
+			default:
+				fmt.Printf("%v\t%v\t%v\n", event.Type, event.Job.Id, event.Job.State)
+			}
+		}
+
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(watch_jobsCmd)
+
+	watch_jobsCmd.PersistentFlags().String("url", "", "Sync Gateway URL (or secret reference, eg env:SG_URL)")
+	watch_jobsCmd.PersistentFlags().String("owner", "", "Only jobs of this owner")
+	watch_jobsCmd.PersistentFlags().String("since", "", "Changes feed sequence to start from (defaults to now)")
+
+	watchStates = watch_jobsCmd.PersistentFlags().StringSlice("state", []string{}, "Only jobs in these states, eg PROCESSING_SUCCESSFUL")
+	watchTags = watch_jobsCmd.PersistentFlags().StringSlice("tag", []string{}, "Only jobs with all of these tags")
+
+}
@@ -0,0 +1,520 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+/*
+The API sits in front of Sync Gateway for things Sync Gateway can't do itself:
+
+	GET /jobs/{id}           The job doc, plus a user_error_message for failed
+	                         jobs in the language asked for by Accept-Language,
+	                         and an immutable_result_url for successful ones
+	GET /jobs/{id}/result    The result image, resized and converted to
+	                         suit the client (see serveResult)
+	GET /jobs/{id}/logs      The engine output, optionally streamed live
+	                         while the job runs (see serveLogs)
+	GET /results/{id}/{hash} The result image at a content addressed url
+	                         that can be cached forever (see serveImmutableResult)
+	GET /admin/audit         The audit log, for admins (see serveAuditLog)
+
+Responses have an ETag derived from the job's revision, so clients polling
+with If-None-Match get a 304 until the job changes.
+
+Requests are made to Sync Gateway with the caller's Authorization and Cookie
+headers, so Sync Gateway's channel based access control still applies.
+*/
+type APIServer struct {
+	SyncGatewayUrl string
+	AdminUrl       string // Sync Gateway admin url, for the admin endpoints
+	AdminToken     string // Bearer token callers of the admin endpoints need
+	cache          *imageCache
+}
+
+const (
+	maxResultWidth = 4096
+	minResultWidth = 16
+)
+
+// For responses that never change, eg content addressed results
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// Image formats the API can produce, in order of preference
+var apiImageFormats = []string{"image/jpeg", "image/png"}
+
+func NewAPIServer(syncGatewayUrl string, cacheBytes int64) *APIServer {
+	return &APIServer{
+		SyncGatewayUrl: strings.TrimSuffix(syncGatewayUrl, "/"),
+		cache:          newImageCache(cacheBytes),
+	}
+}
+
+func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "jobs":
+		s.serveJob(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "result":
+		s.serveResult(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "logs":
+		s.serveLogs(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "results":
+		s.serveImmutableResult(w, r, parts[1], parts[2])
+	case len(parts) == 2 && parts[0] == "admin" && parts[1] == "audit":
+		s.serveAuditLog(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+
+}
+
+// GET from Sync Gateway as the caller, or with the API's own credentials
+// (if any are in the url) when r is nil.
+func (s *APIServer) syncGatewayGet(r *http.Request, path string) (*http.Response, error) {
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v/%v", s.SyncGatewayUrl, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		for _, header := range []string{"Authorization", "Cookie"} {
+			if value := r.Header.Get(header); value != "" {
+				req.Header.Set(header, value)
+			}
+		}
+	}
+	return http.DefaultClient.Do(req)
+
+}
+
+// GET one of the job's attachments from Sync Gateway (as the caller, unless r
+// is nil), or from the external store if it's too large for Sync Gateway.
+func (s *APIServer) getAttachment(r *http.Request, jobDoc JobDocument, attachment string) (body io.ReadCloser, statusCode int, err error) {
+
+	if location, ok := jobDoc.ExternalAttachments[attachment]; ok {
+		store := getExternalStore()
+		if store == nil {
+			return nil, 0, fmt.Errorf("%v is in %v, but there's no external store configured", attachment, location)
+		}
+		body, err := store.Get(location)
+		return body, 200, err
+	}
+
+	resp, err := s.syncGatewayGet(r, fmt.Sprintf("%v/%v", url.PathEscape(jobDoc.Id), attachment))
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.StatusCode, nil
+
+}
+
+// Retrieve a job doc as the caller, writing an error response if that fails
+func (s *APIServer) retrieveJob(w http.ResponseWriter, r *http.Request, jobId string) (jobDoc JobDocument, ok bool) {
+	jobDoc, _, ok = s.retrieveJobBody(w, r, jobId)
+	return jobDoc, ok
+}
+
+// Same as retrieveJob, but also returns the raw json from Sync Gateway
+func (s *APIServer) retrieveJobBody(w http.ResponseWriter, r *http.Request, jobId string) (jobDoc JobDocument, body []byte, ok bool) {
+
+	resp, err := s.syncGatewayGet(r, url.PathEscape(jobId))
+	if err != nil {
+		log.Printf("Error retrieving job %v: %v", jobId, err)
+		http.Error(w, "Error retrieving job", http.StatusBadGateway)
+		return jobDoc, nil, false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		// pass through 401/403/404 from Sync Gateway
+		http.Error(w, http.StatusText(resp.StatusCode), resp.StatusCode)
+		return jobDoc, nil, false
+	}
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, "Error retrieving job", http.StatusBadGateway)
+		return jobDoc, nil, false
+	}
+
+	if err := json.Unmarshal(body, &jobDoc); err != nil {
+		http.Error(w, "Error decoding job", http.StatusBadGateway)
+		return jobDoc, nil, false
+	}
+	if !jobDoc.IsJob() {
+		http.NotFound(w, r)
+		return jobDoc, nil, false
+	}
+	return jobDoc, body, true
+
+}
+
+// Set the ETag, and if the client already has that version (If-None-Match)
+// respond with a 304 and return true.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+
+}
+
+func (s *APIServer) serveJob(w http.ResponseWriter, r *http.Request, jobId string) {
+
+	jobDoc, body, ok := s.retrieveJobBody(w, r, jobId)
+	if !ok {
+		return
+	}
+
+	etag := fmt.Sprintf(`"%v"`, jobDoc.Revision)
+	extraFields := map[string]string{}
+
+	// add the error message for failed jobs, in the caller's language
+	locales := ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if userErrorMessage := jobDoc.UserErrorMessage(locales...); userErrorMessage != "" {
+		extraFields["user_error_message"] = userErrorMessage
+		w.Header().Set("Vary", "Accept-Language")
+		etag = fmt.Sprintf(`"%v/%v"`, jobDoc.Revision, strings.Join(locales, ","))
+	}
+
+	// and where to get the result from a CDN
+	if resultPath := jobDoc.ImmutableResultPath(); resultPath != "" {
+		extraFields["immutable_result_url"] = resultPath
+	}
+
+	if len(extraFields) > 0 {
+		var err error
+		if body, err = withFields(body, extraFields); err != nil {
+			http.Error(w, "Error decoding job", http.StatusBadGateway)
+			return
+		}
+	}
+
+	if checkNotModified(w, r, etag) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == "HEAD" {
+		return
+	}
+	w.Write(body)
+
+}
+
+// Add fields (eg user_error_message) to the raw job json, named as the
+// document hooks store fields (eg userErrorMessage with camelCase) so they
+// match the rest of it.
+func withFields(body []byte, extraFields map[string]string) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range extraFields {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		fields[storedFieldName(name)] = encoded
+	}
+	return json.Marshal(fields)
+}
+
+// Pick the image format from the format query param (jpeg or png), or
+// otherwise the Accept header.
+func negotiateImageFormat(r *http.Request) (contentType string, err error) {
+
+	if format := r.URL.Query().Get("format"); format != "" {
+		switch strings.ToLower(format) {
+		case "jpeg", "jpg":
+			return "image/jpeg", nil
+		case "png":
+			return "image/png", nil
+		}
+		return "", fmt.Errorf("Unsupported format: %v", format)
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return apiImageFormats[0], nil
+	}
+
+	bestQuality := 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				quality, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		for _, format := range apiImageFormats {
+			if mediaType == format || mediaType == "image/*" || mediaType == "*/*" {
+				if quality > bestQuality {
+					contentType = format
+					bestQuality = quality
+				}
+				break
+			}
+		}
+	}
+
+	if contentType == "" {
+		return "", fmt.Errorf("None of %v are acceptable", strings.Join(apiImageFormats, ", "))
+	}
+	return contentType, nil
+
+}
+
+// The width asked for in the width query param or Width client hint.  When
+// neither is given, clients that send Save-Data get the medium size.
+// Returns 0 for the full size.
+func requestedWidth(r *http.Request) (int, error) {
+
+	widthStr := r.URL.Query().Get("width")
+	if widthStr == "" {
+		widthStr = r.Header.Get("Width")
+	}
+	if widthStr == "" {
+		if strings.EqualFold(r.Header.Get("Save-Data"), "on") {
+			return resultVariantSizes[VariantMedium], nil
+		}
+		return 0, nil
+	}
+
+	width, err := strconv.Atoi(widthStr)
+	if err != nil || width < minResultWidth || width > maxResultWidth {
+		return 0, fmt.Errorf("Width must be between %v and %v", minResultWidth, maxResultWidth)
+	}
+	return width, nil
+
+}
+
+// The smallest pre-generated variant that is at least width wide, to
+// save downloading the full size result from Sync Gateway.
+func resultAttachmentForWidth(jobDoc JobDocument, width int) string {
+
+	attachment := ResultImageAttachment
+	if width == 0 {
+		return attachment
+	}
+
+	smallestWidth := 0
+	for _, info := range jobDoc.ResultManifest {
+		if info.Width < width {
+			continue
+		}
+		if smallestWidth == 0 || info.Width < smallestWidth {
+			attachment = info.Attachment
+			smallestWidth = info.Width
+		}
+	}
+	return attachment
+
+}
+
+func encodeImage(img image.Image, contentType string) ([]byte, error) {
+	var buffer bytes.Buffer
+	var err error
+	switch contentType {
+	case "image/png":
+		err = png.Encode(&buffer, img)
+	default:
+		err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: 90})
+	}
+	return buffer.Bytes(), err
+}
+
+// Serve the result image, resized to the requested width (never scaled up)
+// and in the negotiated format.  Rendered images are cached by job revision.
+func (s *APIServer) serveResult(w http.ResponseWriter, r *http.Request, jobId string) {
+
+	contentType, err := negotiateImageFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	width, err := requestedWidth(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jobDoc, ok := s.retrieveJob(w, r, jobId)
+	if !ok {
+		return
+	}
+	if !jobDoc.IsProcessingSuccessful() {
+		http.Error(w, "Result not available", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept, Save-Data, Width")
+
+	// each width and format is a different representation
+	etag := fmt.Sprintf(`"%v/%v/%v"`, jobDoc.Revision, width, strings.TrimPrefix(contentType, "image/"))
+	if checkNotModified(w, r, etag) {
+		return
+	}
+
+	cacheKey := fmt.Sprintf("%v@%v/%v/%v", jobDoc.Id, jobDoc.Revision, width, contentType)
+	attachment := resultAttachmentForWidth(jobDoc, width)
+	if cachedContentType, data, ok := s.cache.Get(cacheKey); ok {
+		w.Header().Set("Content-Disposition", contentDisposition(jobDoc, attachment, imageExtension(cachedContentType)))
+		writeImage(w, r, cachedContentType, data)
+		return
+	}
+
+	body, statusCode, err := s.getAttachment(r, jobDoc, attachment)
+	if err != nil {
+		log.Printf("Error retrieving %v for job %v: %v", attachment, jobDoc.Id, err)
+		http.Error(w, "Error retrieving result", http.StatusBadGateway)
+		return
+	}
+	defer body.Close()
+	if statusCode != 200 {
+		http.Error(w, http.StatusText(statusCode), statusCode)
+		return
+	}
+
+	img, _, err := image.Decode(body)
+	if err != nil {
+		log.Printf("Error decoding %v for job %v: %v", attachment, jobDoc.Id, err)
+		http.Error(w, "Error decoding result", http.StatusBadGateway)
+		return
+	}
+
+	bounds := img.Bounds()
+	if width > 0 && width < bounds.Dx() {
+		img = scaleImage(img, width, bounds.Dy()*width/bounds.Dx())
+	}
+
+	data, err := encodeImage(img, contentType)
+	if err != nil {
+		http.Error(w, "Error encoding result", http.StatusInternalServerError)
+		return
+	}
+
+	s.cache.Add(cacheKey, contentType, data)
+	w.Header().Set("Content-Disposition", contentDisposition(jobDoc, attachment, imageExtension(contentType)))
+	writeImage(w, r, contentType, data)
+
+}
+
+func imageExtension(contentType string) string {
+	if contentType == "image/png" {
+		return "png"
+	}
+	return "jpg"
+}
+
+func writeImage(w http.ResponseWriter, r *http.Request, contentType string, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method == "HEAD" {
+		return
+	}
+	w.Write(data)
+}
+
+// Serve the full size result at /results/{id}/{hash}.  The hash is the sha256
+// of the result, so the response never changes and can be cached forever by
+// clients and CDNs.  Since the hash can't be guessed, the url works like a
+// capability: it's retrieved with the API's own credentials rather than the
+// caller's, so a CDN doesn't need to pass any through.
+func (s *APIServer) serveImmutableResult(w http.ResponseWriter, r *http.Request, jobId, hash string) {
+
+	hash = strings.TrimSuffix(hash, path.Ext(hash))
+
+	jobDoc := JobDocument{}
+	resp, err := s.syncGatewayGet(nil, url.PathEscape(jobId))
+	if err != nil {
+		http.Error(w, "Error retrieving job", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || json.NewDecoder(resp.Body).Decode(&jobDoc) != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !jobDoc.IsJob() || jobDoc.ResultHash == "" || jobDoc.ResultHash != hash {
+		http.NotFound(w, r)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%v"`, hash)
+	if r.Header.Get("If-None-Match") == etag {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", immutableCacheControl)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body, statusCode, err := s.getAttachment(nil, jobDoc, ResultImageAttachment)
+	if err != nil {
+		http.Error(w, "Error retrieving result", http.StatusBadGateway)
+		return
+	}
+	defer body.Close()
+	if statusCode != 200 {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, "Error retrieving result", http.StatusBadGateway)
+		return
+	}
+
+	// never serve something else under this url, even if the job changed
+	// between the two requests
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	contentType := http.DetectContentType(data)
+	w.Header().Set("Content-Disposition", contentDisposition(jobDoc, ResultImageAttachment, imageExtension(contentType)))
+	writeImage(w, r, contentType, data)
+
+}
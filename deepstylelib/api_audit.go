@@ -0,0 +1,79 @@
+package deepstylelib
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+Serve the audit log to admins:
+
+	GET /admin/audit?since=2016-01-02T15:04:05Z&until=...&id=job1&action=CANCEL
+
+All the params are optional, and the entries are returned oldest first as a
+json array.  This needs the API server's AdminUrl, and since it bypasses
+Sync Gateway's access control, callers must send the AdminToken as a bearer
+token.
+*/
+func (s *APIServer) serveAuditLog(w http.ResponseWriter, r *http.Request) {
+
+	if s.AdminUrl == "" || s.AdminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="deepstyle admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query, err := parseAuditQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	auditDocs, err := QueryAuditLog(s.AdminUrl, query)
+	if err != nil {
+		log.Printf("Error querying audit log: %v", err)
+		http.Error(w, "Error querying audit log", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(auditDocs); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+
+}
+
+func parseAuditQuery(r *http.Request) (AuditQuery, error) {
+
+	params := r.URL.Query()
+	query := AuditQuery{
+		AffectedId: params.Get("id"),
+		Action:     params.Get("action"),
+	}
+
+	var err error
+	if since := params.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return query, fmt.Errorf("Invalid since, expected RFC3339: %v", since)
+		}
+	}
+	if until := params.Get("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return query, fmt.Errorf("Invalid until, expected RFC3339: %v", until)
+		}
+	}
+	return query, nil
+
+}
@@ -0,0 +1,231 @@
+package deepstylelib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often a followed job log is polled.  Workers only append to the log
+// every JobLogFlushInterval, so there's no point polling much faster.
+var jobLogPollInterval = time.Second
+
+/*
+Serve the engine output of a job from its job log doc.
+
+	GET /jobs/{id}/logs                The output so far, as text/plain
+	GET /jobs/{id}/logs?follow=true    Keep streaming new output until the job
+	                                   succeeds or fails
+
+When following, clients that accept text/event-stream get server sent events,
+with the log offset as the event id so that EventSource reconnects (with
+Last-Event-ID) resume where they left off.  Other clients get a chunked
+text/plain response.  The offset query param also resumes from an offset.
+*/
+func (s *APIServer) serveLogs(w http.ResponseWriter, r *http.Request, jobId string) {
+
+	// also checks the caller can see the job
+	jobDoc, ok := s.retrieveJob(w, r, jobId)
+	if !ok {
+		return
+	}
+
+	offset, err := requestedLogOffset(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logDoc, err := s.retrieveJobLog(r, jobDoc)
+	if err != nil {
+		log.Printf("Error retrieving log for job %v: %v", jobDoc.Id, err)
+		http.Error(w, "Error retrieving job log", http.StatusBadGateway)
+		return
+	}
+
+	if r.URL.Query().Get("follow") != "true" {
+		output, _ := logDoc.OutputSince(offset)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Log-Offset", strconv.FormatInt(logDoc.Offset, 10))
+		if r.Method == "HEAD" {
+			return
+		}
+		io.WriteString(w, output)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var stream logStream = plainLogStream{w}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		stream = sseLogStream{w}
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // don't let nginx buffer it
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(jobLogPollInterval)
+	defer ticker.Stop()
+
+	for {
+
+		output, startOffset := logDoc.OutputSince(offset)
+		if startOffset > offset {
+			stream.Dropped(startOffset - offset)
+		}
+		if output != "" {
+			stream.Output(output, logDoc.Offset)
+		}
+		offset = logDoc.Offset
+		flusher.Flush()
+
+		if jobDoc.IsProcessingSuccessful() || jobDoc.IsProcessingFailed() {
+			stream.Done(jobDoc.State)
+			flusher.Flush()
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		// check the state before the log, so the last of the output
+		// is picked up before stopping
+		if jobDoc, err = s.retrieveJobAsCaller(r, jobDoc.Id); err != nil {
+			log.Printf("Error retrieving job %v while following log: %v", jobId, err)
+			return
+		}
+		if logDoc, err = s.retrieveJobLog(r, jobDoc); err != nil {
+			log.Printf("Error retrieving log for job %v while following: %v", jobId, err)
+			return
+		}
+
+	}
+
+}
+
+// The offset to start from, given by the offset query param or the
+// Last-Event-ID header of a reconnecting EventSource.
+func requestedLogOffset(r *http.Request) (int64, error) {
+	offsetStr := r.URL.Query().Get("offset")
+	if offsetStr == "" {
+		offsetStr = r.Header.Get("Last-Event-ID")
+	}
+	if offsetStr == "" {
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(offsetStr, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("Invalid offset: %v", offsetStr)
+	}
+	return offset, nil
+}
+
+func (s *APIServer) retrieveJobAsCaller(r *http.Request, jobId string) (jobDoc JobDocument, err error) {
+	resp, err := s.syncGatewayGet(r, url.PathEscape(jobId))
+	if err != nil {
+		return jobDoc, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return jobDoc, fmt.Errorf("Unexpected status retrieving job: %v", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&jobDoc)
+	return jobDoc, err
+}
+
+// Retrieve the job's log doc as the caller.  Jobs that haven't produced any
+// output yet don't have one, and jobs that finished before there were job
+// logs only have their std_out_and_err.
+func (s *APIServer) retrieveJobLog(r *http.Request, jobDoc JobDocument) (logDoc JobLogDocument, err error) {
+
+	resp, err := s.syncGatewayGet(r, url.PathEscape(JobLogDocId(jobDoc.Id)))
+	if err != nil {
+		return logDoc, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		err = json.NewDecoder(resp.Body).Decode(&logDoc)
+		return logDoc, err
+	case 404:
+		logDoc.Output = jobDoc.StdOutAndErr
+		logDoc.Offset = int64(len(jobDoc.StdOutAndErr))
+		return logDoc, nil
+	default:
+		return logDoc, fmt.Errorf("Unexpected status retrieving job log: %v", resp.Status)
+	}
+
+}
+
+type logStream interface {
+	Output(output string, offset int64)
+	Dropped(numBytes int64)
+	Done(state string)
+}
+
+type plainLogStream struct {
+	w io.Writer
+}
+
+func (s plainLogStream) Output(output string, offset int64) {
+	io.WriteString(s.w, output)
+}
+
+func (s plainLogStream) Dropped(numBytes int64) {
+	fmt.Fprintf(s.w, "\n[... %v bytes of output dropped ...]\n", numBytes)
+}
+
+func (s plainLogStream) Done(state string) {}
+
+type sseLogStream struct {
+	w io.Writer
+}
+
+func (s sseLogStream) Output(output string, offset int64) {
+	writeServerSentEvent(s.w, "", strconv.FormatInt(offset, 10), output)
+}
+
+func (s sseLogStream) Dropped(numBytes int64) {
+	writeServerSentEvent(s.w, "dropped", "", strconv.FormatInt(numBytes, 10))
+}
+
+func (s sseLogStream) Done(state string) {
+	writeServerSentEvent(s.w, "done", "", state)
+}
+
+// Write a server sent event, splitting the data over multiple data: lines
+// since it can't contain newlines.
+func writeServerSentEvent(w io.Writer, event, id, data string) {
+	if event != "" {
+		fmt.Fprintf(w, "event: %v\n", event)
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %v\n", id)
+	}
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %v\n", strings.TrimSuffix(line, "\r"))
+	}
+	io.WriteString(w, "\n")
+}
@@ -0,0 +1,179 @@
+package deepstylelib
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type serverSentEvent struct {
+	event string
+	id    string
+	data  string
+}
+
+func readServerSentEvent(t *testing.T, reader *bufio.Reader) serverSentEvent {
+	t.Helper()
+	event := serverSentEvent{}
+	dataLines := []string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ": "); i >= 0 {
+			field, value = line[:i], line[i+2:]
+		}
+		switch field {
+		case "event":
+			event.event = value
+		case "id":
+			event.id = value
+		case "data":
+			dataLines = append(dataLines, value)
+		}
+	}
+	event.data = strings.Join(dataLines, "\n")
+	return event
+}
+
+// An API server in front of a fake Sync Gateway, polling the job log often
+func newLogsTestServer(t *testing.T) (*fakeSyncGateway, *httptest.Server) {
+
+	pollInterval := jobLogPollInterval
+	jobLogPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { jobLogPollInterval = pollInterval })
+
+	sg := newFakeSyncGateway(t)
+	api := httptest.NewServer(NewAPIServer(sg.DBURL(), 0))
+	t.Cleanup(api.Close)
+	return sg, api
+
+}
+
+func putJobWithLog(t *testing.T, sg *fakeSyncGateway, jobId, state, output string, offset int64) {
+	jobDoc := JobDocument{State: state}
+	jobDoc.Type = Job
+	sg.put(t, jobId, jobDoc)
+	putJobLog(t, sg, jobId, output, offset)
+}
+
+func putJobLog(t *testing.T, sg *fakeSyncGateway, jobId, output string, offset int64) {
+	logDoc := JobLogDocument{JobId: jobId, Output: output, Offset: offset}
+	logDoc.Type = JobLog
+	sg.put(t, JobLogDocId(jobId), logDoc)
+}
+
+func followLogs(t *testing.T, api *httptest.Server, jobId, lastEventId string) *bufio.Reader {
+
+	req, err := http.NewRequest("GET", api.URL+"/jobs/"+jobId+"/logs?follow=true", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return bufio.NewReader(resp.Body)
+
+}
+
+func TestServeLogsFollow(t *testing.T) {
+
+	sg, api := newLogsTestServer(t)
+	putJobWithLog(t, sg, "job1", StateBeingProcessed, "Iteration 1 / 10\n", 17)
+
+	events := followLogs(t, api, "job1", "")
+	assert.Equal(t, serverSentEvent{id: "17", data: "Iteration 1 / 10\n"}, readServerSentEvent(t, events))
+
+	// the log before the state, as the worker does
+	putJobLog(t, sg, "job1", "Iteration 1 / 10\nIteration 2 / 10\n", 34)
+	jobDoc := JobDocument{}
+	sg.get(t, "job1", &jobDoc)
+	jobDoc.State = StateProcessingSuccessful
+	sg.put(t, "job1", jobDoc)
+
+	assert.Equal(t, serverSentEvent{id: "34", data: "Iteration 2 / 10\n"}, readServerSentEvent(t, events))
+	assert.Equal(t, serverSentEvent{event: "done", data: StateProcessingSuccessful}, readServerSentEvent(t, events))
+
+}
+
+func TestServeLogsFollowResume(t *testing.T) {
+
+	sg, api := newLogsTestServer(t)
+	putJobWithLog(t, sg, "job1", StateProcessingFailed, "abc\ndef\n", 8)
+
+	// an EventSource reconnecting after the event with id 4
+	events := followLogs(t, api, "job1", "4")
+	assert.Equal(t, serverSentEvent{id: "8", data: "def\n"}, readServerSentEvent(t, events))
+	assert.Equal(t, serverSentEvent{event: "done", data: StateProcessingFailed}, readServerSentEvent(t, events))
+
+}
+
+func TestServeLogsFollowDropped(t *testing.T) {
+
+	sg, api := newLogsTestServer(t)
+	// only the last 10 bytes of the 1000 are kept
+	putJobWithLog(t, sg, "job1", StateProcessingSuccessful, "0123456789", 1000)
+
+	events := followLogs(t, api, "job1", "100")
+	assert.Equal(t, serverSentEvent{event: "dropped", data: "890"}, readServerSentEvent(t, events))
+	assert.Equal(t, serverSentEvent{id: "1000", data: "0123456789"}, readServerSentEvent(t, events))
+	assert.Equal(t, serverSentEvent{event: "done", data: StateProcessingSuccessful}, readServerSentEvent(t, events))
+
+}
+
+func TestServeLogsFollowLogDeleted(t *testing.T) {
+
+	sg, api := newLogsTestServer(t)
+	putJobWithLog(t, sg, "job1", StateBeingProcessed, "Iteration 1 / 10\n", 17)
+
+	events := followLogs(t, api, "job1", "")
+	assert.Equal(t, serverSentEvent{id: "17", data: "Iteration 1 / 10\n"}, readServerSentEvent(t, events))
+
+	// the job completes and maintenance deletes its log, so the rest of the
+	// output is only in std_out_and_err
+	jobDoc := JobDocument{}
+	sg.get(t, "job1", &jobDoc)
+	jobDoc.State = StateProcessingSuccessful
+	jobDoc.StdOutAndErr = "Iteration 1 / 10\nIteration 10 / 10\n"
+	sg.put(t, "job1", jobDoc)
+	sg.remove(JobLogDocId("job1"))
+
+	assert.Equal(t, serverSentEvent{id: "35", data: "Iteration 10 / 10\n"}, readServerSentEvent(t, events))
+	assert.Equal(t, serverSentEvent{event: "done", data: StateProcessingSuccessful}, readServerSentEvent(t, events))
+
+}
+
+func TestServeLogsFollowPlain(t *testing.T) {
+
+	sg, api := newLogsTestServer(t)
+	putJobWithLog(t, sg, "job1", StateProcessingSuccessful, "abc\ndef\n", 8)
+
+	resp, err := http.Get(api.URL + "/jobs/job1/logs?follow=true&offset=4")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "def\n", string(body))
+
+}
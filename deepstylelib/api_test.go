@@ -0,0 +1,256 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateImageFormat(t *testing.T) {
+
+	r := httptest.NewRequest("GET", "/jobs/foo/result", nil)
+	contentType, err := negotiateImageFormat(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", contentType)
+
+	r.Header.Set("Accept", "image/webp, image/png;q=0.9, */*;q=0.1")
+	contentType, err = negotiateImageFormat(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", contentType)
+
+	r.Header.Set("Accept", "image/webp")
+	_, err = negotiateImageFormat(r)
+	assert.Error(t, err)
+
+	// the query param wins over the Accept header
+	r = httptest.NewRequest("GET", "/jobs/foo/result?format=png", nil)
+	r.Header.Set("Accept", "image/jpeg")
+	contentType, err = negotiateImageFormat(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", contentType)
+
+}
+
+func TestCheckNotModified(t *testing.T) {
+
+	r := httptest.NewRequest("GET", "/jobs/foo", nil)
+	w := httptest.NewRecorder()
+	assert.False(t, checkNotModified(w, r, `"2-abc"`))
+	assert.Equal(t, `"2-abc"`, w.Header().Get("ETag"))
+
+	r.Header.Set("If-None-Match", `"1-def", W/"2-abc"`)
+	w = httptest.NewRecorder()
+	assert.True(t, checkNotModified(w, r, `"2-abc"`))
+	assert.Equal(t, 304, w.Code)
+
+	r.Header.Set("If-None-Match", `"1-def"`)
+	w = httptest.NewRecorder()
+	assert.False(t, checkNotModified(w, r, `"2-abc"`))
+
+}
+
+func TestRequestedWidth(t *testing.T) {
+
+	r := httptest.NewRequest("GET", "/jobs/foo/result?width=320", nil)
+	width, err := requestedWidth(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 320, width)
+
+	r = httptest.NewRequest("GET", "/jobs/foo/result", nil)
+	r.Header.Set("Save-Data", "on")
+	width, err = requestedWidth(r)
+	assert.NoError(t, err)
+	assert.Equal(t, resultVariantSizes[VariantMedium], width)
+
+	r = httptest.NewRequest("GET", "/jobs/foo/result?width=100000", nil)
+	_, err = requestedWidth(r)
+	assert.Error(t, err)
+
+}
+
+func TestWriteServerSentEvent(t *testing.T) {
+
+	var buffer bytes.Buffer
+	writeServerSentEvent(&buffer, "", "42", "Iteration 1 / 10\nIteration 2 / 10")
+	assert.Equal(t, "id: 42\ndata: Iteration 1 / 10\ndata: Iteration 2 / 10\n\n", buffer.String())
+
+	buffer.Reset()
+	writeServerSentEvent(&buffer, "done", "", StateProcessingSuccessful)
+	assert.Equal(t, "event: done\ndata: PROCESSING_SUCCESSFUL\n\n", buffer.String())
+
+}
+
+func TestRequestedLogOffset(t *testing.T) {
+
+	r := httptest.NewRequest("GET", "/jobs/foo/logs?follow=true", nil)
+	offset, err := requestedLogOffset(r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), offset)
+
+	r.Header.Set("Last-Event-ID", "1024")
+	offset, err = requestedLogOffset(r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1024), offset)
+
+	r = httptest.NewRequest("GET", "/jobs/foo/logs?offset=-1", nil)
+	_, err = requestedLogOffset(r)
+	assert.Error(t, err)
+
+}
+
+func TestServeAuditLog(t *testing.T) {
+
+	var viewQuery url.Values
+	syncGw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/deepstyle/_design/audit_log/_view/audit_log", r.URL.Path)
+		viewQuery = r.URL.Query()
+		w.Write([]byte(`{"rows":[
+			{"id":"audit::1","value":{"type":"audit","action":"RESET_STUCK_JOB","timestamp":"2016-01-02T15:04:05Z","affected_ids":["job1"]}},
+			{"id":"audit::2","value":{"type":"audit","action":"RESET_STUCK_JOB","timestamp":"2016-01-02T15:04:06Z","affected_ids":["job2"]}}
+		]}`))
+	}))
+	defer syncGw.Close()
+
+	s := NewAPIServer(syncGw.URL+"/deepstyle", 0)
+	s.AdminUrl = syncGw.URL + "/deepstyle/"
+
+	// not served without a token configured
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/admin/audit", nil))
+	assert.Equal(t, 404, w.Code)
+
+	s.AdminToken = "secret"
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/admin/audit", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	s.ServeHTTP(w, r)
+	assert.Equal(t, 401, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/admin/audit?id=job2&since=2016-01-02T15:04:05Z", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	s.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+
+	// the view is only read from (a second before) since
+	assert.Equal(t, `"2016-01-02T15:04:04Z"`, viewQuery.Get("startkey"))
+	assert.Equal(t, "", viewQuery.Get("endkey"))
+
+	auditDocs := []AuditDocument{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &auditDocs))
+	assert.Len(t, auditDocs, 1)
+	assert.Equal(t, "audit::2", auditDocs[0].Id)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/admin/audit?since=yesterday", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	s.ServeHTTP(w, r)
+	assert.Equal(t, 400, w.Code)
+
+}
+
+func TestServeImmutableResult(t *testing.T) {
+
+	result := []byte("\xff\xd8\xff\xe0 not really a jpeg")
+	sum := sha256.Sum256(result)
+	resultHash := hex.EncodeToString(sum[:])
+
+	jobDoc := successfulJobDoc("job1", resultHash)
+	attachment := result
+
+	syncGw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/deepstyle/job1":
+			json.NewEncoder(w).Encode(jobDoc)
+		case "/deepstyle/job1/result_image":
+			w.Write(attachment)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer syncGw.Close()
+
+	s := NewAPIServer(syncGw.URL+"/deepstyle", 0)
+	get := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// the job points at it
+	w := get("/jobs/job1", "")
+	assert.Equal(t, 200, w.Code)
+	fields := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &fields))
+	resultPath := "/results/job1/" + resultHash + ".jpg"
+	assert.Equal(t, resultPath, fields["immutable_result_url"])
+
+	w = get(resultPath, "")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, immutableCacheControl, w.Header().Get("Cache-Control"))
+	assert.Equal(t, result, w.Body.Bytes())
+
+	w = get(resultPath, `"`+resultHash+`"`)
+	assert.Equal(t, 304, w.Code)
+
+	// not the job's hash
+	w = get("/results/job1/"+strings.Repeat("0", 64)+".jpg", "")
+	assert.Equal(t, 404, w.Code)
+
+	// no such job
+	w = get("/results/job2/"+resultHash+".jpg", "")
+	assert.Equal(t, 404, w.Code)
+
+	// the attachment no longer matches the hash, eg the job changed
+	attachment = []byte("something else")
+	w = get(resultPath, "")
+	assert.Equal(t, 404, w.Code)
+
+}
+
+func TestWithFields(t *testing.T) {
+
+	body := []byte(`{"_id":"job1","state":"PROCESSING_FAILED","error_code":"OUT_OF_MEMORY"}`)
+	extraFields := map[string]string{"user_error_message": "Your photo was too big to process, try a smaller one"}
+
+	withExtraFields, err := withFields(body, extraFields)
+	assert.NoError(t, err)
+	fields := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(withExtraFields, &fields))
+	assert.Equal(t, extraFields["user_error_message"], fields["user_error_message"])
+	assert.Equal(t, "job1", fields["_id"])
+
+	// named like the rest of the body
+	defer resetDocumentHooks()
+	RegisterDocumentHooks(CamelCaseFieldNameHooks())
+	body = []byte(`{"_id":"job1","state":"PROCESSING_FAILED","errorCode":"OUT_OF_MEMORY"}`)
+	withExtraFields, err = withFields(body, extraFields)
+	assert.NoError(t, err)
+	fields = map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(withExtraFields, &fields))
+	assert.Equal(t, extraFields["user_error_message"], fields["userErrorMessage"])
+	_, ok := fields["user_error_message"]
+	assert.False(t, ok)
+
+}
+
+// A successful job with the given result hash, as Sync Gateway returns it
+func successfulJobDoc(id, resultHash string) JobDocument {
+	jobDoc := JobDocument{State: StateProcessingSuccessful, ResultHash: resultHash}
+	jobDoc.Id = id
+	jobDoc.Revision = "5-abc"
+	jobDoc.Type = Job
+	return jobDoc
+}
@@ -0,0 +1,195 @@
+package deepstylelib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/tleyden/go-couch"
+)
+
+const (
+	AuditDesignDocName = "audit_log"
+	AuditViewName      = "audit_log"
+)
+
+// Admin actions recorded in the audit log.  Add one here along with the
+// RecordAudit call for any new admin action.
+const (
+	AuditActionResetStuckJob = "RESET_STUCK_JOB"
+	AuditActionWorkerRollout = "WORKER_ROLLOUT"
+)
+
+// Who is performing admin actions.  Defaults to user@hostname.
+var AuditActor = defaultAuditActor()
+
+// An audit document is written once and never updated, the sync function
+// (see docs/sync-gateway-config.json) rejects any changes to existing ones.
+type AuditDocument struct {
+	TypedDocument
+	Actor       string    `json:"actor"`
+	Action      string    `json:"action"`
+	Timestamp   time.Time `json:"timestamp"`
+	AffectedIds []string  `json:"affected_ids"`
+	Details     string    `json:"details,omitempty"`
+}
+
+func defaultAuditActor() string {
+	username := "unknown"
+	if currentUser, err := user.Current(); err == nil {
+		username = currentUser.Username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return username
+	}
+	return fmt.Sprintf("%v@%v", username, hostname)
+}
+
+func newAuditDocId(timestamp time.Time) string {
+	randomBytes := make([]byte, 4)
+	rand.Read(randomBytes)
+	return fmt.Sprintf(
+		"audit::%v::%v",
+		timestamp.Format(time.RFC3339Nano),
+		hex.EncodeToString(randomBytes),
+	)
+}
+
+// Record an admin action in the audit log
+func RecordAudit(db couch.Database, action string, affectedIds []string, details string) error {
+
+	timestamp := time.Now().UTC()
+
+	auditDoc := AuditDocument{
+		Actor:       AuditActor,
+		Action:      action,
+		Timestamp:   timestamp,
+		AffectedIds: affectedIds,
+		Details:     details,
+	}
+	auditDoc.Type = Audit
+
+	_, _, err := db.InsertWith(auditDoc, newAuditDocId(timestamp))
+	if err != nil {
+		return fmt.Errorf("Error recording audit of %v on %v: %v", action, affectedIds, err)
+	}
+	log.Printf("Audit: %v %v %v", AuditActor, action, affectedIds)
+	return nil
+
+}
+
+type AuditQuery struct {
+	Since      time.Time // Zero value means no lower bound
+	Until      time.Time // Zero value means no upper bound
+	AffectedId string    // Only return entries that affected this doc id
+	Action     string    // Only return entries for this action
+}
+
+func (q AuditQuery) matches(auditDoc AuditDocument) bool {
+	if !q.Since.IsZero() && auditDoc.Timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && auditDoc.Timestamp.After(q.Until) {
+		return false
+	}
+	if q.Action != "" && auditDoc.Action != q.Action {
+		return false
+	}
+	if q.AffectedId == "" {
+		return true
+	}
+	for _, affectedId := range auditDoc.AffectedIds {
+		if affectedId == q.AffectedId {
+			return true
+		}
+	}
+	return false
+}
+
+// The view key range covering the query's time range.  Timestamps are keyed
+// as RFC3339 strings, which only sort correctly to the second (05.5Z sorts
+// before 05Z), so the range is a second wider on each side and matches()
+// does the exact filtering.
+func (q AuditQuery) viewParams() url.Values {
+	params := url.Values{}
+	params.Set("stale", "false")
+	if !q.Since.IsZero() {
+		startKey, _ := json.Marshal(q.Since.UTC().Add(-time.Second).Format(time.RFC3339))
+		params.Set("startkey", string(startKey))
+	}
+	if !q.Until.IsZero() {
+		endKey, _ := json.Marshal(q.Until.UTC().Add(time.Second).Format(time.RFC3339))
+		params.Set("endkey", string(endKey))
+	}
+	return params
+}
+
+// Query the audit log (requires the Sync Gateway admin url), oldest first.
+// Only the query's time range of the view is read.
+func QueryAuditLog(syncGwAdminUrl string, query AuditQuery) ([]AuditDocument, error) {
+
+	output := struct {
+		Rows []struct {
+			Id    string        `json:"id"`
+			Value AuditDocument `json:"value"`
+		} `json:"rows"`
+	}{}
+
+	viewUrl := fmt.Sprintf(
+		"%v/_design/%v/_view/%v?%v",
+		strings.TrimSuffix(syncGwAdminUrl, "/"),
+		AuditDesignDocName,
+		AuditViewName,
+		query.viewParams().Encode(),
+	)
+	err := adminRequest("GET", viewUrl, nil, &output)
+	if err != nil && isNotFound(err) {
+		// nothing has queried the audit log yet, install the view
+		if err := installAuditView(syncGwAdminUrl); err != nil {
+			return nil, err
+		}
+		log.Printf("Sleeping 10s to wait for view to be ready")
+		<-time.After(10 * time.Second)
+		err = adminRequest("GET", viewUrl, nil, &output)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	auditDocs := []AuditDocument{}
+	for _, row := range output.Rows {
+		auditDoc := row.Value
+		auditDoc.Id = row.Id
+		if query.matches(auditDoc) {
+			auditDocs = append(auditDocs, auditDoc)
+		}
+	}
+	return auditDocs, nil
+
+}
+
+func installAuditView(syncGwAdminUrl string) error {
+
+	viewJson := fmt.Sprintf(`
+{
+    "views":{
+        "%v":{
+            "map":"function (doc, meta) { if (doc.%v != '%v') { return; } emit(doc.%v, doc); }"
+        }
+    }
+}
+`, AuditViewName, storedFieldName("type"), Audit, storedFieldName("timestamp"))
+
+	log.Printf("installAuditView called")
+
+	return putDesignDoc(syncGwAdminUrl, AuditDesignDocName, []byte(viewJson))
+
+}
@@ -0,0 +1,326 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/tleyden/go-couch"
+)
+
+/*
+The canary submits a tiny job every so often and checks that it comes back,
+with a result matching its result_hash, within the timeout.  Each probe's
+success and latency are published to CloudWatch (DeepStyleCanary namespace)
+so alarms can be put on them, and alert hooks are called when the canary
+starts failing and when it recovers.
+*/
+
+type CanaryOptions struct {
+	Interval         time.Duration // Between probes
+	Timeout          time.Duration // Max time for the job to complete
+	Owner            string        // Owner of the canary jobs
+	ExpectedHash     string        // Expected result hash, for deterministic engines
+	FailureThreshold int           // Consecutive failures before alerting
+	CloudWatch       bool          // Publish metrics to CloudWatch
+	AlertHooks       []CanaryAlertHook
+}
+
+type CanaryResult struct {
+	JobId     string
+	Success   bool
+	Latency   time.Duration
+	Err       error
+	Timestamp time.Time
+}
+
+// Called when the canary starts failing (after FailureThreshold failures)
+// and when it recovers.
+type CanaryAlertHook interface {
+	Alert(alert CanaryAlert) error
+}
+
+type CanaryAlert struct {
+	Status              string  `json:"status"` // failing or recovered
+	JobId               string  `json:"job_id"`
+	Error               string  `json:"error,omitempty"`
+	LatencySeconds      float64 `json:"latency_seconds"`
+	ConsecutiveFailures int     `json:"consecutive_failures"`
+}
+
+const (
+	CanaryStatusFailing   = "failing"
+	CanaryStatusRecovered = "recovered"
+
+	canaryPollInterval = 5 * time.Second
+	canaryImageSize    = 32
+)
+
+// Post alerts as json to a url, eg a Slack or PagerDuty integration
+type WebhookAlertHook struct {
+	Url string
+}
+
+func (h WebhookAlertHook) Alert(alert CanaryAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(h.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected status posting canary alert: %v", resp.Status)
+	}
+	return nil
+}
+
+// Write a small gradient png for the canary's photo or style image
+func writeCanaryImage(path string, tint color.RGBA) error {
+
+	img := image.NewRGBA(image.Rect(0, 0, canaryImageSize, canaryImageSize))
+	for x := 0; x < canaryImageSize; x++ {
+		for y := 0; y < canaryImageSize; y++ {
+			img.Set(x, y, color.RGBA{
+				R: uint8(x*255/canaryImageSize) | tint.R,
+				G: uint8(y*255/canaryImageSize) | tint.G,
+				B: tint.B,
+				A: 255,
+			})
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+
+}
+
+// Submit a canary job and wait for it to complete
+func RunCanaryProbe(db couch.Database, options CanaryOptions) (result CanaryResult) {
+
+	result.Timestamp = time.Now()
+
+	tempDir, err := ioutil.TempDir("", "deepstyle-canary")
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer os.RemoveAll(tempDir)
+
+	photoPath := filepath.Join(tempDir, "photo.png")
+	stylePath := filepath.Join(tempDir, "style.png")
+	if err := writeCanaryImage(photoPath, color.RGBA{B: 64}); err != nil {
+		result.Err = err
+		return result
+	}
+	if err := writeCanaryImage(stylePath, color.RGBA{R: 128, B: 192}); err != nil {
+		result.Err = err
+		return result
+	}
+
+	jobDoc, err := CreateJob(db, JobDocument{
+		Owner:       options.Owner,
+		StyleName:   "canary",
+		ResultSinks: []string{}, // don't deliver canary results anywhere
+	}, photoPath, stylePath)
+	if jobDoc != nil {
+		result.JobId = jobDoc.Id
+		defer deleteCanaryJob(db, jobDoc.Id)
+	}
+	if err != nil {
+		result.Err = fmt.Errorf("Error creating canary job: %v", err)
+		return result
+	}
+
+	deadline := result.Timestamp.Add(options.Timeout)
+	for !jobDoc.IsProcessingSuccessful() && !jobDoc.IsProcessingFailed() {
+		if time.Now().After(deadline) {
+			result.Err = fmt.Errorf("Canary job %v still %v after %v", jobDoc.Id, jobDoc.State, options.Timeout)
+			return result
+		}
+		<-time.After(canaryPollInterval)
+		if err := jobDoc.RefreshFromDB(); err != nil {
+			log.Printf("Error refreshing canary job %v: %v", jobDoc.Id, err)
+		}
+	}
+	result.Latency = time.Since(result.Timestamp)
+
+	if jobDoc.IsProcessingFailed() {
+		result.Err = fmt.Errorf("Canary job %v failed: %v", jobDoc.Id, jobDoc.ErrorMessage)
+		return result
+	}
+
+	if err := verifyCanaryResult(jobDoc, options.ExpectedHash); err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.Success = true
+	return result
+
+}
+
+// Check the result attachment is intact, and is what's expected if known
+func verifyCanaryResult(jobDoc *JobDocument, expectedHash string) error {
+
+	reader, err := jobDoc.RetrieveAttachment(ResultImageAttachment)
+	if err != nil {
+		return fmt.Errorf("Error retrieving canary result: %v", err)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return fmt.Errorf("Error retrieving canary result: %v", err)
+	}
+	resultHash := hex.EncodeToString(hash.Sum(nil))
+
+	if resultHash != jobDoc.ResultHash {
+		return fmt.Errorf("Canary result hash %v doesn't match result_hash %v", resultHash, jobDoc.ResultHash)
+	}
+	if expectedHash != "" && resultHash != expectedHash {
+		return fmt.Errorf("Canary result hash %v, expected %v", resultHash, expectedHash)
+	}
+	return nil
+
+}
+
+func deleteCanaryJob(db couch.Database, jobId string) {
+	for _, docId := range []string{jobId, JobLogDocId(jobId)} {
+		doc := Document{}
+		if err := db.Retrieve(docId, &doc); err != nil {
+			continue
+		}
+		if err := db.Delete(docId, doc.Revision); err != nil {
+			log.Printf("Error deleting canary doc %v: %v", docId, err)
+		}
+	}
+}
+
+// Decides when to call the alert hooks: once when the failure threshold is
+// reached, and once on recovery, rather than on every probe.
+type canaryAlerter struct {
+	failureThreshold    int
+	consecutiveFailures int
+	alerting            bool
+}
+
+func (a *canaryAlerter) alertFor(result CanaryResult) (alert CanaryAlert, ok bool) {
+
+	alert = CanaryAlert{
+		JobId:          result.JobId,
+		LatencySeconds: result.Latency.Seconds(),
+	}
+
+	if result.Success {
+		a.consecutiveFailures = 0
+		if !a.alerting {
+			return alert, false
+		}
+		a.alerting = false
+		alert.Status = CanaryStatusRecovered
+		return alert, true
+	}
+
+	a.consecutiveFailures++
+	alert.ConsecutiveFailures = a.consecutiveFailures
+	alert.Error = fmt.Sprintf("%v", result.Err)
+	if a.alerting || a.consecutiveFailures < a.failureThreshold {
+		return alert, false
+	}
+	a.alerting = true
+	alert.Status = CanaryStatusFailing
+	return alert, true
+
+}
+
+func publishCanaryMetrics(result CanaryResult) error {
+
+	success := 0.0
+	if result.Success {
+		success = 1.0
+	}
+	latency := result.Latency.Seconds()
+
+	metricData := []*cloudwatch.MetricDatum{
+		{
+			MetricName: aws.String("CanarySuccess"),
+			Value:      &success,
+			Timestamp:  &result.Timestamp,
+		},
+	}
+	if result.Success {
+		metricData = append(metricData, &cloudwatch.MetricDatum{
+			MetricName: aws.String("CanaryLatency"),
+			Unit:       aws.String("Seconds"),
+			Value:      &latency,
+			Timestamp:  &result.Timestamp,
+		})
+	}
+
+	cloudwatchSvc := cloudwatch.New(session.New(), &aws.Config{Region: aws.String("us-east-1")})
+	_, err := cloudwatchSvc.PutMetricData(&cloudwatch.PutMetricDataInput{
+		MetricData: metricData,
+		Namespace:  aws.String("DeepStyleCanary"),
+	})
+	return err
+
+}
+
+// Run canary probes forever
+func RunCanary(db couch.Database, options CanaryOptions) {
+
+	alerter := &canaryAlerter{failureThreshold: options.FailureThreshold}
+
+	for {
+
+		result := RunCanaryProbe(db, options)
+		if result.Success {
+			log.Printf("Canary job %v succeeded in %v", result.JobId, result.Latency)
+		} else {
+			log.Printf("Canary failed: %v", result.Err)
+		}
+
+		if options.CloudWatch {
+			if err := publishCanaryMetrics(result); err != nil {
+				log.Printf("ERROR adding canary metric data %v", err)
+			}
+		}
+
+		if alert, ok := alerter.alertFor(result); ok {
+			for _, hook := range options.AlertHooks {
+				if err := hook.Alert(alert); err != nil {
+					log.Printf("Error sending canary alert: %v", err)
+				}
+			}
+		}
+
+		if wait := options.Interval - time.Since(result.Timestamp); wait > 0 {
+			<-time.After(wait)
+		}
+
+	}
+
+}
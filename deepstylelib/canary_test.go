@@ -0,0 +1,59 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteCanaryImage(t *testing.T) {
+
+	tempDir, err := ioutil.TempDir("", "deepstyle-canary-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	imagePath := filepath.Join(tempDir, "photo.png")
+	assert.NoError(t, writeCanaryImage(imagePath, color.RGBA{B: 64}))
+
+	width, height, err := imageSize(imagePath)
+	assert.NoError(t, err)
+	assert.Equal(t, canaryImageSize, width)
+	assert.Equal(t, canaryImageSize, height)
+
+}
+
+func TestCanaryAlerter(t *testing.T) {
+
+	alerter := &canaryAlerter{failureThreshold: 2}
+	failure := CanaryResult{Err: fmt.Errorf("timed out")}
+	success := CanaryResult{Success: true, Latency: time.Minute}
+
+	_, ok := alerter.alertFor(success)
+	assert.False(t, ok)
+
+	// not until the threshold is reached
+	_, ok = alerter.alertFor(failure)
+	assert.False(t, ok)
+
+	alert, ok := alerter.alertFor(failure)
+	assert.True(t, ok)
+	assert.Equal(t, CanaryStatusFailing, alert.Status)
+	assert.Equal(t, 2, alert.ConsecutiveFailures)
+	assert.Equal(t, "timed out", alert.Error)
+
+	// only alert once while failing
+	_, ok = alerter.alertFor(failure)
+	assert.False(t, ok)
+
+	alert, ok = alerter.alertFor(success)
+	assert.True(t, ok)
+	assert.Equal(t, CanaryStatusRecovered, alert.Status)
+	assert.Equal(t, 60.0, alert.LatencySeconds)
+
+}
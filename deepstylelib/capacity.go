@@ -0,0 +1,229 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tleyden/go-couch"
+)
+
+/*
+Soft capacity reservation for interactive jobs.
+
+Workers heartbeat into the worker_capacity doc, and before running a batch
+job a worker claims a batch slot there.  Batch jobs may only use the slots
+left after reserving InteractiveReserve of the live workers (rounded up, but
+always leaving one batch slot), so a big import can't take over the whole
+fleet and leave users waiting.  A worker that finds no free batch slot skips
+the job, and looks for READY jobs again once the worker_capacity doc changes
+(eg a slot is released, or its holder stops heartbeating).
+
+It's soft because the fleet size comes from heartbeats: workers that stop
+heartbeating for WorkerHeartbeatTimeout are dropped, and if the doc can't be
+updated the batch job runs anyway.
+*/
+
+// Job priorities
+const (
+	PriorityInteractive = "interactive" // default, eg from the app
+	PriorityBatch       = "batch"       // eg from deepstyle import
+)
+
+const (
+	WorkerCapacityDocId     = "worker_capacity"
+	WorkerHeartbeatInterval = time.Minute
+	WorkerHeartbeatTimeout  = 5 * time.Minute
+)
+
+type WorkerStatus struct {
+	LastSeen time.Time `json:"last_seen"`
+	Running  string    `json:"running,omitempty"` // Priority of the job it's running, if any
+}
+
+type WorkerCapacityDocument struct {
+	TypedDocument
+	Workers map[string]WorkerStatus `json:"workers"` // by worker id
+}
+
+// How many of numWorkers are reserved for interactive jobs.  At least one
+// is left for batch jobs, otherwise they'd never run on a small fleet.
+func ReservedInteractiveSlots(numWorkers int, interactiveReserve float64) int {
+	if interactiveReserve <= 0 || numWorkers <= 1 {
+		return 0
+	}
+	reserved := int(math.Ceil(float64(numWorkers) * interactiveReserve))
+	if reserved >= numWorkers {
+		return numWorkers - 1
+	}
+	return reserved
+}
+
+// Forget workers that haven't heartbeated in a while
+func (c *WorkerCapacityDocument) expireWorkers(now time.Time) {
+	for workerId, status := range c.Workers {
+		if now.Sub(status.LastSeen) > WorkerHeartbeatTimeout {
+			log.Printf("Worker %v hasn't been seen since %v, no longer counting it", workerId, status.LastSeen)
+			delete(c.Workers, workerId)
+		}
+	}
+}
+
+func (c *WorkerCapacityDocument) heartbeat(workerId, running string, now time.Time) {
+	if c.Workers == nil {
+		c.Workers = map[string]WorkerStatus{}
+	}
+	c.Workers[workerId] = WorkerStatus{LastSeen: now, Running: running}
+}
+
+// Try to claim a batch slot for workerId, recording its heartbeat either way
+func (c *WorkerCapacityDocument) claimBatchSlot(workerId string, interactiveReserve float64, now time.Time) (claimed bool) {
+
+	c.expireWorkers(now)
+	c.heartbeat(workerId, "", now)
+
+	runningBatch := 0
+	for otherWorkerId, status := range c.Workers {
+		if otherWorkerId != workerId && status.Running == PriorityBatch {
+			runningBatch++
+		}
+	}
+	batchSlots := len(c.Workers) - ReservedInteractiveSlots(len(c.Workers), interactiveReserve)
+	if runningBatch >= batchSlots {
+		return false
+	}
+
+	c.heartbeat(workerId, PriorityBatch, now)
+	return true
+
+}
+
+// Apply update to the capacity doc (creating it if needed) and save it,
+// getting the latest and re-applying it on conflicts.
+func editWorkerCapacity(db couch.Database, update func(c *WorkerCapacityDocument)) error {
+
+	for i := 1; i <= 10; i++ {
+
+		capacity := WorkerCapacityDocument{}
+		if err := db.Retrieve(WorkerCapacityDocId, &capacity); err != nil {
+			if !isNotFound(err) {
+				return err
+			}
+			capacity = WorkerCapacityDocument{
+				TypedDocument: TypedDocument{Type: WorkerCapacity},
+			}
+		}
+
+		update(&capacity)
+
+		var err error
+		if capacity.Revision == "" {
+			_, _, err = db.InsertWith(capacity, WorkerCapacityDocId)
+		} else {
+			_, err = db.Edit(capacity)
+		}
+		if err == nil {
+			return nil
+		}
+		if !isConflict(err) {
+			return err
+		}
+
+		log.Printf("Conflict updating worker capacity, retrying attempt #%v", i+1)
+
+	}
+
+	return fmt.Errorf("Tried to update worker capacity 10 times, giving up")
+
+}
+
+// A worker's side of the capacity reservation
+type CapacityReservation struct {
+	Database           couch.Database
+	WorkerId           string
+	InteractiveReserve float64 // Fraction of workers only running interactive jobs, eg 0.25
+	mutex              sync.Mutex
+	running            string
+	skipped            bool // Whether a batch job was skipped since takeSkipped
+}
+
+func NewCapacityReservation(db couch.Database, workerId string, interactiveReserve float64) (*CapacityReservation, error) {
+	if interactiveReserve < 0 || interactiveReserve >= 1 {
+		return nil, fmt.Errorf("Interactive reserve must be at least 0 and less than 1, got %v", interactiveReserve)
+	}
+	return &CapacityReservation{
+		Database:           db,
+		WorkerId:           workerId,
+		InteractiveReserve: interactiveReserve,
+	}, nil
+}
+
+// Heartbeat every WorkerHeartbeatInterval in the background, so this worker
+// is counted (and keeps its batch slot) while it's busy running a job.
+func (r *CapacityReservation) Start() {
+	go func() {
+		for {
+			if err := r.Heartbeat(); err != nil {
+				log.Printf("Error updating worker capacity heartbeat: %v", err)
+			}
+			<-time.After(WorkerHeartbeatInterval)
+		}
+	}()
+}
+
+func (r *CapacityReservation) Heartbeat() error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return editWorkerCapacity(r.Database, func(c *WorkerCapacityDocument) {
+		c.expireWorkers(time.Now())
+		c.heartbeat(r.WorkerId, r.running, time.Now())
+	})
+
+}
+
+// Whether this worker may run a batch job now.  Call ReleaseBatchSlot once
+// it's done.
+func (r *CapacityReservation) ClaimBatchSlot() (claimed bool, err error) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	err = editWorkerCapacity(r.Database, func(c *WorkerCapacityDocument) {
+		claimed = c.claimBatchSlot(r.WorkerId, r.InteractiveReserve, time.Now())
+	})
+	if err != nil {
+		return false, err
+	}
+	if claimed {
+		r.running = PriorityBatch
+	} else {
+		r.skipped = true
+	}
+	return claimed, nil
+
+}
+
+// Whether a batch job was skipped for lack of a slot since the last call
+func (r *CapacityReservation) takeSkipped() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	skipped := r.skipped
+	r.skipped = false
+	return skipped
+}
+
+func (r *CapacityReservation) ReleaseBatchSlot() error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.running = ""
+	return editWorkerCapacity(r.Database, func(c *WorkerCapacityDocument) {
+		c.heartbeat(r.WorkerId, "", time.Now())
+	})
+
+}
@@ -0,0 +1,88 @@
+package deepstylelib
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReservedInteractiveSlots(t *testing.T) {
+	assert.Equal(t, 0, ReservedInteractiveSlots(4, 0))
+	assert.Equal(t, 1, ReservedInteractiveSlots(4, 0.25))
+	assert.Equal(t, 2, ReservedInteractiveSlots(5, 0.25))
+	assert.Equal(t, 0, ReservedInteractiveSlots(1, 0.1))
+	assert.Equal(t, 1, ReservedInteractiveSlots(2, 0.75))
+	assert.Equal(t, 3, ReservedInteractiveSlots(4, 1))
+	assert.Equal(t, 0, ReservedInteractiveSlots(0, 0.25))
+}
+
+func TestClaimBatchSlot(t *testing.T) {
+
+	now := time.Now()
+	capacity := WorkerCapacityDocument{}
+	for _, workerId := range []string{"w1", "w2", "w3", "w4"} {
+		capacity.heartbeat(workerId, "", now)
+	}
+
+	// 1 of the 4 workers is reserved
+	assert.True(t, capacity.claimBatchSlot("w1", 0.25, now))
+	assert.True(t, capacity.claimBatchSlot("w2", 0.25, now))
+	assert.True(t, capacity.claimBatchSlot("w3", 0.25, now))
+	assert.False(t, capacity.claimBatchSlot("w4", 0.25, now))
+	assert.Equal(t, "", capacity.Workers["w4"].Running)
+
+	// a worker can claim again for its next batch job
+	assert.True(t, capacity.claimBatchSlot("w3", 0.25, now))
+
+	// once w1 is done, w4 can have its slot
+	capacity.heartbeat("w1", "", now)
+	assert.True(t, capacity.claimBatchSlot("w4", 0.25, now))
+
+	// w2 and w3 stop heartbeating, which leaves 2 workers and 1 batch slot
+	later := now.Add(WorkerHeartbeatTimeout + time.Minute)
+	capacity.heartbeat("w4", PriorityBatch, later)
+	assert.False(t, capacity.claimBatchSlot("w1", 0.25, later))
+	assert.Equal(t, 2, len(capacity.Workers))
+
+}
+
+func TestProcessReadyJobsWithoutBatchSlot(t *testing.T) {
+
+	sg := newFakeSyncGateway(t)
+	db := sg.database(t)
+
+	// the only batch slot is taken
+	capacity := WorkerCapacityDocument{TypedDocument: TypedDocument{Type: WorkerCapacity}}
+	capacity.heartbeat("worker1", PriorityBatch, time.Now())
+	capacity.heartbeat("worker2", "", time.Now())
+	sg.put(t, WorkerCapacityDocId, capacity)
+
+	jobDoc := JobDocument{State: StateReadyToProcess, Priority: PriorityBatch}
+	jobDoc.Type = Job
+	sg.put(t, "job1", jobDoc)
+	sg.handle("GET", "/_design/unprocessed_jobs/_view/unprocessed_jobs", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"total_rows": 2, "rows": [
+			{"id": "job1", "key": "READY_TO_PROCESS", "value": "job1"},
+			{"id": "job2", "key": "BEING_PROCESSED", "value": "job2"}
+		]}`))
+	})
+
+	reservation, err := NewCapacityReservation(db, "worker2", 0.5)
+	assert.NoError(t, err)
+	follower := ChangesFeedFollower{
+		Database:    db,
+		ProcessJobs: true,
+		WorkerId:    "worker2",
+		Capacity:    reservation,
+	}
+	follower.processReadyJobs()
+
+	// left READY, and noted so it's looked at again when a slot frees up
+	sg.get(t, "job1", &jobDoc)
+	assert.Equal(t, StateReadyToProcess, jobDoc.State)
+	assert.True(t, reservation.takeSkipped())
+	assert.False(t, reservation.takeSkipped())
+
+}
@@ -2,12 +2,17 @@ package deepstylelib
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/couchbaselabs/logg"
 	"github.com/tleyden/go-couch"
@@ -25,12 +30,27 @@ import (
     * Delete temp files
 */
 
+// How often workers look for READY_TO_PROCESS jobs they skipped on the
+// changes feed
+const ReadyJobsCheckInterval = 5 * time.Minute
+
 type ChangesFeedFollower struct {
-	Database          couch.Database
-	UniqushURL        string
-	ProcessJobs       bool // Run NeuralStyle (typically only on AWS+GPU)
-	SendNotifications bool // Send push notifications when jobs done
-	StartingSince     string
+	Database           couch.Database
+	UniqushURL         string
+	ProcessJobs        bool // Run NeuralStyle (typically only on AWS+GPU)
+	SendNotifications  bool // Send push notifications when jobs done
+	StartingSince      string
+	ResultSinks        ResultSinks   // Deliver results to these besides the attachment
+	HangTimeout        time.Duration // Kill the engine after this long without output
+	WorkerId           string
+	ResultVariants     []string             // Variants to produce for jobs that don't ask for any
+	Updater            *WorkerUpdater       // Follow worker rollouts, if set
+	MaxPhotoMegapixels int                  // Fail jobs with larger photos, 0 for no limit
+	NotificationWindow time.Duration        // Coalesce notifications over this window, 0 to send each one
+	Capacity           *CapacityReservation // Only run batch jobs in a free batch slot, if set
+	digester           *notificationDigester
+	shutdown           context.Context // Cancelled on SIGINT or SIGTERM
+	jobMutex           *sync.Mutex     // Held while a job is running
 }
 
 func NewChangesFeedFollower(startingSince, syncGatewayUrl string) (*ChangesFeedFollower, error) {
@@ -41,8 +61,10 @@ func NewChangesFeedFollower(startingSince, syncGatewayUrl string) (*ChangesFeedF
 	}
 
 	return &ChangesFeedFollower{
-		Database:      db,
-		StartingSince: startingSince,
+		Database:           db,
+		StartingSince:      startingSince,
+		WorkerId:           defaultWorkerId(),
+		MaxPhotoMegapixels: DefaultMaxPhotoMegapixels,
 	}, nil
 }
 
@@ -50,6 +72,43 @@ func (f ChangesFeedFollower) Follow() {
 
 	var since interface{}
 
+	if f.SendNotifications && f.NotificationWindow > 0 {
+		f.digester = newNotificationDigester(f.NotificationWindow, f.push)
+	}
+	f.exitOnSignal()
+
+	if f.Capacity != nil {
+		f.Capacity.Start()
+	}
+
+	// Jobs are processed synchronously in handleChange, so in between
+	// changes the worker is drained and it's safe to update.
+	var lastUpdateCheck time.Time
+	checkForUpdate := func(force bool) {
+		if f.Updater == nil {
+			return
+		}
+		if !force && time.Since(lastUpdateCheck) < WorkerUpdateCheckInterval {
+			return
+		}
+		lastUpdateCheck = time.Now()
+		f.Updater.UpdateAndRestart(since, f.flushDigests)
+	}
+
+	// Jobs skipped on the changes feed (eg they hung on this worker) are
+	// still READY, look for them every so often.
+	var lastReadyJobsCheck time.Time
+	checkReadyJobs := func(force bool) {
+		if !f.ProcessJobs {
+			return
+		}
+		if !force && time.Since(lastReadyJobsCheck) < ReadyJobsCheckInterval {
+			return
+		}
+		lastReadyJobsCheck = time.Now()
+		f.processReadyJobs()
+	}
+
 	handleChange := func(reader io.Reader) interface{} {
 		changes, err := decodeChanges(reader)
 		if err != nil {
@@ -57,13 +116,34 @@ func (f ChangesFeedFollower) Follow() {
 			// since we want to follow the changes feed forever, just log an error
 			// TODO: don't even log an error if its an io.Timeout, just noise
 			log.Printf("%T error decoding changes: %v.", err, err)
+			checkReadyJobs(false)
+			checkForUpdate(false)
 			return since
 		}
 
 		f.processChanges(changes)
 
+		// a batch slot may have freed up for jobs this worker skipped
+		capacityChanged := false
+		for _, change := range changes.Results {
+			if change.Id == WorkerCapacityDocId {
+				capacityChanged = true
+			}
+		}
+		checkReadyJobs(capacityChanged && f.Capacity != nil && f.Capacity.takeSkipped())
+
+		// before checking for an update, so a restarted worker doesn't
+		// process (and notify about) these changes again
 		since = changes.LastSequence
 
+		rolloutChanged := false
+		for _, change := range changes.Results {
+			if change.Id == WorkerRolloutDocId {
+				rolloutChanged = true
+			}
+		}
+		checkForUpdate(rolloutChanged)
+
 		return since
 
 	}
@@ -73,10 +153,43 @@ func (f ChangesFeedFollower) Follow() {
 	since = f.determineStartingSince(f.StartingSince)
 	options["since"] = since
 
+	// after a restart, let the next worker update
+	checkForUpdate(true)
+
 	f.Database.Changes(handleChange, options)
 
 }
 
+func (f ChangesFeedFollower) flushDigests() {
+	if f.digester != nil {
+		f.digester.Flush()
+	}
+}
+
+// Exit cleanly on SIGINT or SIGTERM: kill the engine if a job is running
+// (which puts the job back in the queue and releases its batch slot), then
+// send any pending digests.  Must be called before any jobs are processed.
+func (f *ChangesFeedFollower) exitOnSignal() {
+
+	shutdown, cancel := context.WithCancel(context.Background())
+	f.shutdown = shutdown
+	f.jobMutex = &sync.Mutex{}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Got %v, shutting down", sig)
+		cancel()
+		// wait for the job, if any, to finish being cancelled
+		f.jobMutex.Lock()
+		f.flushDigests()
+		log.Printf("Shut down")
+		os.Exit(0)
+	}()
+
+}
+
 func (f ChangesFeedFollower) lastProcessedSeq() (string, error) {
 
 	infile, err := os.Open("lastprocessed.db")
@@ -97,6 +210,13 @@ func (f ChangesFeedFollower) lastProcessedSeq() (string, error) {
 
 func (f ChangesFeedFollower) determineStartingSince(startingSince string) interface{} {
 
+	// carry on where we were before restarting to update
+	if restartSince := os.Getenv(restartSinceEnvVar); restartSince != "" {
+		os.Unsetenv(restartSinceEnvVar)
+		log.Printf("Using since from before restart: %v", restartSince)
+		return restartSince
+	}
+
 	if startingSince != "" {
 		// if we have been passed a starting since, use it
 		log.Printf("Using startingSince param: %v", startingSince)
@@ -135,6 +255,40 @@ func (f ChangesFeedFollower) processChanges(changes couch.Changes) {
 
 }
 
+// Process the jobs in the unprocessed_jobs view that are READY_TO_PROCESS
+func (f ChangesFeedFollower) processReadyJobs() {
+
+	viewResults := struct {
+		Rows []struct {
+			Id  string `json:"id"`
+			Key string `json:"key"`
+		} `json:"rows"`
+	}{}
+	options := map[string]interface{}{"stale": "false"}
+	err := queryViewInstallIfMissing(
+		f.Database.DBURL(),
+		DesignDocName,
+		ViewName,
+		options,
+		&viewResults,
+		installView,
+	)
+	if err != nil {
+		log.Printf("Error looking for skipped ready jobs: %v", err)
+		return
+	}
+
+	for _, row := range viewResults.Rows {
+		if row.Key != StateReadyToProcess {
+			continue
+		}
+		if err := f.processChange(couch.Change{Id: row.Id}); err != nil {
+			log.Printf("Error processing ready job %v: %v", row.Id, err)
+		}
+	}
+
+}
+
 func (f ChangesFeedFollower) processChange(change couch.Change) error {
 
 	docId := change.Id
@@ -149,24 +303,18 @@ func (f ChangesFeedFollower) processChange(change couch.Change) error {
 		return nil
 	}
 
-	doc := TypedDocument{}
-	err := f.Database.Retrieve(docId, &doc)
+	// retrieved as a JobDocument whatever the type, so that any document
+	// hooks are applied before looking at the type field
+	jobDoc := JobDocument{}
+	err := f.Database.Retrieve(docId, &jobDoc)
 	if err != nil {
 		return err
 	}
 
 	// skip any docs that aren't jobs
-	if !doc.IsJob() {
+	if !jobDoc.IsJob() {
 		return nil
 	}
-	log.Printf("doc: %+v. isJob: %v", doc, doc.IsJob())
-
-	// re-retrieve from db, I wish I knew a better way.
-	jobDoc := JobDocument{}
-	err = f.Database.Retrieve(docId, &jobDoc)
-	if err != nil {
-		return err
-	}
 	log.Printf("jobdoc: %+v", jobDoc)
 
 	if f.ProcessJobs {
@@ -176,10 +324,47 @@ func (f ChangesFeedFollower) processChange(change couch.Change) error {
 			return nil
 		}
 
+		if f.jobMutex != nil {
+			f.jobMutex.Lock()
+			defer f.jobMutex.Unlock()
+		}
+		if f.shutdown != nil && f.shutdown.Err() != nil {
+			return nil
+		}
+
+		// leave jobs that hung on this worker for other workers, for a while
+		if jobDoc.waitingForHangRetry(f.WorkerId, time.Now()) {
+			log.Printf("Skipping job %v, it hung on this worker at %v", jobDoc.Id, jobDoc.LastHungAt)
+			return nil
+		}
+
+		// leave batch jobs for other workers if the batch slots are taken
+		if jobDoc.IsBatch() && f.Capacity != nil {
+			claimed, err := f.Capacity.ClaimBatchSlot()
+			if err != nil {
+				log.Printf("Error claiming batch slot, running job %v anyway: %v", jobDoc.Id, err)
+			} else if !claimed {
+				log.Printf("Skipping batch job %v, the batch slots are taken", jobDoc.Id)
+				return nil
+			} else {
+				defer func() {
+					if err := f.Capacity.ReleaseBatchSlot(); err != nil {
+						log.Printf("Error releasing batch slot: %v", err)
+					}
+				}()
+			}
+		}
+
 		// Run the job (call neural style)
 		config := configuration{
-			Database: f.Database,
-			TempDir:  "/tmp",
+			Database:           f.Database,
+			TempDir:            os.TempDir(),
+			ResultSinks:        f.ResultSinks,
+			HangTimeout:        f.HangTimeout,
+			WorkerId:           f.WorkerId,
+			ResultVariants:     f.ResultVariants,
+			MaxPhotoMegapixels: f.MaxPhotoMegapixels,
+			Context:            f.shutdown,
 		}
 
 		if err := executeDeepStyleJob(config, jobDoc); err != nil {
@@ -205,31 +390,51 @@ func (f ChangesFeedFollower) sendNotifications(jobDoc JobDocument) error {
 	message := ""
 	switch jobDoc.State {
 	case StateProcessingSuccessful:
-		message = "Your DeepStyle work of art is ready!"
+		message, _ = UserMessage(MessageJobReady, nil, jobDoc.Locale)
 	case StateProcessingFailed:
-		message = "Oops, something went wrong making your DeepStyle work of art!"
+		message, _ = UserMessage(MessageJobFailed, nil, jobDoc.Locale)
+		if userErrorMessage := jobDoc.UserErrorMessage(); userErrorMessage != "" {
+			message = userErrorMessage
+		}
 	default:
 		// Job isn't finished, don't send any notification
 		return nil
 	}
 
+	// eg canary jobs
+	if jobDoc.OwnerDeviceToken == "" {
+		return nil
+	}
+
+	if f.digester != nil {
+		f.digester.Add(jobDoc, message)
+		log.Printf("Added %v@%v to notification digest", jobDoc.Id, jobDoc.Revision)
+		return nil
+	}
+
+	if err := f.push(jobDoc.Owner, jobDoc.OwnerDeviceToken, message); err != nil {
+		return err
+	}
+
+	log.Printf("Sent notification for %v@%v", jobDoc.Id, jobDoc.Revision)
+
+	return nil
+
+}
+
+func (f ChangesFeedFollower) push(owner, deviceToken, message string) error {
+
 	// create subscriber in uniqush
 	uniqushClient := libuqclient.NewUniqushClient(f.UniqushURL)
 	uniqushService := uniqushClient.NewService("deepstyle", libuqclient.APNS)
-	subscriber := uniqushService.NewSubscriber(jobDoc.Owner, jobDoc.OwnerDeviceToken)
+	subscriber := uniqushService.NewSubscriber(owner, deviceToken)
 	_, err := subscriber.Create()
 	if err != nil {
 		return err
 	}
 
 	_, err = subscriber.Push(message)
-	if err != nil {
-		return err
-	}
-
-	log.Printf("Sent notification for %v@%v", jobDoc.Id, jobDoc.Revision)
-
-	return nil
+	return err
 
 }
 
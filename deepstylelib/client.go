@@ -0,0 +1,317 @@
+package deepstylelib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tleyden/go-couch"
+)
+
+// A client for apps and scripts working with jobs in Sync Gateway
+type Client struct {
+	SyncGatewayUrl string
+	Database       couch.Database
+}
+
+func NewClient(syncGatewayUrl string) (*Client, error) {
+	db, err := GetDbConnection(syncGatewayUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to db: %v.  Err: %v", syncGatewayUrl, err)
+	}
+	return &Client{
+		SyncGatewayUrl: strings.TrimSuffix(syncGatewayUrl, "/"),
+		Database:       db,
+	}, nil
+}
+
+// Which jobs to watch.  Empty fields match everything.
+type JobFilter struct {
+	Owner  string   // Filtered by Sync Gateway, using the owner's channel
+	States []string // Jobs in any of these states
+	Tags   []string // Jobs with all of these tags
+	Since  string   // Changes feed sequence to start from, defaults to now
+}
+
+func (filter JobFilter) Matches(jobDoc JobDocument) bool {
+
+	if filter.Owner != "" && jobDoc.Owner != filter.Owner {
+		return false
+	}
+
+	if len(filter.States) > 0 {
+		matchesState := false
+		for _, state := range filter.States {
+			if jobDoc.State == state {
+				matchesState = true
+			}
+		}
+		if !matchesState {
+			return false
+		}
+	}
+
+	for _, tag := range filter.Tags {
+		if !jobDoc.HasTag(tag) {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+type JobEventType string
+
+const (
+	JobCreated      JobEventType = "created"
+	JobStateChanged JobEventType = "state_changed" // including to a completed state
+	JobProgress     JobEventType = "progress"
+	JobCompleted    JobEventType = "completed" // succeeded or failed, after the state_changed
+)
+
+type JobEvent struct {
+	Type     JobEventType
+	Job      JobDocument
+	OldState string  // For JobStateChanged, empty if the job wasn't seen before
+	Progress float64 // For JobProgress, 0-1
+}
+
+const watchJobsRetryInterval = 5 * time.Second
+
+// How many completed jobs a watcher remembers, to ignore further changes to
+// them that don't change their state.
+const maxWatchedCompletedJobs = 1000
+
+// The response of a _changes request with include_docs
+type changesWithDocs struct {
+	LastSequence interface{} `json:"last_seq"`
+	Results      []struct {
+		Id      string          `json:"id"`
+		Deleted bool            `json:"deleted"`
+		Doc     json.RawMessage `json:"doc"`
+	} `json:"results"`
+}
+
+/*
+Watch for changes to jobs matching the filter, until ctx is done (when the
+channel is closed).  Owner filtering is done by Sync Gateway, the rest by
+the client.  Progress events come from the jobs' job_log docs.
+
+	events, err := client.WatchJobs(ctx, deepstylelib.JobFilter{Owner: "foo@bar.com"})
+	for event := range events {
+	    ...
+	}
+*/
+func (c *Client) WatchJobs(ctx context.Context, filter JobFilter) (<-chan JobEvent, error) {
+
+	since := filter.Since
+	if since == "" {
+		lastSequence, err := c.Database.LastSequence()
+		if err != nil {
+			return nil, fmt.Errorf("Error getting last sequence: %v", err)
+		}
+		since = lastSequence
+	}
+
+	events := make(chan JobEvent, 100)
+	watcher := newJobWatcher(filter, events)
+
+	go func() {
+		defer close(events)
+		for {
+			changes, err := c.changesSince(ctx, since, filter)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("Error watching jobs, retrying in %v: %v", watchJobsRetryInterval, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(watchJobsRetryInterval):
+				}
+				continue
+			}
+			if !watcher.process(ctx, changes) {
+				return
+			}
+			since = fmt.Sprintf("%v", changes.LastSequence)
+		}
+	}()
+
+	return events, nil
+
+}
+
+func (c *Client) changesSince(ctx context.Context, since string, filter JobFilter) (changes changesWithDocs, err error) {
+
+	params := url.Values{}
+	params.Set("feed", "longpoll")
+	params.Set("since", since)
+	params.Set("include_docs", "true")
+	params.Set("timeout", "60000")
+	if filter.Owner != "" {
+		params.Set("filter", "sync_gateway/bychannel")
+		params.Set("channels", filter.Owner)
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v/_changes?%v", c.SyncGatewayUrl, params.Encode()), nil)
+	if err != nil {
+		return changes, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return changes, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return changes, fmt.Errorf("Unexpected status from changes feed: %v", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&changes)
+	return changes, err
+
+}
+
+// Turns changes into events, remembering what it has seen of each job.  Only
+// jobs matching the filter that haven't completed are kept, so the memory
+// used is bounded by the jobs in flight rather than growing forever.
+type jobWatcher struct {
+	filter         JobFilter
+	events         chan<- JobEvent
+	jobs           map[string]JobDocument // last seen version of each job
+	progress       map[string]float64     // last progress of each job
+	completed      map[string]bool        // recently completed jobs, see maxWatchedCompletedJobs
+	completedOrder []string               // completed, oldest first
+}
+
+func newJobWatcher(filter JobFilter, events chan<- JobEvent) *jobWatcher {
+	return &jobWatcher{
+		filter:    filter,
+		events:    events,
+		jobs:      map[string]JobDocument{},
+		progress:  map[string]float64{},
+		completed: map[string]bool{},
+	}
+}
+
+func (w *jobWatcher) forget(jobId string) {
+	delete(w.jobs, jobId)
+	delete(w.progress, jobId)
+}
+
+func (w *jobWatcher) rememberCompleted(jobId string) {
+	w.completed[jobId] = true
+	w.completedOrder = append(w.completedOrder, jobId)
+	if len(w.completedOrder) > maxWatchedCompletedJobs {
+		delete(w.completed, w.completedOrder[0])
+		w.completedOrder = w.completedOrder[1:]
+	}
+}
+
+// Returns false if ctx was done before all the events could be sent
+func (w *jobWatcher) process(ctx context.Context, changes changesWithDocs) bool {
+
+	for _, change := range changes.Results {
+
+		if change.Deleted {
+			w.forget(change.Id)
+			delete(w.completed, change.Id)
+			continue
+		}
+		if len(change.Doc) == 0 {
+			continue
+		}
+
+		for _, event := range w.eventsFor(change.Doc) {
+			select {
+			case w.events <- event:
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+	}
+	return true
+
+}
+
+func (w *jobWatcher) eventsFor(docJson json.RawMessage) []JobEvent {
+
+	jobDoc := JobDocument{}
+	if err := json.Unmarshal(docJson, &jobDoc); err != nil {
+		return nil
+	}
+
+	switch jobDoc.Type {
+	case Job:
+		return w.jobEvents(jobDoc)
+	case JobLog:
+		logDoc := JobLogDocument{}
+		if err := json.Unmarshal(docJson, &logDoc); err != nil {
+			return nil
+		}
+		return w.progressEvents(logDoc)
+	}
+	return nil
+
+}
+
+func (w *jobWatcher) jobEvents(jobDoc JobDocument) []JobEvent {
+
+	if !w.filter.Matches(jobDoc) {
+		// if it matches later it's treated as a job that wasn't seen before
+		w.forget(jobDoc.Id)
+		return nil
+	}
+
+	previous, seen := w.jobs[jobDoc.Id]
+	isCompleted := jobDoc.IsProcessingSuccessful() || jobDoc.IsProcessingFailed()
+	if isCompleted {
+		if !seen && w.completed[jobDoc.Id] {
+			// already sent its completion, eg a later change to the result
+			return nil
+		}
+		w.forget(jobDoc.Id)
+		w.rememberCompleted(jobDoc.Id)
+	} else {
+		// eg retried
+		delete(w.completed, jobDoc.Id)
+		w.jobs[jobDoc.Id] = jobDoc
+	}
+
+	events := []JobEvent{}
+	if !seen && (jobDoc.State == StateNotReadyToProcess || strings.HasPrefix(jobDoc.Revision, "1-")) {
+		events = append(events, JobEvent{Type: JobCreated, Job: jobDoc})
+		return events
+	}
+
+	if !seen || previous.State != jobDoc.State {
+		events = append(events, JobEvent{Type: JobStateChanged, Job: jobDoc, OldState: previous.State})
+		if isCompleted {
+			events = append(events, JobEvent{Type: JobCompleted, Job: jobDoc})
+		}
+	}
+	return events
+
+}
+
+func (w *jobWatcher) progressEvents(logDoc JobLogDocument) []JobEvent {
+
+	// only jobs that have been seen can be checked against the filter
+	jobDoc, seen := w.jobs[logDoc.JobId]
+	if !seen || !w.filter.Matches(jobDoc) {
+		return nil
+	}
+	if previous, ok := w.progress[logDoc.JobId]; ok && previous == logDoc.Progress {
+		return nil
+	}
+	w.progress[logDoc.JobId] = logDoc.Progress
+	return []JobEvent{{Type: JobProgress, Job: jobDoc, Progress: logDoc.Progress}}
+
+}
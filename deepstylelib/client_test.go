@@ -0,0 +1,72 @@
+package deepstylelib
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func jobJson(id, rev, owner, state string, tags ...string) json.RawMessage {
+	jobDoc := JobDocument{Owner: owner, State: state, Tags: tags}
+	jobDoc.Id, jobDoc.Revision, jobDoc.Type = id, rev, Job
+	data, _ := json.Marshal(jobDoc)
+	return data
+}
+
+func TestJobFilterMatches(t *testing.T) {
+
+	jobDoc := JobDocument{Owner: "alice", State: StateReadyToProcess, Tags: []string{"batch", "portraits"}}
+
+	assert.True(t, JobFilter{}.Matches(jobDoc))
+	assert.True(t, JobFilter{Owner: "alice", Tags: []string{"batch"}}.Matches(jobDoc))
+	assert.False(t, JobFilter{Owner: "bob"}.Matches(jobDoc))
+	assert.False(t, JobFilter{States: []string{StateProcessingSuccessful}}.Matches(jobDoc))
+	assert.False(t, JobFilter{Tags: []string{"batch", "landscapes"}}.Matches(jobDoc))
+
+}
+
+func TestJobWatcherEvents(t *testing.T) {
+
+	watcher := newJobWatcher(JobFilter{Tags: []string{"batch"}}, nil)
+
+	events := watcher.eventsFor(jobJson("job1", "1-a", "alice", StateNotReadyToProcess, "batch"))
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, JobCreated, events[0].Type)
+
+	// no state change, no event
+	assert.Equal(t, 0, len(watcher.eventsFor(jobJson("job1", "2-a", "alice", StateNotReadyToProcess, "batch"))))
+
+	events = watcher.eventsFor(jobJson("job1", "3-a", "alice", StateBeingProcessed, "batch"))
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, JobStateChanged, events[0].Type)
+	assert.Equal(t, StateNotReadyToProcess, events[0].OldState)
+
+	logDoc := JobLogDocument{JobId: "job1", Progress: 0.5}
+	logDoc.Type = JobLog
+	logJson, _ := json.Marshal(logDoc)
+	events = watcher.eventsFor(logJson)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, JobProgress, events[0].Type)
+	assert.Equal(t, 0.5, events[0].Progress)
+
+	events = watcher.eventsFor(jobJson("job1", "4-a", "alice", StateProcessingSuccessful, "batch"))
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, JobStateChanged, events[0].Type)
+	assert.Equal(t, JobCompleted, events[1].Type)
+
+	// completed jobs are forgotten, but later changes to them are ignored
+	assert.Equal(t, 0, len(watcher.jobs))
+	assert.Equal(t, 0, len(watcher.progress))
+	assert.Equal(t, 0, len(watcher.eventsFor(jobJson("job1", "5-a", "alice", StateProcessingSuccessful, "batch"))))
+
+	// retried
+	events = watcher.eventsFor(jobJson("job1", "6-a", "alice", StateReadyToProcess, "batch"))
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, JobStateChanged, events[0].Type)
+
+	// filtered out, and not kept
+	assert.Equal(t, 0, len(watcher.eventsFor(jobJson("job2", "1-a", "alice", StateNotReadyToProcess))))
+	assert.Equal(t, 1, len(watcher.jobs))
+
+}
@@ -0,0 +1,142 @@
+package deepstyletest
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+type ConformanceOptions struct {
+	GoldenDir     string        // Compare outputs with <sample name>.jpg in here, if set
+	HashTolerance int           // Perceptual hash bits that may differ, defaults to DefaultHashTolerance
+	Timeout       time.Duration // For each run, defaults to 10 minutes
+	CancelTimeout time.Duration // How soon Run must return once cancelled, defaults to 10 seconds
+}
+
+// Tolerated difference between the aspect ratios of the photo and output
+const aspectRatioTolerance = 0.05
+
+func (o ConformanceOptions) withDefaults() ConformanceOptions {
+	if o.HashTolerance == 0 {
+		o.HashTolerance = DefaultHashTolerance
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Minute
+	}
+	if o.CancelTimeout == 0 {
+		o.CancelTimeout = 10 * time.Second
+	}
+	return o
+}
+
+/*
+Check engine against the contract the workers rely on, as subtests:
+
+  - it has a name
+  - for each of the SampleJobs, Run writes a JPEG to the output path (the
+    workers attach it as one) with the photo's aspect ratio (and matching the
+    golden image, if there's a GoldenDir)
+  - Run fails when the photo is missing
+  - Run returns promptly once its context is cancelled
+
+Engines that aren't Available() are skipped.
+*/
+func RunEngineConformance(t *testing.T, engine deepstylelib.Engine, options ConformanceOptions) {
+
+	options = options.withDefaults()
+
+	if engine.Name() == "" {
+		t.Errorf("Engine has no name")
+	}
+	if !engine.Available() {
+		t.Skipf("Engine %v isn't available", engine.Name())
+	}
+
+	for _, sample := range SampleJobs(t) {
+		sample := sample
+		t.Run(sample.Name, func(t *testing.T) {
+			checkEngineOutput(t, engine, sample, options)
+		})
+	}
+
+	t.Run("missing_photo", func(t *testing.T) {
+		sample := SampleJobs(t)[0]
+		sample.SourceImagePath = filepath.Join(t.TempDir(), "missing.png")
+		ctx, cancel := context.WithTimeout(context.Background(), options.Timeout)
+		defer cancel()
+		output := &bytes.Buffer{}
+		if err := engine.Run(ctx, sample.EngineParams(filepath.Join(t.TempDir(), "output.jpg")), output); err == nil {
+			t.Errorf("Expected an error for a missing photo, output: %v", output.String())
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		sample := SampleJobs(t)[0]
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		done := make(chan struct{})
+		go func() {
+			engine.Run(ctx, sample.EngineParams(filepath.Join(t.TempDir(), "output.jpg")), &bytes.Buffer{})
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(options.CancelTimeout):
+			t.Errorf("Run didn't return within %v of being cancelled", options.CancelTimeout)
+		}
+	})
+
+}
+
+func checkEngineOutput(t *testing.T, engine deepstylelib.Engine, sample SampleJob, options ConformanceOptions) {
+
+	outputPath := filepath.Join(t.TempDir(), "output.jpg")
+	ctx, cancel := context.WithTimeout(context.Background(), options.Timeout)
+	defer cancel()
+
+	output := &bytes.Buffer{}
+	if err := engine.Run(ctx, sample.EngineParams(outputPath), output); err != nil {
+		t.Fatalf("Run failed: %v, output: %v", err, output.String())
+	}
+
+	if _, err := os.Stat(outputPath); err != nil {
+		t.Fatalf("No output image: %v", err)
+	}
+	format, err := ImageFormat(outputPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if format != "jpeg" {
+		t.Errorf("Output is a %v image, expected a JPEG", format)
+	}
+	outputImg, err := LoadImage(outputPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	photo, err := LoadImage(sample.SourceImagePath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	photoRatio, outputRatio := aspectRatio(photo), aspectRatio(outputImg)
+	if math.Abs(photoRatio-outputRatio)/photoRatio > aspectRatioTolerance {
+		t.Errorf("Output is %vx%v, expected the photo's aspect ratio (%vx%v)",
+			outputImg.Bounds().Dx(), outputImg.Bounds().Dy(), photo.Bounds().Dx(), photo.Bounds().Dy())
+	}
+
+	if options.GoldenDir != "" {
+		AssertGoldenImage(t, outputPath, filepath.Join(options.GoldenDir, sample.Name+".jpg"), options.HashTolerance)
+	}
+
+}
+
+func aspectRatio(img image.Image) float64 {
+	return float64(img.Bounds().Dx()) / float64(img.Bounds().Dy())
+}
@@ -0,0 +1,80 @@
+package deepstyletest
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+func TestPerceptualHash(t *testing.T) {
+
+	img := SampleImage(SamplePhotoWidth, SamplePhotoHeight, 8, color.RGBA{B: 64})
+	same := SampleImage(SamplePhotoWidth*2, SamplePhotoHeight*2, 16, color.RGBA{B: 64})
+	different := SampleImage(SamplePhotoWidth, SamplePhotoHeight, 8, color.RGBA{}).(*image.RGBA)
+	for x := 0; x < SamplePhotoWidth/2; x++ {
+		for y := 0; y < SamplePhotoHeight; y++ {
+			different.Set(x, y, color.White)
+		}
+	}
+
+	// scaled up is the same image
+	assert.True(t, HashDistance(PerceptualHash(img), PerceptualHash(same)) <= DefaultHashTolerance)
+	assert.True(t, HashDistance(PerceptualHash(img), PerceptualHash(different)) > DefaultHashTolerance)
+
+}
+
+func TestAssertGoldenImage(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "output.png")
+	goldenPath := filepath.Join(dir, "golden", "output.png")
+	assert.NoError(t, WriteImage(path, SampleImage(SamplePhotoWidth, SamplePhotoHeight, 8, color.RGBA{})))
+
+	os.Setenv(UpdateGoldenEnvVar, "1")
+	AssertGoldenImage(t, path, goldenPath, DefaultHashTolerance)
+	os.Unsetenv(UpdateGoldenEnvVar)
+
+	assert.NoError(t, CompareImages(path, goldenPath, 0))
+
+	assert.NoError(t, WriteImage(path, SampleImage(SamplePhotoWidth, SamplePhotoHeight, 32, color.RGBA{R: 255})))
+	assert.Error(t, CompareImages(path, goldenPath, DefaultHashTolerance))
+
+}
+
+func TestSampleJobDocument(t *testing.T) {
+	jobDoc := SampleJobDocument("job1", deepstylelib.StateProcessingFailed)
+	assert.Equal(t, deepstylelib.ErrorCodeOutOfMemory, jobDoc.ErrorCode)
+	jobDocAt, err := jobDoc.StateAt(jobDoc.History[1].Timestamp)
+	assert.NoError(t, err)
+	assert.Equal(t, deepstylelib.StateReadyToProcess, jobDocAt.State)
+}
+
+func TestImageFormat(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "sample.jpg")
+	assert.NoError(t, WriteImage(path, SampleImage(SamplePhotoWidth, SamplePhotoHeight, 8, color.RGBA{})))
+	format, err := ImageFormat(path)
+	assert.NoError(t, err)
+	// the extension doesn't make it one
+	assert.Equal(t, "png", format)
+
+	for _, name := range []string{"landscape", "portrait", "with_variants"} {
+		format, err := ImageFormat(filepath.Join("testdata", "golden", name+".jpg"))
+		assert.NoError(t, err)
+		assert.Equal(t, "jpeg", format, name)
+	}
+
+}
+
+func TestRunEngineConformance(t *testing.T) {
+
+	// the fake engine just re-encodes the photos, so testdata/golden has the
+	// sample photos as JPEGs
+	RunEngineConformance(t, deepstylelib.NewFakeEngine(), ConformanceOptions{GoldenDir: "testdata/golden"})
+
+}
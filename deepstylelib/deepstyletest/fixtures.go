@@ -0,0 +1,185 @@
+package deepstyletest
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tleyden/deepstyle/deepstylelib"
+)
+
+// Sizes of the generated sample images.  The photo isn't square, so engines
+// that mix up width and height get caught.
+const (
+	SamplePhotoWidth  = 96
+	SamplePhotoHeight = 64
+	SampleStyleSize   = 64
+)
+
+// A photo and style image on disk, along with a job doc for them
+type SampleJob struct {
+	Name            string
+	SourceImagePath string
+	StyleImagePath  string
+	JobDocument     deepstylelib.JobDocument
+}
+
+// Params for running an engine on the sample, writing to outputPath
+func (s SampleJob) EngineParams(outputPath string) deepstylelib.EngineParams {
+	return deepstylelib.EngineParams{
+		SourceImagePath: s.SourceImagePath,
+		StyleImagePath:  s.StyleImagePath,
+		OutputImagePath: outputPath,
+	}
+}
+
+// Draw a deterministic test image: a gradient with a stripe pattern every
+// period pixels, tinted by tint.
+func SampleImage(width, height, period int, tint color.RGBA) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			stripe := uint8(0)
+			if (x/period+y/period)%2 == 0 {
+				stripe = 96
+			}
+			img.Set(x, y, color.RGBA{
+				R: uint8(x*159/width) + stripe/2 | tint.R,
+				G: uint8(y*159/height) + stripe/2 | tint.G,
+				B: stripe | tint.B,
+				A: 255,
+			})
+		}
+	}
+	return img
+}
+
+func WriteImage(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// The sample jobs, with their images written to a temp dir that's removed
+// when the test is done.  Each has a different photo and style, so their
+// results shouldn't look alike.
+func SampleJobs(t testing.TB) []SampleJob {
+
+	t.Helper()
+	dir := t.TempDir()
+
+	samples := []struct {
+		name           string
+		photo          image.Image
+		style          image.Image
+		styleName      string
+		priority       string
+		resultVariants []string
+	}{
+		{
+			name:      "portrait",
+			photo:     SampleImage(SamplePhotoHeight, SamplePhotoWidth, 8, color.RGBA{B: 64}),
+			style:     SampleImage(SampleStyleSize, SampleStyleSize, 4, color.RGBA{R: 128, B: 192}),
+			styleName: "stripes",
+		},
+		{
+			name:      "landscape",
+			photo:     SampleImage(SamplePhotoWidth, SamplePhotoHeight, 16, color.RGBA{G: 32}),
+			style:     SampleImage(SampleStyleSize, SampleStyleSize, 16, color.RGBA{R: 192}),
+			styleName: "squares",
+			priority:  deepstylelib.PriorityBatch,
+		},
+		{
+			name:           "with_variants",
+			photo:          SampleImage(SamplePhotoWidth, SamplePhotoHeight, 4, color.RGBA{R: 64, G: 64}),
+			style:          SampleImage(SampleStyleSize, SampleStyleSize, 32, color.RGBA{G: 128, B: 128}),
+			styleName:      "blocks",
+			resultVariants: []string{deepstylelib.VariantMedium, deepstylelib.VariantThumbnail},
+		},
+	}
+
+	sampleJobs := []SampleJob{}
+	for _, sample := range samples {
+
+		sampleJob := SampleJob{
+			Name:            sample.name,
+			SourceImagePath: filepath.Join(dir, sample.name+"_photo.png"),
+			StyleImagePath:  filepath.Join(dir, sample.name+"_style.png"),
+		}
+		if err := WriteImage(sampleJob.SourceImagePath, sample.photo); err != nil {
+			t.Fatalf("Error writing sample photo: %v", err)
+		}
+		if err := WriteImage(sampleJob.StyleImagePath, sample.style); err != nil {
+			t.Fatalf("Error writing sample style: %v", err)
+		}
+
+		sampleJob.JobDocument = SampleJobDocument(sample.name, deepstylelib.StateReadyToProcess)
+		sampleJob.JobDocument.StyleName = sample.styleName
+		sampleJob.JobDocument.Priority = sample.priority
+		sampleJob.JobDocument.ResultVariants = sample.resultVariants
+
+		sampleJobs = append(sampleJobs, sampleJob)
+	}
+	return sampleJobs
+
+}
+
+// A job doc in the given state, as a worker would find it in Sync Gateway.
+// Failed jobs have an error code, successful ones a result hash.
+func SampleJobDocument(id, state string) deepstylelib.JobDocument {
+
+	createdAt := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	jobDoc := deepstylelib.JobDocument{
+		State:     state,
+		CreatedAt: createdAt.Format(time.RFC3339),
+		Owner:     "test@example.com",
+		Attachments: deepstylelib.Attachments{
+			deepstylelib.SourceImageAttachment: map[string]interface{}{"content_type": "image/png", "stub": true},
+			deepstylelib.StyleImageAttachment:  map[string]interface{}{"content_type": "image/png", "stub": true},
+		},
+		History: []deepstylelib.JobHistoryEntry{
+			{Timestamp: createdAt, State: deepstylelib.StateNotReadyToProcess},
+			{Timestamp: createdAt.Add(time.Second), State: deepstylelib.StateReadyToProcess},
+		},
+	}
+	jobDoc.Id = id
+	jobDoc.Revision = "3-0123456789abcdef"
+	jobDoc.Type = deepstylelib.Job
+
+	completedAt := createdAt.Add(time.Minute)
+	switch state {
+	case deepstylelib.StateNotReadyToProcess:
+		delete(jobDoc.Attachments, deepstylelib.StyleImageAttachment)
+		jobDoc.History = jobDoc.History[:1]
+	case deepstylelib.StateBeingProcessed:
+		jobDoc.History = append(jobDoc.History, deepstylelib.JobHistoryEntry{Timestamp: completedAt, State: state, Worker: "test-worker"})
+	case deepstylelib.StateProcessingSuccessful:
+		jobDoc.ResultHash = "0000000000000000000000000000000000000000000000000000000000000000"
+		jobDoc.Attachments[deepstylelib.ResultImageAttachment] = map[string]interface{}{"content_type": "image/jpeg", "stub": true}
+		jobDoc.History = append(jobDoc.History, deepstylelib.JobHistoryEntry{Timestamp: completedAt, State: state, Worker: "test-worker"})
+	case deepstylelib.StateProcessingFailed:
+		jobDoc.ErrorCode = deepstylelib.ErrorCodeOutOfMemory
+		jobDoc.ErrorMessage = "exit status 1"
+		jobDoc.StdOutAndErr = "THCudaCheck FAIL: out of memory"
+		jobDoc.History = append(jobDoc.History, deepstylelib.JobHistoryEntry{
+			Timestamp:    completedAt,
+			State:        state,
+			ErrorCode:    jobDoc.ErrorCode,
+			ErrorMessage: jobDoc.ErrorMessage,
+			Worker:       "test-worker",
+		})
+	}
+	return jobDoc
+
+}
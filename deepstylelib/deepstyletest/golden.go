@@ -0,0 +1,201 @@
+/*
+Package deepstyletest has helpers for testing code built on deepstylelib,
+in particular engines: golden image comparisons that tolerate the small
+differences between runs (and GPUs), sample job fixtures, and a conformance
+harness that checks an Engine against the contract the workers rely on.
+
+	func TestMyEngine(t *testing.T) {
+	    deepstyletest.RunEngineConformance(t, NewMyEngine(), deepstyletest.ConformanceOptions{
+	        GoldenDir: "testdata/golden",
+	    })
+	}
+
+Run the tests with DEEPSTYLE_UPDATE_GOLDEN=1 to (re)write the golden images
+from the current output.  For the GPU engines, do that on a reference machine
+(eg a GPU instance for neural-style, a Jetson for the Jetson engine), check
+the images by eye and commit them; runs elsewhere then compare against them
+within the hash tolerance.  This package's own tests run the harness against
+deepstylelib.NewFakeEngine(), whose golden images in testdata/golden are just
+the sample photos as JPEGs.
+*/
+package deepstyletest
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Set to 1 to write the golden images rather than compare against them
+const UpdateGoldenEnvVar = "DEEPSTYLE_UPDATE_GOLDEN"
+
+// How many of the 64 perceptual hash bits may differ for images to count as
+// the same.  Re-encoding or slightly different floating point results flip a
+// few bits, a different style or photo flips around half of them.
+const DefaultHashTolerance = 10
+
+// The dimensions of the grid PerceptualHash compares, one bit per pair of
+// horizontally adjacent cells.
+const (
+	hashWidth  = 9
+	hashHeight = 8
+)
+
+func LoadImage(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding %v: %v", path, err)
+	}
+	return img, nil
+}
+
+// The format of the image at path, as registered with the image package, eg
+// "jpeg" or "png"
+func ImageFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return "", fmt.Errorf("Error decoding %v: %v", path, err)
+	}
+	return format, nil
+}
+
+// The average luminance of each cell of a width x height grid over img
+func luminanceGrid(img image.Image, width, height int) [][]float64 {
+
+	bounds := img.Bounds()
+	grid := make([][]float64, height)
+
+	for row := 0; row < height; row++ {
+		grid[row] = make([]float64, width)
+		minY := bounds.Min.Y + row*bounds.Dy()/height
+		maxY := bounds.Min.Y + (row+1)*bounds.Dy()/height
+		if maxY <= minY {
+			maxY = minY + 1
+		}
+		for col := 0; col < width; col++ {
+			minX := bounds.Min.X + col*bounds.Dx()/width
+			maxX := bounds.Min.X + (col+1)*bounds.Dx()/width
+			if maxX <= minX {
+				maxX = minX + 1
+			}
+			total, count := 0.0, 0
+			for y := minY; y < maxY && y < bounds.Max.Y; y++ {
+				for x := minX; x < maxX && x < bounds.Max.X; x++ {
+					r, g, b, _ := img.At(x, y).RGBA()
+					total += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					count++
+				}
+			}
+			if count > 0 {
+				grid[row][col] = total / float64(count)
+			}
+		}
+	}
+	return grid
+
+}
+
+// A 64 bit difference hash of img: each bit says whether a cell of a
+// downscaled grayscale copy is brighter than its right hand neighbour.
+// Similar looking images have hashes that differ in only a few bits,
+// whatever their size or encoding.
+func PerceptualHash(img image.Image) uint64 {
+	grid := luminanceGrid(img, hashWidth, hashHeight)
+	hash := uint64(0)
+	for row := 0; row < hashHeight; row++ {
+		for col := 0; col < hashWidth-1; col++ {
+			hash <<= 1
+			if grid[row][col] > grid[row][col+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// The number of bits that differ between two hashes
+func HashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Compare the image at path with the golden image, returning an error if
+// more than tolerance bits of their perceptual hashes differ.
+func CompareImages(path, goldenPath string, tolerance int) error {
+
+	img, err := LoadImage(path)
+	if err != nil {
+		return err
+	}
+	golden, err := LoadImage(goldenPath)
+	if err != nil {
+		return err
+	}
+
+	distance := HashDistance(PerceptualHash(img), PerceptualHash(golden))
+	if distance > tolerance {
+		return fmt.Errorf("%v differs from %v by %v bits (tolerance %v)", path, goldenPath, distance, tolerance)
+	}
+	return nil
+
+}
+
+// Fail t unless the image at path matches the golden image within tolerance.
+// With DEEPSTYLE_UPDATE_GOLDEN=1 the golden image is replaced instead.
+func AssertGoldenImage(t testing.TB, path, goldenPath string, tolerance int) {
+
+	t.Helper()
+
+	if os.Getenv(UpdateGoldenEnvVar) == "1" {
+		if err := copyFile(goldenPath, path); err != nil {
+			t.Fatalf("Error updating golden image %v: %v", goldenPath, err)
+		}
+		t.Logf("Updated golden image %v", goldenPath)
+		return
+	}
+
+	if _, err := os.Stat(goldenPath); os.IsNotExist(err) {
+		t.Fatalf("No golden image %v, run with %v=1 to create it", goldenPath, UpdateGoldenEnvVar)
+	}
+	if err := CompareImages(path, goldenPath, tolerance); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func copyFile(dst, src string) error {
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	d, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(d, s); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+
+}
@@ -0,0 +1,129 @@
+package deepstylelib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDatabase(t *testing.T) {
+
+	statusCode := 200
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/deepstyle/", r.URL.Path)
+		w.WriteHeader(statusCode)
+	}))
+	defer server.Close()
+
+	check := checkDatabase("Sync Gateway", server.URL+"/deepstyle")
+	assert.True(t, check.Ok())
+
+	for _, statusCode = range []int{401, 403, 404, 500} {
+		check = checkDatabase("Sync Gateway", server.URL+"/deepstyle")
+		assert.False(t, check.Ok(), "%v", statusCode)
+		assert.False(t, check.Warning)
+		assert.NotEmpty(t, check.Remediation)
+	}
+
+	// nothing listening
+	server.Close()
+	check = checkDatabase("Sync Gateway", server.URL+"/deepstyle")
+	assert.False(t, check.Ok())
+	assert.Contains(t, check.Remediation, "Make sure Sync Gateway is running")
+
+}
+
+func TestCheckDesignDoc(t *testing.T) {
+
+	sg := newFakeSyncGateway(t)
+	designDoc := doctorDesignDoc{MaintenanceDesignDocName, []string{JobLogsViewName, CompletedJobsViewName}, "maintenance"}
+
+	// not installed yet, which is fine
+	check := checkDesignDoc(sg.DBURL(), designDoc)
+	assert.False(t, check.Ok())
+	assert.True(t, check.Warning)
+	assert.Contains(t, check.Remediation, "deepstyle maintenance")
+
+	// installed before the completed_jobs view was added
+	sg.handle("GET", "/_design/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"views":{"job_logs":{"map":"function (doc, meta) {}"}}}`))
+	})
+	check = checkDesignDoc(sg.DBURL(), designDoc)
+	assert.False(t, check.Ok())
+	assert.False(t, check.Warning)
+	assert.Contains(t, check.Err.Error(), CompletedJobsViewName)
+	assert.NotContains(t, check.Err.Error(), JobLogsViewName)
+
+	// as installMaintenanceViews installs it
+	var installed []byte
+	sg.handle("PUT", "/_design/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		installed, _ = ioutil.ReadAll(r.Body)
+	})
+	assert.NoError(t, installMaintenanceViews(sg.DBURL()))
+	sg.handle("GET", "/_design/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(installed)
+	})
+	check = checkDesignDoc(sg.DBURL(), designDoc)
+	assert.True(t, check.Ok(), "%v", check.Err)
+
+	sg.handle("GET", "/_design/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	})
+	check = checkDesignDoc(sg.DBURL(), designDoc)
+	assert.False(t, check.Ok())
+	assert.False(t, check.Warning)
+
+}
+
+func TestCheckUniqush(t *testing.T) {
+
+	psps := `{"deepstyle":["apns:abc"]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/version":
+			w.Write([]byte("uniqush-push 2.6.0"))
+		case "/psps":
+			w.Write([]byte(psps))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	check := checkUniqush(server.URL + "/")
+	assert.True(t, check.Ok(), "%v", check.Err)
+
+	// there's no push service for deepstyle
+	psps = `{}`
+	check = checkUniqush(server.URL)
+	assert.False(t, check.Ok())
+	assert.Contains(t, check.Remediation, "addpsp")
+
+	server.Close()
+	check = checkUniqush(server.URL)
+	assert.False(t, check.Ok())
+
+}
+
+func TestRunDoctor(t *testing.T) {
+
+	sg := newFakeSyncGateway(t)
+	sg.handle("GET", "/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"db_name":"deepstyle"}`))
+	})
+
+	checks := RunDoctor(DoctorOptions{SyncGatewayUrl: sg.DBURL()})
+	assert.Len(t, checks, 1)
+	assert.True(t, checks[0].Ok(), "%v", checks[0].Err)
+
+	// and the design docs, none of which are installed
+	checks = RunDoctor(DoctorOptions{SyncGatewayUrl: sg.DBURL(), SyncGatewayAdminUrl: sg.DBURL()})
+	assert.Len(t, checks, 2+len(doctorDesignDocs))
+	for _, check := range checks[2:] {
+		assert.True(t, check.Warning, check.Name)
+	}
+
+}
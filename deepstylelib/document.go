@@ -6,12 +6,20 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"time"
+
+	"github.com/tleyden/go-couch"
 )
 
 // Doc types
 const (
-	Job = "job"
+	Job            = "job"
+	JobLog         = "job_log"
+	Audit          = "audit"
+	WorkerRollout  = "worker_rollout"
+	WorkerCapacity = "worker_capacity"
 )
 
 // Job States
@@ -41,14 +49,67 @@ func (doc TypedDocument) IsJob() bool {
 
 type JobDocument struct {
 	TypedDocument
-	Attachments      Attachments `json:"_attachments"`
-	State            string      `json:"state"`
-	CreatedAt        string      `json:"created_at"`
-	Owner            string      `json:"owner"`
-	OwnerDeviceToken string      `json:"owner_devicetoken"`
-	ErrorMessage     string      `json:"error_message"`
-	StdOutAndErr     string      `json:"std_out_and_err"`
-	config           configuration
+	Attachments         Attachments                  `json:"_attachments"`
+	State               string                       `json:"state"`
+	CreatedAt           string                       `json:"created_at"`
+	Owner               string                       `json:"owner"`
+	OwnerDeviceToken    string                       `json:"owner_devicetoken"`
+	StyleName           string                       `json:"style_name,omitempty"`
+	Priority            string                       `json:"priority,omitempty"` // PriorityInteractive (the default) or PriorityBatch
+	Tags                []string                     `json:"tags,omitempty"`     // Set by the app, eg for WatchJobs filters
+	ResultSinks         []string                     `json:"result_sinks"`       // nil means all configured sinks
+	ResultVariants      []string                     `json:"result_variants,omitempty"`
+	ResultManifest      map[string]ResultVariantInfo `json:"result_manifest,omitempty"`
+	ResultHash          string                       `json:"result_hash,omitempty"` // sha256 of result_image
+	ErrorMessage        string                       `json:"error_message"`         // Internal details, see ErrorCode
+	ErrorCode           string                       `json:"error_code,omitempty"`
+	ErrorParams         map[string]string            `json:"error_params,omitempty"`
+	Locale              string                       `json:"locale,omitempty"` // For messages to the owner, eg en-US
+	StdOutAndErr        string                       `json:"std_out_and_err"`
+	HangCount           int                          `json:"hang_count,omitempty"`
+	HungOnWorkers       []string                     `json:"hung_on_workers,omitempty"`
+	LastHungAt          string                       `json:"last_hung_at,omitempty"`
+	ExternalAttachments map[string]string            `json:"external_attachments,omitempty"` // Too large for Sync Gateway, see ExternalStore
+	History             []JobHistoryEntry            `json:"history,omitempty"`              // See StateAt
+	config              configuration
+	jobLog              *JobLogDocument // Cached by AppendStdOutAndErr
+}
+
+// Create a new job from the fields set on jobDoc (eg, Owner), upload the
+// photo and style image, and mark it as ready to process.
+func CreateJob(db couch.Database, jobDoc JobDocument, sourceImagePath, styleImagePath string) (*JobDocument, error) {
+
+	jobDoc.Type = Job
+	jobDoc.State = StateNotReadyToProcess
+	jobDoc.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	jobDoc.recordHistory()
+
+	docId, _, err := insertDoc(db, jobDoc)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating job doc: %v", err)
+	}
+
+	config := configuration{
+		Database: db,
+	}
+	createdJobDoc, err := NewJobDocument(docId, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := createdJobDoc.AddAttachment(SourceImageAttachment, sourceImagePath); err != nil {
+		return createdJobDoc, err
+	}
+	if err := createdJobDoc.AddAttachment(StyleImageAttachment, styleImagePath); err != nil {
+		return createdJobDoc, err
+	}
+
+	if _, err := createdJobDoc.UpdateState(StateReadyToProcess); err != nil {
+		return createdJobDoc, err
+	}
+
+	return createdJobDoc, nil
+
 }
 
 func NewJobDocument(documentId string, config configuration) (jobDocument *JobDocument, err error) {
@@ -60,6 +121,19 @@ func NewJobDocument(documentId string, config configuration) (jobDocument *JobDo
 	return jobDocument, err
 }
 
+func (doc JobDocument) HasTag(tag string) bool {
+	for _, jobTag := range doc.Tags {
+		if jobTag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (doc JobDocument) IsBatch() bool {
+	return doc.Priority == PriorityBatch
+}
+
 func (doc JobDocument) IsReadyToProcess() bool {
 	return doc.State == StateReadyToProcess
 }
@@ -72,6 +146,8 @@ func (doc JobDocument) IsProcessingFailed() bool {
 	return doc.State == StateProcessingFailed
 }
 
+// Replace the whole std_out_and_err field.  While a job is running, use
+// AppendStdOutAndErr() instead.
 func (doc *JobDocument) SetStdOutAndErr(stdOutAndErr string) (updated bool, err error) {
 
 	db := doc.config.Database
@@ -91,7 +167,8 @@ func (doc *JobDocument) SetStdOutAndErr(stdOutAndErr string) (updated bool, err
 		return doc.RefreshFromDB()
 	}
 
-	return db.EditRetry(
+	return editDocRetry(
+		db,
 		doc,
 		retryUpdater,
 		retryDoneMetric,
@@ -106,6 +183,11 @@ func (doc *JobDocument) UpdateState(newState string) (updated bool, err error) {
 
 	retryUpdater := func() {
 		doc.State = newState
+		if newState == StateReadyToProcess {
+			// a retry, so any earlier failure no longer applies
+			doc.clearError()
+		}
+		doc.recordHistory()
 	}
 
 	retryDoneMetric := func() bool {
@@ -116,7 +198,8 @@ func (doc *JobDocument) UpdateState(newState string) (updated bool, err error) {
 		return doc.RefreshFromDB()
 	}
 
-	return db.EditRetry(
+	return editDocRetry(
+		db,
 		doc,
 		retryUpdater,
 		retryDoneMetric,
@@ -125,27 +208,134 @@ func (doc *JobDocument) UpdateState(newState string) (updated bool, err error) {
 
 }
 
-func (doc *JobDocument) SetErrorMessage(errorMessage error) (updated bool, err error) {
+// Whether the engine hung while processing this job on the given worker
+func (doc JobDocument) HungOnWorker(workerId string) bool {
+	for _, hungOnWorker := range doc.HungOnWorkers {
+		if hungOnWorker == workerId {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether to leave the job for other workers because it hung on this one,
+// which it only does for HangRetryCooldown.  Otherwise with fewer than
+// MaxHangRetries workers it would never be failed (or finished).
+func (doc JobDocument) waitingForHangRetry(workerId string, now time.Time) bool {
+	if !doc.HungOnWorker(workerId) {
+		return false
+	}
+	lastHungAt, err := time.Parse(time.RFC3339, doc.LastHungAt)
+	if err != nil {
+		return false
+	}
+	return now.Sub(lastHungAt) < HangRetryCooldown
+}
+
+// Record that the engine hung on this worker and put the job back in the
+// queue for another worker, or fail it after MaxHangRetries hangs.  The
+// engine output so far is saved in the same revision.
+func (doc *JobDocument) MarkHung(workerId string, hangErr error, stdOutAndErr string) (updated bool, err error) {
 
 	db := doc.config.Database
+	hangCount := doc.HangCount + 1
+	now := time.Now()
 
-	if errorMessage.Error() == "" {
-		return false, nil
+	retryUpdater := func() {
+		doc.recordHang(workerId, hangErr, hangCount, now)
+		if stdOutAndErr != "" {
+			doc.StdOutAndErr = stdOutAndErr
+		}
+	}
+
+	retryDoneMetric := func() bool {
+		return doc.HangCount >= hangCount
+	}
+
+	retryRefresh := func() error {
+		return doc.RefreshFromDB()
+	}
+
+	return editDocRetry(
+		db,
+		doc,
+		retryUpdater,
+		retryDoneMetric,
+		retryRefresh,
+	)
+
+}
+
+func (doc *JobDocument) recordHang(workerId string, hangErr error, hangCount int, now time.Time) {
+	doc.HangCount = hangCount
+	doc.LastHungAt = now.UTC().Format(time.RFC3339)
+	if !doc.HungOnWorker(workerId) {
+		doc.HungOnWorkers = append(doc.HungOnWorkers, workerId)
+	}
+	if hangCount >= MaxHangRetries {
+		doc.State = StateProcessingFailed
+		doc.ErrorMessage = fmt.Sprintf("%v (hung %v times, giving up)", hangErr, hangCount)
+		doc.ErrorCode = ErrorCodeEngineHung
+	} else {
+		doc.State = StateReadyToProcess
+		doc.clearError()
+	}
+	doc.recordHistory()
+}
+
+func (doc *JobDocument) SetResultHash(resultHash string) (updated bool, err error) {
+
+	db := doc.config.Database
+
+	retryUpdater := func() {
+		doc.ResultHash = resultHash
+	}
+
+	retryDoneMetric := func() bool {
+		return doc.ResultHash == resultHash
+	}
+
+	retryRefresh := func() error {
+		return doc.RefreshFromDB()
+	}
+
+	return editDocRetry(
+		db,
+		doc,
+		retryUpdater,
+		retryDoneMetric,
+		retryRefresh,
+	)
+
+}
+
+// The content addressed path the API serves the result at, see
+// serveImmutableResult.  Empty until the job has succeeded.
+func (doc JobDocument) ImmutableResultPath() string {
+	if !doc.IsProcessingSuccessful() || doc.ResultHash == "" {
+		return ""
 	}
+	return fmt.Sprintf("/results/%v/%v.jpg", url.PathEscape(doc.Id), doc.ResultHash)
+}
+
+func (doc *JobDocument) SetResultManifest(manifest map[string]ResultVariantInfo) (updated bool, err error) {
+
+	db := doc.config.Database
 
 	retryUpdater := func() {
-		doc.ErrorMessage = errorMessage.Error()
+		doc.ResultManifest = manifest
 	}
 
 	retryDoneMetric := func() bool {
-		return doc.ErrorMessage == errorMessage.Error()
+		return len(doc.ResultManifest) == len(manifest)
 	}
 
 	retryRefresh := func() error {
 		return doc.RefreshFromDB()
 	}
 
-	return db.EditRetry(
+	return editDocRetry(
+		db,
 		doc,
 		retryUpdater,
 		retryDoneMetric,
@@ -154,7 +344,66 @@ func (doc *JobDocument) SetErrorMessage(errorMessage error) (updated bool, err e
 
 }
 
+// Mark the job as failed and record why: the internal error message along
+// with the user facing error code (see ClassifyJobError).  They're saved in
+// the same revision, so the notifier never sees a failed job without its
+// error code.  The engine output, if any, goes in the same revision too.
+func (doc *JobDocument) SetFailed(jobErr error, stdOutAndErr string) (updated bool, err error) {
+
+	db := doc.config.Database
+	errorCode, errorParams := ClassifyJobError(jobErr, stdOutAndErr)
+
+	retryUpdater := func() {
+		doc.State = StateProcessingFailed
+		doc.ErrorMessage = jobErr.Error()
+		doc.ErrorCode = errorCode
+		doc.ErrorParams = errorParams
+		if stdOutAndErr != "" {
+			doc.StdOutAndErr = stdOutAndErr
+		}
+		doc.recordHistory()
+	}
+
+	retryDoneMetric := func() bool {
+		return doc.State == StateProcessingFailed && doc.ErrorMessage == jobErr.Error() && doc.ErrorCode == errorCode &&
+			(stdOutAndErr == "" || doc.StdOutAndErr == stdOutAndErr)
+	}
+
+	retryRefresh := func() error {
+		return doc.RefreshFromDB()
+	}
+
+	return editDocRetry(
+		db,
+		doc,
+		retryUpdater,
+		retryDoneMetric,
+		retryRefresh,
+	)
+
+}
+
+func (doc *JobDocument) clearError() {
+	doc.ErrorMessage = ""
+	doc.ErrorCode = ""
+	doc.ErrorParams = nil
+}
+
+// The error message to show the owner of a failed job, in their locale
+func (doc JobDocument) UserErrorMessage(locales ...string) string {
+	if !doc.IsProcessingFailed() || doc.ErrorCode == "" {
+		return ""
+	}
+	if doc.Locale != "" {
+		locales = append(locales, doc.Locale)
+	}
+	return UserErrorMessage(doc.ErrorCode, doc.ErrorParams, locales...)
+}
+
 func (doc *JobDocument) RetrieveAttachment(attachmentName string) (io.Reader, error) {
+	if reader, ok, err := doc.retrieveExternalAttachment(attachmentName); ok {
+		return reader, err
+	}
 	db := doc.config.Database
 	return db.RetrieveAttachment(doc.Id, attachmentName)
 }
@@ -171,6 +420,7 @@ func (doc *JobDocument) RefreshFromDB() error {
 	// if we don't do this, the new doc won't have the config
 	// with the db url.
 	jobDoc.SetConfiguration(doc.config)
+	jobDoc.jobLog = doc.jobLog
 
 	err := db.Retrieve(doc.Id, &jobDoc)
 	if err != nil {
@@ -180,8 +430,21 @@ func (doc *JobDocument) RefreshFromDB() error {
 	return nil
 }
 
+// Upload the file as an attachment, or if it's too large for Sync Gateway
+// and there's an external store, put it there instead.
 func (doc *JobDocument) AddAttachment(attachmentName, filepath string) (err error) {
 
+	err = doc.addSyncGatewayAttachment(attachmentName, filepath)
+	if store := getExternalStore(); store != nil && IsPayloadTooLarge(err) {
+		log.Printf("%v, using the external store", err)
+		return doc.addExternalAttachment(store, attachmentName, filepath)
+	}
+	return err
+
+}
+
+func (doc *JobDocument) addSyncGatewayAttachment(attachmentName, filepath string) (err error) {
+
 	db := doc.config.Database
 	dbUrl := db.DBURL()
 
@@ -199,7 +462,13 @@ func (doc *JobDocument) AddAttachment(attachmentName, filepath string) (err erro
 	}
 	defer f.Close()
 
-	reader := bufio.NewReader(f)
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fileInfo.Size() > MaxAttachmentSize {
+		return newErrPayloadTooLarge(endpointUrlStr, fileInfo.Size())
+	}
 
 	for i := 1; i <= 10; i++ {
 
@@ -208,10 +477,16 @@ func (doc *JobDocument) AddAttachment(attachmentName, filepath string) (err erro
 			return err
 		}
 
-		endpointUrlStr = fmt.Sprintf("%v?rev=%v", endpointUrlStr, doc.Revision)
-		log.Printf("endpointUrlStr: %v", endpointUrlStr)
+		revEndpointUrlStr := fmt.Sprintf("%v?rev=%v", endpointUrlStr, doc.Revision)
+		log.Printf("endpointUrlStr: %v", revEndpointUrlStr)
 
-		req, err := http.NewRequest("PUT", endpointUrlStr, reader)
+		// rewind in case a previous attempt consumed the file
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		reader := bufio.NewReader(f)
+
+		req, err := http.NewRequest("PUT", revEndpointUrlStr, reader)
 		if err != nil {
 			return err
 		}
@@ -230,6 +505,10 @@ func (doc *JobDocument) AddAttachment(attachmentName, filepath string) (err erro
 			continue
 		}
 
+		if resp.StatusCode == http.StatusRequestEntityTooLarge {
+			return newErrPayloadTooLarge(endpointUrlStr, fileInfo.Size())
+		}
+
 		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 			return fmt.Errorf("Unable to upload attachment: %v from %v. Unexpected status code in response: %v", attachmentName, filepath, resp.StatusCode)
 		}
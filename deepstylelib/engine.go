@@ -0,0 +1,182 @@
+package deepstylelib
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// An Engine applies the style of one image to another.  Engines are tried
+// in order and the first available one is used, see SelectEngine().  Run
+// should give up as soon as possible when ctx is cancelled.
+type Engine interface {
+	Name() string
+	Available() bool
+	Run(ctx context.Context, params EngineParams, output io.Writer) error
+}
+
+type EngineParams struct {
+	SourceImagePath string
+	StyleImagePath  string
+	OutputImagePath string
+}
+
+var engines = defaultEngines()
+
+func defaultEngines() []Engine {
+	engines := []Engine{}
+	if runtime.GOOS == "linux" && runtime.GOARCH == "arm64" {
+		// Jetson-class devices don't have nvidia-smi and share
+		// memory between the CPU and GPU.
+		engines = append(engines, NewJetsonEngine())
+	}
+	engines = append(engines, NewNeuralStyleEngine())
+	engines = append(engines, fakeEngine{})
+	return engines
+}
+
+// Register an engine, which takes priority over previously registered ones
+func RegisterEngine(engine Engine) {
+	engines = append([]Engine{engine}, engines...)
+}
+
+func SelectEngine() Engine {
+	for _, engine := range engines {
+		if engine.Available() {
+			return engine
+		}
+	}
+	return fakeEngine{}
+}
+
+// Wraps jcjohnson/neural-style, which needs torch to be installed
+type neuralStyleEngine struct {
+	name      string
+	dir       string      // Where neural-style is checked out
+	hasGPU    func() bool // Whether to run on GPU 0 or on the CPU
+	needsGPU  bool        // Not worth running on the CPU
+	extraArgs []string
+}
+
+func NewNeuralStyleEngine() Engine {
+	return neuralStyleEngine{
+		name:   "neural-style",
+		dir:    neuralStyleDir(),
+		hasGPU: hasGPU,
+	}
+}
+
+// neural-style tuned for the shared memory on Jetson devices: adam uses
+// a lot less memory than lbfgs, and the smaller image size fits in the
+// memory left after the OS.
+func NewJetsonEngine() Engine {
+	return neuralStyleEngine{
+		name:     "neural-style-jetson",
+		dir:      neuralStyleDir(),
+		hasGPU:   hasTegraGPU,
+		needsGPU: true,
+		extraArgs: []string{
+			"-optimizer", "adam",
+			"-image_size", "256",
+			"-backend", "nn",
+		},
+	}
+}
+
+func neuralStyleDir() string {
+	if dir := os.Getenv("NEURAL_STYLE_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(homeDir(), "neural-style")
+}
+
+func (e neuralStyleEngine) Name() string {
+	return e.name
+}
+
+func (e neuralStyleEngine) Available() bool {
+	if e.needsGPU && !e.hasGPU() {
+		return false
+	}
+	return torchInstalled()
+}
+
+func (e neuralStyleEngine) Run(ctx context.Context, params EngineParams, output io.Writer) error {
+
+	cmd := e.command(ctx, params)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	log.Printf("Invoking %v in %v", e.name, cmd.Dir)
+	return runProcessGroup(cmd)
+
+}
+
+func (e neuralStyleEngine) command(ctx context.Context, params EngineParams) *exec.Cmd {
+
+	gpuId := "-1"
+	if e.hasGPU() {
+		gpuId = "0"
+	}
+
+	args := []string{
+		"neural_style.lua",
+		"-gpu",
+		gpuId,
+		"-style_image",
+		params.StyleImagePath,
+		"-content_image",
+		params.SourceImagePath,
+		"-output_image",
+		params.OutputImagePath,
+	}
+	args = append(args, e.extraArgs...)
+
+	// the process (and its children, see runProcessGroup) is killed if
+	// ctx is cancelled
+	cmd := exec.CommandContext(ctx, "th", args...)
+	cmd.Dir = e.dir
+	return cmd
+
+}
+
+// Used when no real engine is available, just re-encodes the source image
+// as a JPEG (like the real engines write) to the output.
+type fakeEngine struct{}
+
+// The engine used when no real one is available, eg to test code built on
+// deepstylelib without torch.
+func NewFakeEngine() Engine {
+	return fakeEngine{}
+}
+
+func (e fakeEngine) Name() string {
+	return "fake"
+}
+
+func (e fakeEngine) Available() bool {
+	return true
+}
+
+func (e fakeEngine) Run(ctx context.Context, params EngineParams, output io.Writer) error {
+	photo, err := os.Open(params.SourceImagePath)
+	if err != nil {
+		return err
+	}
+	defer photo.Close()
+	img, _, err := image.Decode(photo)
+	if err != nil {
+		return fmt.Errorf("Error decoding %v: %v", params.SourceImagePath, err)
+	}
+	if err := writeJpeg(params.OutputImagePath, img); err != nil {
+		return err
+	}
+	_, err = io.WriteString(output, "Torch not installed, just created a fake output file")
+	return err
+}
@@ -0,0 +1,319 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/tleyden/go-couch"
+)
+
+/*
+Sync Gateway rejects attachments over its limit with a 413, which comes back
+as an ErrPayloadTooLarge.  With an external store configured (--external-store
+on any command), attachments that are too large are put there instead, and
+the job's external_attachments field maps the attachment name to where it
+went.  RetrieveAttachment and the API read them from the store transparently:
+
+    --external-store s3://my-bucket/deepstyle/attachments?region=us-west-2
+    --external-store file:///mnt/shared/attachments
+*/
+
+// Couchbase Server's max document size, which is also Sync Gateway's
+// attachment limit.  Larger attachments aren't even attempted.
+var MaxAttachmentSize int64 = 20 * 1024 * 1024
+
+// A request rejected by the server (HTTP 413) for being too large
+type ErrPayloadTooLarge struct {
+	Url   string
+	Size  int64 // Of the request body, in bytes
+	Limit int64 // The server's limit, 0 if unknown (eg a proxy's)
+}
+
+func (e ErrPayloadTooLarge) Error() string {
+	if e.Limit == 0 {
+		return fmt.Sprintf("%v: %v bytes is too large for the server (or a proxy in front of it)", e.Url, e.Size)
+	}
+	return fmt.Sprintf("%v: %v bytes is over the server's limit of %v bytes", e.Url, e.Size, e.Limit)
+}
+
+// The error for a 413 response to a request with a body of size bytes
+func newErrPayloadTooLarge(rawUrl string, size int64) ErrPayloadTooLarge {
+	err := ErrPayloadTooLarge{
+		Url:  redactUrl(rawUrl),
+		Size: size,
+	}
+	// when it's under the known limit, something else rejected it
+	if size > MaxAttachmentSize {
+		err.Limit = MaxAttachmentSize
+	}
+	return err
+}
+
+// Whether err is an ErrPayloadTooLarge.  Attachments are uploaded with
+// addSyncGatewayAttachment, admin requests made with adminRequest and job
+// (and job log) docs written with the *Doc helpers below, which all return
+// one for a 413.
+func IsPayloadTooLarge(err error) bool {
+	_, ok := err.(ErrPayloadTooLarge)
+	return ok
+}
+
+// go-couch returns a plain HttpError when a doc is rejected for being too
+// large, eg std_out_and_err or the history has grown past the max document
+// size, so turn that into an ErrPayloadTooLarge.
+func docWriteError(db couch.Database, doc interface{}, err error) error {
+	httpErr, ok := err.(*couch.HttpError)
+	if !ok || httpErr.Status != http.StatusRequestEntityTooLarge {
+		return err
+	}
+	data, _ := json.Marshal(doc)
+	return newErrPayloadTooLarge(db.DBURL(), int64(len(data)))
+}
+
+func insertDoc(db couch.Database, doc interface{}) (id, rev string, err error) {
+	id, rev, err = db.Insert(doc)
+	return id, rev, docWriteError(db, doc, err)
+}
+
+func insertDocWith(db couch.Database, doc interface{}, docId string) (id, rev string, err error) {
+	id, rev, err = db.InsertWith(doc, docId)
+	return id, rev, docWriteError(db, doc, err)
+}
+
+func editDoc(db couch.Database, doc interface{}) (rev string, err error) {
+	rev, err = db.Edit(doc)
+	return rev, docWriteError(db, doc, err)
+}
+
+func editDocRetry(db couch.Database, doc interface{}, updater func(), done func() bool, refresh func() error) (updated bool, err error) {
+	updated, err = db.EditRetry(doc, updater, done, refresh)
+	return updated, docWriteError(db, doc, err)
+}
+
+// Credentials in urls shouldn't end up in error messages and job docs
+func redactUrl(rawUrl string) string {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil || parsedUrl.User == nil {
+		return rawUrl
+	}
+	parsedUrl.User = nil
+	return parsedUrl.String()
+}
+
+type ExternalStore interface {
+	// Store the file, returning its location (a url the store understands)
+	Put(jobDoc JobDocument, attachmentName, filePath string) (location string, err error)
+	Get(location string) (io.ReadCloser, error)
+}
+
+var (
+	externalStore      ExternalStore
+	externalStoreMutex sync.RWMutex
+)
+
+// Put attachments that are too large for Sync Gateway in store, nil to turn it off
+func SetExternalStore(store ExternalStore) {
+	externalStoreMutex.Lock()
+	defer externalStoreMutex.Unlock()
+	externalStore = store
+}
+
+func getExternalStore() ExternalStore {
+	externalStoreMutex.RLock()
+	defer externalStoreMutex.RUnlock()
+	return externalStore
+}
+
+func NewExternalStore(storeUrl string) (ExternalStore, error) {
+
+	parsedUrl, err := url.Parse(storeUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsedUrl.Scheme {
+	case "s3":
+		region := parsedUrl.Query().Get("region")
+		if region == "" {
+			region = "us-east-1"
+		}
+		return s3ExternalStore{
+			bucket: parsedUrl.Host,
+			prefix: strings.TrimPrefix(parsedUrl.Path, "/"),
+			region: region,
+		}, nil
+	case "file":
+		return localDirExternalStore{
+			dir: filepath.FromSlash(parsedUrl.Path),
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported external store: %v.  Expected s3:// or file://", storeUrl)
+	}
+
+}
+
+// Where the attachment goes in a store, named like the files result sinks
+// deliver (see AttachmentFilename)
+func externalStoreFilename(jobDoc JobDocument, attachmentName, filePath string) string {
+	extension := strings.TrimPrefix(filepath.Ext(filePath), ".")
+	if extension == "" {
+		extension = "jpg"
+	}
+	return AttachmentFilename(jobDoc, attachmentName, extension)
+}
+
+// AWS keys will be taken from environment variables or ~/.aws/.  Locations
+// are s3://bucket/key.
+type s3ExternalStore struct {
+	bucket string
+	prefix string
+	region string
+}
+
+func (s s3ExternalStore) Put(jobDoc JobDocument, attachmentName, filePath string) (location string, err error) {
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	key := path.Join(s.prefix, externalStoreFilename(jobDoc, attachmentName, filePath))
+	uploader := s3manager.NewUploader(session.New(&aws.Config{Region: aws.String(s.region)}))
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   f,
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("s3://%v/%v", s.bucket, key), nil
+
+}
+
+func (s s3ExternalStore) Get(location string) (io.ReadCloser, error) {
+
+	parsedUrl, err := url.Parse(location)
+	if err != nil || parsedUrl.Scheme != "s3" || parsedUrl.Host != s.bucket {
+		return nil, fmt.Errorf("%v isn't in the external store s3://%v", location, s.bucket)
+	}
+
+	client := s3.New(session.New(&aws.Config{Region: aws.String(s.region)}))
+	output, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(strings.TrimPrefix(parsedUrl.Path, "/")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+
+}
+
+// A directory shared by the workers and API servers, eg over NFS.  Locations
+// are file:///path.
+type localDirExternalStore struct {
+	dir string
+}
+
+func (s localDirExternalStore) Put(jobDoc JobDocument, attachmentName, filePath string) (location string, err error) {
+	destPath := filepath.Join(s.dir, filepath.FromSlash(externalStoreFilename(jobDoc, attachmentName, filePath)))
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return "", err
+	}
+	if err := cp(destPath, filePath); err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(destPath)}).String(), nil
+}
+
+func (s localDirExternalStore) Get(location string) (io.ReadCloser, error) {
+	parsedUrl, err := url.Parse(location)
+	if err != nil || parsedUrl.Scheme != "file" {
+		return nil, fmt.Errorf("%v isn't in the external store %v", location, s.dir)
+	}
+	filePath := filepath.FromSlash(parsedUrl.Path)
+	if rel, err := filepath.Rel(s.dir, filePath); err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("%v isn't in the external store %v", location, s.dir)
+	}
+	return os.Open(filePath)
+}
+
+// Put the attachment in the external store and record where it went in the
+// job doc.  Used when it's too large for Sync Gateway.
+func (doc *JobDocument) addExternalAttachment(store ExternalStore, attachmentName, filePath string) error {
+
+	location, err := store.Put(*doc, attachmentName, filePath)
+	if err != nil {
+		return fmt.Errorf("Error putting %v in the external store: %v", attachmentName, err)
+	}
+	log.Printf("Attachment %v of job %v is too large for Sync Gateway, put it in %v", attachmentName, doc.Id, location)
+
+	db := doc.config.Database
+
+	retryUpdater := func() {
+		if doc.ExternalAttachments == nil {
+			doc.ExternalAttachments = map[string]string{}
+		}
+		doc.ExternalAttachments[attachmentName] = location
+	}
+
+	retryDoneMetric := func() bool {
+		return doc.ExternalAttachments[attachmentName] == location
+	}
+
+	retryRefresh := func() error {
+		return doc.RefreshFromDB()
+	}
+
+	_, err = editDocRetry(
+		db,
+		doc,
+		retryUpdater,
+		retryDoneMetric,
+		retryRefresh,
+	)
+	return err
+
+}
+
+// Read an attachment from the external store, if it's in there
+func (doc JobDocument) retrieveExternalAttachment(attachmentName string) (reader io.Reader, ok bool, err error) {
+
+	location, ok := doc.ExternalAttachments[attachmentName]
+	if !ok {
+		return nil, false, nil
+	}
+	store := getExternalStore()
+	if store == nil {
+		return nil, true, fmt.Errorf("Attachment %v is in %v, but there's no external store configured", attachmentName, location)
+	}
+
+	body, err := store.Get(location)
+	if err != nil {
+		return nil, true, err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, true, err
+	}
+	return bytes.NewReader(data), true, nil
+
+}
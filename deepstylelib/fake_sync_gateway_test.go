@@ -0,0 +1,200 @@
+package deepstylelib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tleyden/go-couch"
+)
+
+// Just enough of Sync Gateway's REST API for tests: documents with
+// revisions (and conflicts), attachments, and whatever other paths (eg
+// views) the test registers handlers for.
+type fakeSyncGateway struct {
+	*httptest.Server
+	mutex       sync.Mutex
+	docs        map[string]map[string]interface{}
+	attachments map[string][]byte           // by doc id/attachment name
+	handlers    map[string]http.HandlerFunc // by method and path, eg "GET /_design/foo/_view/bar"
+	nextId      int
+}
+
+func newFakeSyncGateway(t *testing.T) *fakeSyncGateway {
+	s := &fakeSyncGateway{
+		docs:        map[string]map[string]interface{}{},
+		attachments: map[string][]byte{},
+		handlers:    map[string]http.HandlerFunc{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// The database url
+func (s *fakeSyncGateway) DBURL() string {
+	return s.URL + "/deepstyle"
+}
+
+func (s *fakeSyncGateway) database(t *testing.T) couch.Database {
+	db, err := GetDbConnection(s.DBURL())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return db
+}
+
+// Handle method and path (relative to the database) with handler
+func (s *fakeSyncGateway) handle(method, path string, handler http.HandlerFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handlers[method+" "+path] = handler
+}
+
+// Store doc (encoded as the library would) under id, returning its revision
+func (s *fakeSyncGateway) put(t *testing.T, id string, doc interface{}) string {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("%v", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store(id, fields)
+}
+
+// Decode the stored doc with id into doc, returning whether there is one
+func (s *fakeSyncGateway) get(t *testing.T, id string, doc interface{}) bool {
+	s.mutex.Lock()
+	fields, ok := s.docs[id]
+	s.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	data, _ := json.Marshal(fields)
+	if err := json.Unmarshal(data, doc); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return true
+}
+
+// Delete the doc with id, as if someone else had
+func (s *fakeSyncGateway) remove(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.docs, id)
+}
+
+func (s *fakeSyncGateway) store(id string, fields map[string]interface{}) string {
+	generation := 0
+	if existing, ok := s.docs[id]; ok {
+		fmt.Sscanf(fmt.Sprint(existing["_rev"]), "%d-", &generation)
+	}
+	rev := fmt.Sprintf("%d-fake", generation+1)
+	fields["_id"] = id
+	fields["_rev"] = rev
+	s.docs[id] = fields
+	return rev
+}
+
+func (s *fakeSyncGateway) serveHTTP(w http.ResponseWriter, r *http.Request) {
+
+	path := strings.TrimPrefix(r.URL.Path, "/deepstyle")
+	path = strings.TrimPrefix(path, "/")
+
+	s.mutex.Lock()
+	handler, ok := s.handlers[r.Method+" /"+path]
+	s.mutex.Unlock()
+	if ok {
+		handler(w, r)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	docId, attachment := path, ""
+	if !strings.HasPrefix(path, "_design/") {
+		if i := strings.Index(path, "/"); i >= 0 {
+			docId, attachment = path[:i], path[i+1:]
+		}
+	}
+	existing, exists := s.docs[docId]
+
+	writeError := func(status int, reason string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": http.StatusText(status), "reason": reason})
+	}
+	writeOk := func(id, rev string) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "id": id, "rev": rev})
+	}
+	checkRev := func(rev string) bool {
+		if exists && rev != existing["_rev"] {
+			writeError(409, "Document revision conflict")
+			return false
+		}
+		return true
+	}
+
+	switch {
+	case attachment != "" && r.Method == "GET":
+		data, ok := s.attachments[path]
+		if !ok {
+			writeError(404, "missing")
+			return
+		}
+		w.Write(data)
+	case attachment != "" && r.Method == "PUT":
+		if !exists {
+			writeError(404, "missing")
+			return
+		}
+		if !checkRev(r.URL.Query().Get("rev")) {
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		s.attachments[path] = data
+		writeOk(docId, s.store(docId, existing))
+	case path == "" && r.Method == "POST":
+		fields := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&fields)
+		s.nextId++
+		docId = fmt.Sprintf("doc%d", s.nextId)
+		writeOk(docId, s.store(docId, fields))
+	case r.Method == "GET":
+		if !exists {
+			writeError(404, "missing")
+			return
+		}
+		json.NewEncoder(w).Encode(existing)
+	case r.Method == "PUT":
+		fields := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&fields)
+		rev, _ := fields["_rev"].(string)
+		if !checkRev(rev) {
+			return
+		}
+		writeOk(docId, s.store(docId, fields))
+	case r.Method == "DELETE":
+		if !exists {
+			writeError(404, "missing")
+			return
+		}
+		if !checkRev(r.URL.Query().Get("rev")) {
+			return
+		}
+		delete(s.docs, docId)
+		writeOk(docId, "")
+	default:
+		writeError(405, "unsupported")
+	}
+
+}
@@ -0,0 +1,70 @@
+package deepstylelib
+
+import (
+	"container/list"
+	"sync"
+)
+
+// An LRU cache of encoded images, bounded by the total size of the images.
+type imageCache struct {
+	maxBytes int64
+	numBytes int64
+	mutex    sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List // Most recently used at the front
+}
+
+type imageCacheEntry struct {
+	key         string
+	contentType string
+	data        []byte
+}
+
+func newImageCache(maxBytes int64) *imageCache {
+	return &imageCache{
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+func (c *imageCache) Get(key string) (contentType string, data []byte, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return "", nil, false
+	}
+	c.lru.MoveToFront(element)
+	entry := element.Value.(imageCacheEntry)
+	return entry.contentType, entry.data, true
+}
+
+func (c *imageCache) Add(key, contentType string, data []byte) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if int64(len(data)) > c.maxBytes {
+		return
+	}
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(imageCacheEntry{
+		key:         key,
+		contentType: contentType,
+		data:        data,
+	})
+	c.numBytes += int64(len(data))
+
+	for c.numBytes > c.maxBytes {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(imageCacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.numBytes -= int64(len(entry.data))
+	}
+
+}
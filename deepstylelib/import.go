@@ -0,0 +1,252 @@
+package deepstylelib
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/tleyden/go-couch"
+)
+
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+}
+
+type ImportOptions struct {
+	Dir            string // Directory to walk for photos
+	StyleImagePath string
+	StyleName      string
+	Owner          string
+	Concurrency    int    // Max number of jobs being created at once
+	CheckpointPath string // Photos already imported, one path per line
+	Priority       string // Of the created jobs, eg PriorityBatch
+}
+
+type ImportReport struct {
+	Created  int
+	Skipped  int // Already imported according to the checkpoint file
+	Failed   int
+	Failures map[string]error // Keyed by photo path
+}
+
+// Figure out the style image for a --style value, which is either a path to
+// an image or the name of an image in stylesDir (eg, starry_night).
+func ResolveStyleImage(style, stylesDir string) (styleImagePath, styleName string, err error) {
+
+	styleName = strings.TrimSuffix(filepath.Base(style), filepath.Ext(style))
+
+	if _, err := os.Stat(style); err == nil {
+		return style, styleName, nil
+	}
+
+	for extension := range imageExtensions {
+		candidate := filepath.Join(stylesDir, style+extension)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, styleName, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("No style image found for %v, tried it as a path and in %v", style, stylesDir)
+
+}
+
+// Keeps track of which photos have been imported so that an interrupted
+// import can be resumed.
+type importCheckpoint struct {
+	mutex    sync.Mutex
+	imported map[string]bool
+	file     *os.File
+}
+
+func openImportCheckpoint(checkpointPath string) (*importCheckpoint, error) {
+
+	checkpoint := &importCheckpoint{
+		imported: map[string]bool{},
+	}
+
+	if existing, err := os.Open(checkpointPath); err == nil {
+		scanner := bufio.NewScanner(existing)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				checkpoint.imported[line] = true
+			}
+		}
+		existing.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(checkpointPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint.file = file
+
+	return checkpoint, nil
+
+}
+
+func (c *importCheckpoint) isImported(photoPath string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.imported[photoPath]
+}
+
+func (c *importCheckpoint) markImported(photoPath string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.imported[photoPath] = true
+	if _, err := fmt.Fprintln(c.file, photoPath); err != nil {
+		return err
+	}
+	return c.file.Sync()
+}
+
+func (c *importCheckpoint) Close() error {
+	return c.file.Close()
+}
+
+func findPhotos(dir string) ([]string, error) {
+	photoPaths := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if imageExtensions[strings.ToLower(filepath.Ext(path))] {
+			photoPaths = append(photoPaths, path)
+		}
+		return nil
+	})
+	return photoPaths, err
+}
+
+// Create a job for every photo in a directory
+func ImportImages(db couch.Database, options ImportOptions) (ImportReport, error) {
+
+	report := ImportReport{
+		Failures: map[string]error{},
+	}
+
+	photoPaths, err := findPhotos(options.Dir)
+	if err != nil {
+		return report, err
+	}
+	log.Printf("Found %v photos in %v", len(photoPaths), options.Dir)
+
+	checkpoint, err := openImportCheckpoint(options.CheckpointPath)
+	if err != nil {
+		return report, fmt.Errorf("Error opening checkpoint file %v: %v", options.CheckpointPath, err)
+	}
+	defer checkpoint.Close()
+
+	importFunc := func(photoPath string) error {
+		return importImage(db, options, photoPath)
+	}
+	return runImport(photoPaths, checkpoint, options.Concurrency, importFunc), nil
+
+}
+
+// Call importFunc for each photo that isn't in the checkpoint yet, marking it
+// imported on success.
+func runImport(photoPaths []string, checkpoint *importCheckpoint, concurrency int, importFunc func(photoPath string) error) ImportReport {
+
+	report := ImportReport{
+		Failures: map[string]error{},
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mutex sync.Mutex // protects report
+	var waitGroup sync.WaitGroup
+	photoPathsChan := make(chan string)
+
+	for i := 0; i < concurrency; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for photoPath := range photoPathsChan {
+				err := importFunc(photoPath)
+				if err == nil {
+					err = checkpoint.markImported(photoPath)
+				}
+				mutex.Lock()
+				if err != nil {
+					log.Printf("Error importing %v: %v", photoPath, err)
+					report.Failed += 1
+					report.Failures[photoPath] = err
+				} else {
+					report.Created += 1
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, photoPath := range photoPaths {
+		if checkpoint.isImported(photoPath) {
+			report.Skipped += 1
+			continue
+		}
+		photoPathsChan <- photoPath
+	}
+	close(photoPathsChan)
+	waitGroup.Wait()
+
+	return report
+
+}
+
+func importImage(db couch.Database, options ImportOptions, photoPath string) error {
+
+	jobDoc := JobDocument{
+		Owner:     options.Owner,
+		StyleName: options.StyleName,
+		Priority:  options.Priority,
+	}
+
+	createdJobDoc, err := CreateJob(db, jobDoc, photoPath, options.StyleImagePath)
+	if err != nil {
+		if createdJobDoc == nil {
+			return err
+		}
+		// otherwise it's left NOT_READY forever, and since the photo isn't
+		// checkpointed a rerun would create another one
+		created, deleteErr := deletePartialJob(db, createdJobDoc.Id)
+		if deleteErr != nil {
+			log.Printf("Error deleting partially created job %v: %v", createdJobDoc.Id, deleteErr)
+		}
+		if !created {
+			return err
+		}
+		log.Printf("Job %v became ready despite %v", createdJobDoc.Id, err)
+	}
+	log.Printf("Created job %v for %v", createdJobDoc.Id, photoPath)
+	return nil
+
+}
+
+// Delete a job that CreateJob failed part way through, unless it's no longer
+// NOT_READY, eg setting READY_TO_PROCESS saved but the response was lost.  A
+// worker may already be running it, so it counts as created.
+func deletePartialJob(db couch.Database, jobId string) (created bool, err error) {
+	jobDoc := JobDocument{}
+	if err := db.Retrieve(jobId, &jobDoc); err != nil {
+		return false, err
+	}
+	if jobDoc.State != StateNotReadyToProcess {
+		return true, nil
+	}
+	return false, db.Delete(jobId, jobDoc.Revision)
+}
@@ -0,0 +1,89 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportCheckpoint(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "deepstyle-import-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	checkpointPath := filepath.Join(dir, "checkpoint")
+
+	checkpoint, err := openImportCheckpoint(checkpointPath)
+	assert.NoError(t, err)
+	assert.False(t, checkpoint.isImported("a.jpg"))
+	assert.NoError(t, checkpoint.markImported("a.jpg"))
+	assert.NoError(t, checkpoint.markImported("b.jpg"))
+	assert.True(t, checkpoint.isImported("a.jpg"))
+	assert.NoError(t, checkpoint.Close())
+
+	// picked up again on reopening, and appended to
+	checkpoint, err = openImportCheckpoint(checkpointPath)
+	assert.NoError(t, err)
+	assert.True(t, checkpoint.isImported("a.jpg"))
+	assert.True(t, checkpoint.isImported("b.jpg"))
+	assert.False(t, checkpoint.isImported("c.jpg"))
+	assert.NoError(t, checkpoint.markImported("c.jpg"))
+	assert.NoError(t, checkpoint.Close())
+
+	contents, err := ioutil.ReadFile(checkpointPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "a.jpg\nb.jpg\nc.jpg\n", string(contents))
+
+}
+
+func TestRunImport(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "deepstyle-import-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	checkpointPath := filepath.Join(dir, "checkpoint")
+
+	photoPaths := []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"}
+
+	var mutex sync.Mutex
+	imported := map[string]int{}
+	failing := map[string]bool{"c.jpg": true}
+	importFunc := func(photoPath string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failing[photoPath] {
+			return fmt.Errorf("Error uploading %v", photoPath)
+		}
+		imported[photoPath] += 1
+		return nil
+	}
+
+	checkpoint, err := openImportCheckpoint(checkpointPath)
+	assert.NoError(t, err)
+	report := runImport(photoPaths, checkpoint, 2, importFunc)
+	assert.NoError(t, checkpoint.Close())
+	assert.Equal(t, 3, report.Created)
+	assert.Equal(t, 0, report.Skipped)
+	assert.Equal(t, 1, report.Failed)
+	assert.Error(t, report.Failures["c.jpg"])
+
+	// a rerun only retries the failed photo
+	delete(failing, "c.jpg")
+	checkpoint, err = openImportCheckpoint(checkpointPath)
+	assert.NoError(t, err)
+	report = runImport(photoPaths, checkpoint, 2, importFunc)
+	assert.NoError(t, checkpoint.Close())
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, 3, report.Skipped)
+	assert.Equal(t, 0, report.Failed)
+
+	for _, photoPath := range photoPaths {
+		assert.Equal(t, 1, imported[photoPath], "Imported %v", photoPath)
+	}
+
+}
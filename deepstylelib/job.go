@@ -1,10 +1,11 @@
 package deepstylelib
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os/exec"
-	"path"
+	"path/filepath"
+	"time"
 
 	"github.com/tleyden/go-couch"
 )
@@ -16,9 +17,23 @@ const (
 )
 
 type configuration struct {
-	Database     couch.Database
-	TempDir      string // Where to store attachments and output
-	UnitTestMode bool   // Are we in "Unit Test Mode"?
+	Database           couch.Database
+	TempDir            string          // Where to store attachments and output
+	UnitTestMode       bool            // Are we in "Unit Test Mode"?
+	Engine             Engine          // Defaults to SelectEngine()
+	ResultSinks        ResultSinks     // Where to deliver results besides the attachment
+	HangTimeout        time.Duration   // Kill the engine after this long without output
+	WorkerId           string          // Identifies this worker in hung_on_workers
+	ResultVariants     []string        // Variants for jobs that don't ask for any
+	MaxPhotoMegapixels int             // Reject larger photos, 0 for no limit
+	Context            context.Context // Cancelled when the worker shuts down, defaults to context.Background()
+}
+
+func (c configuration) context() context.Context {
+	if c.Context == nil {
+		return context.Background()
+	}
+	return c.Context
 }
 
 type DeepStyleJob struct {
@@ -45,17 +60,21 @@ func (d DeepStyleJob) Execute() (err error, outputFilePath, stdOutAndErr string)
 		return err, "", ""
 	}
 
+	if err := checkPhotoSize(sourceImagePath, d.config.MaxPhotoMegapixels); err != nil {
+		return err, "", ""
+	}
+
 	outputFilename := fmt.Sprintf(
 		"%v_%v.jpg",
 		d.jobDoc.Id,
 		ResultImageAttachment,
 	)
-	outputFilePath = path.Join(
+	outputFilePath = filepath.Join(
 		d.config.TempDir,
 		outputFilename,
 	)
 
-	stdOutAndErrByteSlice, err := d.executeNeuralStyle(
+	stdOutAndErrByteSlice, err := d.executeEngine(
 		sourceImagePath,
 		styleImagePath,
 		outputFilePath,
@@ -65,54 +84,25 @@ func (d DeepStyleJob) Execute() (err error, outputFilePath, stdOutAndErr string)
 
 }
 
-func (d DeepStyleJob) executeNeuralStyle(sourceImagePath, styleImagePath, outputFilePath string) (stdOutAndErr []byte, err error) {
-
-	torchInstalled := torchInstalled()
-
-	if torchInstalled {
-		useGpu := hasGPU()
-		cmd := d.generateNeuralStyleCommand(
-			sourceImagePath,
-			styleImagePath,
-			outputFilePath,
-			useGpu,
-		)
-		// set the current working directory to ~/neural_style
-		cmd.Dir = "/home/ubuntu/neural-style"
+func (d DeepStyleJob) executeEngine(sourceImagePath, styleImagePath, outputFilePath string) (stdOutAndErr []byte, err error) {
 
-		// Execute the command and get the output
-		log.Printf("Invoking neural-style")
-		return cmd.CombinedOutput()
-
-	} else {
-		useGpu := hasGPU()
-		log.Printf("useGpu: %v", useGpu)
-		// copy the sourceImagePath to the outputFilePath
-		cp(outputFilePath, sourceImagePath)
-		return []byte("Torch not installed, just created a fake output file"), nil
+	engine := d.config.Engine
+	if engine == nil {
+		engine = SelectEngine()
 	}
+	log.Printf("Using engine: %v", engine.Name())
 
-}
-
-func (d DeepStyleJob) generateNeuralStyleCommand(sourceImagePath, styleImagePath, outputFilePath string, useGpu bool) (cmd *exec.Cmd) {
-
-	gpuId := "-1"
-	if useGpu {
-		gpuId = "0"
+	params := EngineParams{
+		SourceImagePath: sourceImagePath,
+		StyleImagePath:  styleImagePath,
+		OutputImagePath: outputFilePath,
 	}
 
-	return exec.Command(
-		"th",
-		"neural_style.lua",
-		"-gpu",
-		gpuId,
-		"-style_image",
-		styleImagePath,
-		"-content_image",
-		sourceImagePath,
-		"-output_image",
-		outputFilePath,
-	)
+	// stream the output to the job log while the engine runs
+	output := newJobLogWriter(&d.jobDoc)
+	err = runWithWatchdog(d.config.context(), engine, params, output, d.config.HangTimeout)
+	output.Close()
+	return output.Output(), err
 
 }
 
@@ -125,7 +115,8 @@ func (d DeepStyleJob) DownloadAttachments() (err error, sourceImagePath, styleIm
 
 		attachmentReader, err := d.jobDoc.RetrieveAttachment(attachmentName)
 		if err != nil {
-			return fmt.Errorf("Error retrieving attachment: %v", err), "", ""
+			err = fmt.Errorf("Error retrieving attachment: %v", err)
+			return NewJobError(ErrorCodeMissingImage, nil, err), "", ""
 		}
 
 		filename := fmt.Sprintf(
@@ -133,7 +124,7 @@ func (d DeepStyleJob) DownloadAttachments() (err error, sourceImagePath, styleIm
 			d.jobDoc.Id,
 			attachmentName,
 		)
-		attachmentFilepath := path.Join(
+		attachmentFilepath := filepath.Join(
 			d.config.TempDir,
 			filename,
 		)
@@ -157,27 +148,63 @@ func executeDeepStyleJob(config configuration, jobDoc JobDocument) error {
 	deepStyleJob := NewDeepStyleJob(jobDoc, config)
 	err, outputFilePath, stdOutAndErr := deepStyleJob.Execute()
 
+	// Was the worker shut down?  Leave the job for another one.
+	if shutdownErr := config.context().Err(); shutdownErr != nil {
+		log.Printf("Worker shutting down, putting job %v back in the queue", jobDoc.Id)
+		if _, errState := jobDoc.UpdateState(StateReadyToProcess); errState != nil {
+			log.Printf("Unable to put job %v back in the queue: %v", jobDoc.Id, errState)
+		}
+		return fmt.Errorf("Job %v interrupted by shutdown: %v", jobDoc.Id, shutdownErr)
+	}
+
+	// Did the engine hang?  Give another worker a chance at it.
+	if isEngineHung(err) {
+		log.Printf("Job %v hung: %v", jobDoc.Id, err)
+		if _, errHung := jobDoc.MarkHung(config.WorkerId, err, stdOutAndErr); errHung != nil {
+			log.Printf("Unable to record hang for job %v: %v", jobDoc.Id, errHung)
+		}
+		return err
+	}
+
 	// Did the job fail?
 	if err != nil {
 		// Record failure
 		log.Printf("Job failed with error: %v", err)
-		jobDoc.UpdateState(StateProcessingFailed)
-		jobDoc.SetErrorMessage(err)
-		jobDoc.SetStdOutAndErr(stdOutAndErr)
+		jobDoc.SetFailed(err, stdOutAndErr)
 		return err
 	}
 
 	// Try to attach the result image, otherwise consider it a failure
 	if err := jobDoc.AddAttachment(ResultImageAttachment, outputFilePath); err != nil {
-		jobDoc.UpdateState(StateProcessingFailed)
 		log.Printf("Set err message to: %v", err)
-		updated, errSet := jobDoc.SetErrorMessage(err)
-		log.Printf("setErrorMessage updated: %v errSet: %v", updated, errSet)
-		updated, errSet = jobDoc.SetStdOutAndErr(stdOutAndErr)
-		log.Printf("SetStdOutAndErr updated: %v errSet: %v", updated, errSet)
+		updated, errSet := jobDoc.SetFailed(err, stdOutAndErr)
+		log.Printf("SetFailed updated: %v errSet: %v", updated, errSet)
 		return err
 	}
 
+	// Record the hash of the result for content addressed urls
+	resultHash, err := sha256File(outputFilePath)
+	if err == nil {
+		_, err = jobDoc.SetResultHash(resultHash)
+	}
+	if err != nil {
+		log.Printf("Error setting result hash for job %v: %v", jobDoc.Id, err)
+	}
+
+	// Attach resized variants, if any were asked for.  The full size result
+	// is already attached, so the job still succeeds if this fails.
+	if variants := resultVariantsForJob(jobDoc, config.ResultVariants); len(variants) > 0 {
+		if err := deepStyleJob.attachResultVariants(&jobDoc, outputFilePath, variants); err != nil {
+			log.Printf("Error attaching result variants for job %v: %v", jobDoc.Id, err)
+		}
+	}
+
+	// Deliver to any external destinations.  The result is already attached,
+	// so the job is still considered successful if this fails.
+	if err := config.ResultSinks.Deliver(jobDoc, outputFilePath); err != nil {
+		log.Printf("Job %v: %v", jobDoc.Id, err)
+	}
+
 	// Record successful result in job
 	jobDoc.SetStdOutAndErr(stdOutAndErr)
 	jobDoc.UpdateState(StateProcessingSuccessful)
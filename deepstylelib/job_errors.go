@@ -0,0 +1,99 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Failed jobs have an error_code (and error_params) saying what went wrong in
+terms the app can show to users, see UserErrorMessage.  The error_message and
+std_out_and_err fields keep the internal details for debugging.
+*/
+const (
+	ErrorCodePhotoTooLarge    = "PHOTO_TOO_LARGE"   // params: max_megapixels
+	ErrorCodeUnsupportedImage = "UNSUPPORTED_IMAGE" // the engine couldn't read an image
+	ErrorCodeMissingImage     = "MISSING_IMAGE"     // the photo or style image wasn't uploaded
+	ErrorCodeOutOfMemory      = "OUT_OF_MEMORY"
+	ErrorCodeEngineHung       = "ENGINE_HUNG"
+	ErrorCodeResultTooLarge   = "RESULT_TOO_LARGE" // Sync Gateway rejected the result (or job doc) as too large
+	ErrorCodeInternal         = "INTERNAL_ERROR"
+)
+
+// Photos larger than this are rejected before running the engine
+const DefaultMaxPhotoMegapixels = 20
+
+// An error with a user facing error code
+type JobError struct {
+	Code   string
+	Params map[string]string
+	Err    error // The internal details
+}
+
+func (e JobError) Error() string {
+	return e.Err.Error()
+}
+
+func NewJobError(code string, params map[string]string, err error) JobError {
+	return JobError{
+		Code:   code,
+		Params: params,
+		Err:    err,
+	}
+}
+
+// Torch errors that mean something to users, matched against the engine output
+var engineOutputErrorCodes = []struct {
+	match string
+	code  string
+}{
+	{"out of memory", ErrorCodeOutOfMemory},
+	{"cannot allocate memory", ErrorCodeOutOfMemory},
+	{"unknown image type", ErrorCodeUnsupportedImage},
+	{"error loading image", ErrorCodeUnsupportedImage},
+	{"Not a JPEG file", ErrorCodeUnsupportedImage},
+}
+
+// Work out the error code for a job that failed with err and produced output
+func ClassifyJobError(err error, output string) (code string, params map[string]string) {
+
+	switch e := err.(type) {
+	case JobError:
+		return e.Code, e.Params
+	case EngineHungError:
+		return ErrorCodeEngineHung, nil
+	case ErrPayloadTooLarge:
+		return ErrorCodeResultTooLarge, nil
+	}
+
+	lowerOutput := strings.ToLower(output)
+	for _, candidate := range engineOutputErrorCodes {
+		if strings.Contains(lowerOutput, strings.ToLower(candidate.match)) {
+			return candidate.code, nil
+		}
+	}
+	return ErrorCodeInternal, nil
+
+}
+
+// Reject photos over maxMegapixels before spending GPU time on them.  Images
+// that can't be decoded here are left for the engine to try.
+func checkPhotoSize(sourceImagePath string, maxMegapixels int) error {
+
+	if maxMegapixels <= 0 {
+		return nil
+	}
+	width, height, err := imageSize(sourceImagePath)
+	if err != nil {
+		return nil
+	}
+	if width*height > maxMegapixels*1000*1000 {
+		return NewJobError(
+			ErrorCodePhotoTooLarge,
+			map[string]string{"max_megapixels": fmt.Sprintf("%v", maxMegapixels)},
+			fmt.Errorf("Photo is %vx%v, more than %v megapixels", width, height, maxMegapixels),
+		)
+	}
+	return nil
+
+}
@@ -0,0 +1,69 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyJobError(t *testing.T) {
+
+	tooLarge := NewJobError(
+		ErrorCodePhotoTooLarge,
+		map[string]string{"max_megapixels": "20"},
+		fmt.Errorf("Photo is 6000x4000"),
+	)
+	code, params := ClassifyJobError(tooLarge, "")
+	assert.Equal(t, ErrorCodePhotoTooLarge, code)
+	assert.Equal(t, "20", params["max_megapixels"])
+
+	code, _ = ClassifyJobError(EngineHungError{}, "")
+	assert.Equal(t, ErrorCodeEngineHung, code)
+
+	code, _ = ClassifyJobError(newErrPayloadTooLarge("http://localhost:4984/deepstyle/job1/result_image", MaxAttachmentSize+1), "")
+	assert.Equal(t, ErrorCodeResultTooLarge, code)
+
+	output := "Iteration 50 / 1000\nTHCudaCheck FAIL file=/tmp/luarocks_cutorch/lib/THC/generic/THCStorage.cu line=40 error=2 : out of memory"
+	code, _ = ClassifyJobError(fmt.Errorf("exit status 1"), output)
+	assert.Equal(t, ErrorCodeOutOfMemory, code)
+
+	code, _ = ClassifyJobError(fmt.Errorf("exit status 1"), "something unexpected")
+	assert.Equal(t, ErrorCodeInternal, code)
+
+}
+
+func TestUserErrorMessage(t *testing.T) {
+
+	params := map[string]string{"max_megapixels": "20"}
+	assert.Equal(t, "Your photo was too large (max 20MP)", UserErrorMessage(ErrorCodePhotoTooLarge, params))
+	assert.Equal(t, "Tu foto es demasiado grande (máx. 20MP)", UserErrorMessage(ErrorCodePhotoTooLarge, params, "es-MX"))
+
+	// falls back to the default locale, and to the generic message
+	assert.Equal(t, "Your photo was too large (max 20MP)", UserErrorMessage(ErrorCodePhotoTooLarge, params, "xx"))
+	assert.Equal(t, UserErrorMessage(ErrorCodeInternal, nil), UserErrorMessage("NOT_A_CODE", nil))
+
+	RegisterMessages("fr", map[string]string{ErrorCodeEngineHung: "Trop long"})
+	assert.Equal(t, "Trop long", UserErrorMessage(ErrorCodeEngineHung, nil, "fr-CA"))
+
+}
+
+func TestJobUserErrorMessage(t *testing.T) {
+
+	jobDoc := JobDocument{State: StateProcessingFailed, ErrorCode: ErrorCodeOutOfMemory}
+	assert.Equal(t, UserErrorMessage(ErrorCodeOutOfMemory, nil), jobDoc.UserErrorMessage())
+
+	// retried and succeeded, a leftover error code doesn't count
+	jobDoc.State = StateProcessingSuccessful
+	assert.Equal(t, "", jobDoc.UserErrorMessage())
+
+	jobDoc.State = StateProcessingFailed
+	jobDoc.clearError()
+	assert.Equal(t, "", jobDoc.UserErrorMessage())
+
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	assert.Equal(t, []string{"es-MX", "es", "en"}, ParseAcceptLanguage("en;q=0.5, es-MX, es;q=0.8, *;q=0.1"))
+	assert.Equal(t, []string{}, ParseAcceptLanguage(""))
+}
@@ -0,0 +1,85 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"time"
+)
+
+// Oldest entries are dropped beyond this, a job that keeps getting retried
+// shouldn't grow without bound.
+const MaxJobHistoryEntries = 100
+
+// A snapshot of a job's state, recorded each time the state or error changes.
+// Older revisions of the job doc are compacted away (see maintenance.go), so
+// this is what StateAt() works from.
+type JobHistoryEntry struct {
+	Timestamp    time.Time `json:"timestamp"`
+	State        string    `json:"state"`
+	ErrorCode    string    `json:"error_code,omitempty"`
+	ErrorMessage string    `json:"error_message,omitempty"`
+	Worker       string    `json:"worker,omitempty"` // Empty for changes made outside a worker
+}
+
+// Append the job's current state to its history, unless nothing has changed
+// since the last entry.  Call from inside a retryUpdater.
+func (doc *JobDocument) recordHistory() {
+
+	entry := JobHistoryEntry{
+		Timestamp:    time.Now().UTC(),
+		State:        doc.State,
+		ErrorCode:    doc.ErrorCode,
+		ErrorMessage: doc.ErrorMessage,
+		Worker:       doc.config.WorkerId,
+	}
+
+	if numEntries := len(doc.History); numEntries > 0 {
+		last := doc.History[numEntries-1]
+		if last.State == entry.State && last.ErrorCode == entry.ErrorCode && last.ErrorMessage == entry.ErrorMessage {
+			return
+		}
+	}
+
+	doc.History = append(doc.History, entry)
+	if len(doc.History) > MaxJobHistoryEntries {
+		doc.History = doc.History[len(doc.History)-MaxJobHistoryEntries:]
+	}
+
+}
+
+/*
+Reconstruct what the job looked like at time t: its state and error as of
+the last history entry at or before t.  Everything else is as it is now.
+
+Returns an error if the job didn't exist yet, or if t is before the first
+history entry (eg, before it was picked up by a worker, when the app created
+it without going through CreateJob).
+*/
+func (doc JobDocument) StateAt(t time.Time) (JobDocument, error) {
+
+	if createdAt, err := time.Parse(time.RFC3339, doc.CreatedAt); err == nil && t.Before(createdAt) {
+		return JobDocument{}, fmt.Errorf("Job %v was created at %v, after %v", doc.Id, doc.CreatedAt, t.Format(time.RFC3339))
+	}
+
+	numEntries := 0 // at or before t
+	for _, entry := range doc.History {
+		if entry.Timestamp.After(t) {
+			break
+		}
+		numEntries++
+	}
+	if numEntries == 0 {
+		return JobDocument{}, fmt.Errorf("No history of job %v at or before %v", doc.Id, t.Format(time.RFC3339))
+	}
+	entryAt := doc.History[numEntries-1]
+
+	jobDoc := doc
+	jobDoc.State = entryAt.State
+	jobDoc.ErrorCode = entryAt.ErrorCode
+	jobDoc.ErrorMessage = entryAt.ErrorMessage
+	if jobDoc.ErrorCode == "" {
+		jobDoc.ErrorParams = nil
+	}
+	jobDoc.History = doc.History[:numEntries]
+	return jobDoc, nil
+
+}
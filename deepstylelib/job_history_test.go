@@ -0,0 +1,79 @@
+package deepstylelib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordHistory(t *testing.T) {
+
+	jobDoc := JobDocument{}
+	jobDoc.State = StateReadyToProcess
+	jobDoc.recordHistory()
+	jobDoc.recordHistory()
+	assert.Equal(t, 1, len(jobDoc.History))
+
+	jobDoc.State = StateProcessingFailed
+	jobDoc.recordHistory()
+	jobDoc.ErrorCode = ErrorCodeOutOfMemory
+	jobDoc.recordHistory()
+	assert.Equal(t, 3, len(jobDoc.History))
+	assert.Equal(t, ErrorCodeOutOfMemory, jobDoc.History[2].ErrorCode)
+
+	for i := 0; i < MaxJobHistoryEntries; i++ {
+		jobDoc.State = StateReadyToProcess
+		if i%2 == 0 {
+			jobDoc.State = StateBeingProcessed
+		}
+		jobDoc.recordHistory()
+	}
+	assert.Equal(t, MaxJobHistoryEntries, len(jobDoc.History))
+
+}
+
+func TestStateAt(t *testing.T) {
+
+	created := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	jobDoc := JobDocument{
+		State:        StateProcessingFailed,
+		CreatedAt:    created.Format(time.RFC3339),
+		ErrorCode:    ErrorCodeEngineHung,
+		ErrorMessage: "hung",
+		History: []JobHistoryEntry{
+			{Timestamp: created, State: StateNotReadyToProcess},
+			{Timestamp: created.Add(time.Minute), State: StateReadyToProcess},
+			{Timestamp: created.Add(2 * time.Minute), State: StateProcessingSuccessful},
+			{Timestamp: created.Add(24 * time.Hour), State: StateProcessingFailed, ErrorCode: ErrorCodeEngineHung, ErrorMessage: "hung"},
+		},
+	}
+
+	_, err := jobDoc.StateAt(created.Add(-time.Second))
+	assert.Error(t, err)
+
+	jobDocAt, err := jobDoc.StateAt(created.Add(90 * time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, StateReadyToProcess, jobDocAt.State)
+	assert.Equal(t, 2, len(jobDocAt.History))
+
+	jobDocAt, err = jobDoc.StateAt(created.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, StateProcessingSuccessful, jobDocAt.State)
+	assert.Equal(t, "", jobDocAt.ErrorCode)
+	assert.Equal(t, "", jobDocAt.ErrorMessage)
+
+	jobDocAt, err = jobDoc.StateAt(created.Add(48 * time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, StateProcessingFailed, jobDocAt.State)
+	assert.Equal(t, ErrorCodeEngineHung, jobDocAt.ErrorCode)
+
+	// the doc itself is left alone
+	assert.Equal(t, 4, len(jobDoc.History))
+
+	// created by the app, no history until a worker picked it up
+	jobDoc.History = jobDoc.History[2:]
+	_, err = jobDoc.StateAt(created.Add(time.Minute))
+	assert.Error(t, err)
+
+}
@@ -0,0 +1,248 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Max amount of output kept in the job log doc and in the job's
+	// std_out_and_err field, older output is dropped.
+	MaxJobLogBytes = 32 * 1024
+
+	// How often buffered engine output is appended to the job log doc
+	JobLogFlushInterval = 5 * time.Second
+)
+
+/*
+While a job runs its output is appended to a sibling "job_log" doc rather than
+rewriting the (much larger) job doc each time.  The log doc only keeps the most
+recent MaxJobLogBytes of output, so each write is bounded no matter how long
+the job runs.  Offset is the total number of bytes ever appended, so readers
+can tell how much they missed and only fetch what's new.
+*/
+type JobLogDocument struct {
+	TypedDocument
+	JobId    string  `json:"job_id"`
+	Owner    string  `json:"owner"`
+	Output   string  `json:"output"` // The output ending at Offset
+	Offset   int64   `json:"offset"`
+	Progress float64 `json:"progress"` // 0-1, from the engine's iteration count
+}
+
+// neural-style prints "Iteration 50 / 1000" as it goes
+var iterationRegexp = regexp.MustCompile(`Iteration (\d+) / (\d+)`)
+
+func parseProgress(output string) (progress float64, ok bool) {
+	matches := iterationRegexp.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return 0, false
+	}
+	last := matches[len(matches)-1]
+	iteration, _ := strconv.Atoi(last[1])
+	numIterations, _ := strconv.Atoi(last[2])
+	if numIterations == 0 {
+		return 0, false
+	}
+	return float64(iteration) / float64(numIterations), true
+}
+
+func JobLogDocId(jobId string) string {
+	return fmt.Sprintf("%v_log", jobId)
+}
+
+func (logDoc *JobLogDocument) append(chunk string) {
+	logDoc.Output = string(tail([]byte(logDoc.Output+chunk), MaxJobLogBytes))
+	logDoc.Offset += int64(len(chunk))
+	if progress, ok := parseProgress(chunk); ok {
+		logDoc.Progress = progress
+	}
+}
+
+// The output after the given offset that is still available, along with the
+// offset it actually starts at (later than requested if output was dropped).
+func (logDoc JobLogDocument) OutputSince(offset int64) (output string, startOffset int64) {
+	startOffset = logDoc.Offset - int64(len(logDoc.Output))
+	if offset <= startOffset {
+		return logDoc.Output, startOffset
+	}
+	if offset >= logDoc.Offset {
+		return "", logDoc.Offset
+	}
+	return logDoc.Output[offset-startOffset:], offset
+}
+
+// The last maxBytes (or slightly fewer) of b, starting on a rune boundary
+func tail(b []byte, maxBytes int) []byte {
+	if len(b) <= maxBytes {
+		return b
+	}
+	start := len(b) - maxBytes
+	for start < len(b) && !utf8.RuneStart(b[start]) {
+		start++
+	}
+	return b[start:]
+}
+
+func isConflict(err error) bool {
+	return strings.Contains(err.Error(), "409") || strings.Contains(err.Error(), "conflict")
+}
+
+// Append a chunk of output to the job log doc, creating it if needed.
+func (doc *JobDocument) AppendStdOutAndErr(chunk string) error {
+
+	if chunk == "" {
+		return nil
+	}
+
+	db := doc.config.Database
+
+	if doc.jobLog == nil {
+		logDoc := &JobLogDocument{}
+		if err := db.Retrieve(JobLogDocId(doc.Id), logDoc); err != nil {
+			// doesn't exist yet, it will be created below
+			logDoc = &JobLogDocument{}
+		}
+		logDoc.Id = JobLogDocId(doc.Id)
+		logDoc.Type = JobLog
+		logDoc.JobId = doc.Id
+		logDoc.Owner = doc.Owner
+		doc.jobLog = logDoc
+	}
+	logDoc := doc.jobLog
+
+	for i := 1; i <= 10; i++ {
+
+		updated := *logDoc
+		updated.append(chunk)
+
+		var rev string
+		var err error
+		if updated.Revision == "" {
+			_, rev, err = insertDocWith(db, updated, updated.Id)
+		} else {
+			rev, err = editDoc(db, updated)
+		}
+
+		if err == nil {
+			updated.Revision = rev
+			*logDoc = updated
+			return nil
+		}
+
+		if !isConflict(err) {
+			return err
+		}
+
+		// someone else updated it (or it already existed), get the latest
+		log.Printf("Conflict appending to job log %v, retrying attempt #%v", logDoc.Id, i+1)
+		if err := db.Retrieve(logDoc.Id, logDoc); err != nil {
+			return err
+		}
+
+	}
+
+	return fmt.Errorf("Tried to append to job log 10 times, giving up")
+
+}
+
+// Retrieve the job log doc for a job
+func RetrieveJobLog(doc JobDocument) (JobLogDocument, error) {
+	logDoc := JobLogDocument{}
+	err := doc.config.Database.Retrieve(JobLogDocId(doc.Id), &logDoc)
+	return logDoc, err
+}
+
+// An io.Writer for engine output that keeps the tail of the output in
+// memory and appends it to the job log every JobLogFlushInterval.  Appending
+// happens in the background, so a slow Sync Gateway doesn't block the
+// engine's output (and trip the hang watchdog).  Call Close once the engine
+// is done.
+type jobLogWriter struct {
+	jobDoc     *JobDocument
+	mutex      sync.Mutex // protects pending and output
+	pending    []byte
+	output     []byte
+	flushMutex sync.Mutex // serializes appends to the job log
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+func newJobLogWriter(jobDoc *JobDocument) *jobLogWriter {
+	w := &jobLogWriter{
+		jobDoc:  jobDoc,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.flushPeriodically()
+	return w
+}
+
+func (w *jobLogWriter) Write(p []byte) (int, error) {
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.output = tail(append(w.output, p...), MaxJobLogBytes)
+	// the log doc only keeps this much anyway
+	w.pending = tail(append(w.pending, p...), MaxJobLogBytes)
+
+	// never fail the engine because the log couldn't be written
+	return len(p), nil
+
+}
+
+func (w *jobLogWriter) flushPeriodically() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(JobLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.Flush()
+		}
+	}
+}
+
+// Append the pending output to the job log
+func (w *jobLogWriter) Flush() {
+
+	w.flushMutex.Lock()
+	defer w.flushMutex.Unlock()
+
+	w.mutex.Lock()
+	chunk := w.pending
+	w.pending = nil
+	w.mutex.Unlock()
+
+	if err := w.jobDoc.AppendStdOutAndErr(string(chunk)); err != nil {
+		log.Printf("Error appending to job log for %v: %v", w.jobDoc.Id, err)
+		// try again with the next flush
+		w.mutex.Lock()
+		w.pending = tail(append(chunk, w.pending...), MaxJobLogBytes)
+		w.mutex.Unlock()
+	}
+
+}
+
+// Stop flushing in the background, and flush what's left
+func (w *jobLogWriter) Close() {
+	close(w.done)
+	<-w.stopped
+	w.Flush()
+}
+
+// The most recent MaxJobLogBytes of output
+func (w *jobLogWriter) Output() []byte {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.output
+}
@@ -0,0 +1,101 @@
+package deepstylelib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobLogAppend(t *testing.T) {
+
+	logDoc := JobLogDocument{}
+	logDoc.append("Iteration 1 / 1000\n")
+	logDoc.append("Iteration 2 / 1000\n")
+	assert.Equal(t, int64(38), logDoc.Offset)
+	assert.Equal(t, 0.002, logDoc.Progress)
+
+	output, startOffset := logDoc.OutputSince(19)
+	assert.Equal(t, "Iteration 2 / 1000\n", output)
+	assert.Equal(t, int64(19), startOffset)
+
+	output, startOffset = logDoc.OutputSince(38)
+	assert.Equal(t, "", output)
+	assert.Equal(t, int64(38), startOffset)
+
+	// only the most recent output is kept
+	logDoc.append(strings.Repeat("x", MaxJobLogBytes))
+	assert.Equal(t, MaxJobLogBytes, len(logDoc.Output))
+	assert.Equal(t, int64(38+MaxJobLogBytes), logDoc.Offset)
+
+	output, startOffset = logDoc.OutputSince(0)
+	assert.Equal(t, MaxJobLogBytes, len(output))
+	assert.Equal(t, int64(38), startOffset)
+
+}
+
+func TestTailRuneBoundary(t *testing.T) {
+	b := []byte("héllo")
+	assert.Equal(t, "llo", string(tail(b, 4))) // not half of the é
+	assert.Equal(t, "éllo", string(tail(b, 5)))
+	assert.Equal(t, "héllo", string(tail(b, 6)))
+	assert.True(t, utf8.Valid(tail([]byte(strings.Repeat("é", MaxJobLogBytes)), MaxJobLogBytes)))
+}
+
+func TestJobLogWriterSlowSyncGateway(t *testing.T) {
+
+	sg := newFakeSyncGateway(t)
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	appended := []JobLogDocument{}
+	sg.handle("PUT", "/job1_log", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		logDoc := JobLogDocument{}
+		json.NewDecoder(r.Body).Decode(&logDoc)
+		mutex.Lock()
+		appended = append(appended, logDoc)
+		rev := fmt.Sprintf("%d-fake", len(appended))
+		mutex.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "id": "job1_log", "rev": rev})
+	})
+
+	jobDoc := JobDocument{}
+	jobDoc.Id = "job1"
+	jobDoc.SetConfiguration(configuration{Database: sg.database(t)})
+	writer := newJobLogWriter(&jobDoc)
+
+	writer.Write([]byte("Iteration 1 / 10\n"))
+	flushed := make(chan struct{})
+	go func() {
+		writer.Flush()
+		close(flushed)
+	}()
+
+	// the engine can carry on writing while the append is stuck
+	time.Sleep(100 * time.Millisecond)
+	written := make(chan struct{})
+	go func() {
+		writer.Write([]byte("Iteration 2 / 10\n"))
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatalf("Write blocked on the job log append")
+	}
+
+	close(release)
+	<-flushed
+	writer.Close()
+
+	assert.Equal(t, 2, len(appended))
+	assert.Equal(t, "Iteration 1 / 10\nIteration 2 / 10\n", appended[1].Output)
+	assert.Equal(t, "Iteration 1 / 10\nIteration 2 / 10\n", string(writer.Output()))
+
+}
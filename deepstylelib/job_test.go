@@ -1,8 +1,12 @@
 package deepstylelib
 
 import (
+	"context"
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/tleyden/go-couch"
 )
 
@@ -40,3 +44,54 @@ func TestAddAttachment(t *testing.T) {
 	jobDoc.AddAttachment("foo", "/tmp/foo.png")
 
 }
+
+func TestExecuteDeepStyleJobShutdown(t *testing.T) {
+
+	sg := newFakeSyncGateway(t)
+	jobDoc := JobDocument{State: StateReadyToProcess}
+	jobDoc.Type = Job
+	sg.put(t, "job1", jobDoc)
+	sg.attachments["job1/"+SourceImageAttachment] = []byte("photo")
+	sg.attachments["job1/"+StyleImageAttachment] = []byte("style")
+	sg.get(t, "job1", &jobDoc)
+
+	// the worker is told to shut down part way through
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	config := configuration{
+		Database:    sg.database(t),
+		TempDir:     t.TempDir(),
+		Engine:      stallingEngine{interval: 50 * time.Millisecond, stallAfter: 100 * time.Millisecond},
+		HangTimeout: time.Hour,
+		Context:     ctx,
+	}
+	err := executeDeepStyleJob(config, jobDoc)
+	assert.Error(t, err)
+
+	// back in the queue for another worker, not failed
+	sg.get(t, "job1", &jobDoc)
+	assert.Equal(t, StateReadyToProcess, jobDoc.State)
+	assert.Equal(t, "", jobDoc.ErrorCode)
+
+}
+
+func TestSetFailedRecordsOutput(t *testing.T) {
+
+	sg := newFakeSyncGateway(t)
+	jobDoc := JobDocument{State: StateBeingProcessed}
+	jobDoc.Type = Job
+	sg.put(t, "job1", jobDoc)
+	sg.get(t, "job1", &jobDoc)
+	jobDoc.SetConfiguration(configuration{Database: sg.database(t)})
+
+	_, err := jobDoc.SetFailed(fmt.Errorf("exit status 1"), "out of memory")
+	assert.NoError(t, err)
+
+	// the failure and the engine output are saved in a single revision
+	sg.get(t, "job1", &jobDoc)
+	assert.Equal(t, "2-fake", jobDoc.Revision)
+	assert.Equal(t, StateProcessingFailed, jobDoc.State)
+	assert.Equal(t, "out of memory", jobDoc.StdOutAndErr)
+
+}
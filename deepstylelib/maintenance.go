@@ -0,0 +1,369 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Every state change and log append is a new revision, and mobile clients
+replicate the revision history along with the docs.  Maintenance keeps that
+in check:
+
+* Sets the database's revs_limit (how many revisions Sync Gateway keeps per
+  doc) and puts it back if it gets changed.  That takes Sync Gateway 3.0 or
+  later, whose POST /{db}/_config only changes the fields it's given.  Older
+  versions need it set in the config file (see docs/sync-gateway-config.json).
+* Deletes the job_log docs of completed jobs, whose output has been copied to
+  the job's std_out_and_err.  They're deleted rather than purged because
+  purges don't replicate, so mobile clients would keep them forever, while
+  the tombstone tells them to drop the doc.
+* Compacts the database once jobs have completed since the last compaction,
+  dropping the bodies of the old revisions of the completed job docs, which
+  only the current revision is needed for.  Sync Gateway can only compact a
+  whole database, not a single doc, so it's as close as it gets to compacting
+  each job as it completes.  When it last compacted is kept in a _local doc,
+  which doesn't replicate.  With revs_limit that leaves completed jobs with a
+  short history of revision ids and a single body.
+*/
+
+const (
+	MaintenanceDesignDocName = "maintenance"
+	JobLogsViewName          = "job_logs"
+	CompletedJobsViewName    = "completed_jobs" // Keyed by when the job completed
+
+	// When the database was last compacted, see CompactAfterCompletedJobs
+	MaintenanceStatusDocId = "_local/maintenance"
+
+	// Sync Gateway's own default
+	DefaultRevsLimit = 1000
+)
+
+type MaintenanceOptions struct {
+	RevsLimit     int           // 0 to leave it alone
+	DeleteJobLogs bool          // Delete the job_log docs of completed jobs
+	Compact       bool          // Compact the database if jobs have completed since it last was
+	Interval      time.Duration // Between runs, 0 to only run once
+}
+
+func adminRequest(method, url string, body interface{}, output interface{}) error {
+
+	var bodyReader *bytes.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		bodyReader = bytes.NewReader(bodyBytes)
+	} else {
+		bodyReader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, url, bodyReader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return newErrPayloadTooLarge(url, bodyReader.Size())
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%v %v: %v %v", method, url, resp.Status, string(respBody))
+	}
+	if output != nil {
+		return json.Unmarshal(respBody, output)
+	}
+	return nil
+
+}
+
+// The database's revs_limit, or DefaultRevsLimit if it hasn't been set
+func GetRevsLimit(syncGwAdminUrl string) (int, error) {
+	config := struct {
+		RevsLimit *int `json:"revs_limit"`
+	}{}
+	configUrl := fmt.Sprintf("%v/_config", strings.TrimSuffix(syncGwAdminUrl, "/"))
+	if err := adminRequest("GET", configUrl, nil, &config); err != nil {
+		return 0, err
+	}
+	if config.RevsLimit == nil {
+		return DefaultRevsLimit, nil
+	}
+	return *config.RevsLimit, nil
+}
+
+// The major version of Sync Gateway, from the admin server's root, eg
+// {"version":"Couchbase Sync Gateway/3.1.0(592;2e8c5b4) EE", ...}
+func SyncGatewayMajorVersion(syncGwAdminUrl string) (int, error) {
+	rootUrl, err := url.Parse(syncGwAdminUrl)
+	if err != nil {
+		return 0, err
+	}
+	rootUrl.Path = "/"
+	rootUrl.RawQuery = ""
+	server := struct {
+		Version string `json:"version"`
+	}{}
+	if err := adminRequest("GET", rootUrl.String(), nil, &server); err != nil {
+		return 0, err
+	}
+	match := syncGatewayVersionRegexp.FindStringSubmatch(server.Version)
+	if match == nil {
+		return 0, fmt.Errorf("Unrecognized Sync Gateway version: %q", server.Version)
+	}
+	return strconv.Atoi(match[1])
+}
+
+var syncGatewayVersionRegexp = regexp.MustCompile(`Sync Gateway/(\d+)\.`)
+
+// Change the database's revs_limit, leaving the rest of its config alone.
+// Needs Sync Gateway 3.0 or later, earlier versions replace the whole config
+// (or don't allow changing it at all).
+func SetRevsLimit(syncGwAdminUrl string, revsLimit int) error {
+	majorVersion, err := SyncGatewayMajorVersion(syncGwAdminUrl)
+	if err != nil {
+		return fmt.Errorf("Error getting Sync Gateway version: %v", err)
+	}
+	if majorVersion < 3 {
+		return fmt.Errorf("Changing revs_limit needs Sync Gateway 3.0 or later, this is %v.x, set revs_limit in its config file instead", majorVersion)
+	}
+	configUrl := fmt.Sprintf("%v/_config", strings.TrimSuffix(syncGwAdminUrl, "/"))
+	return adminRequest("POST", configUrl, map[string]interface{}{"revs_limit": revsLimit}, nil)
+}
+
+// Set the revs_limit if it isn't already.  Returns whether it was changed.
+func EnforceRevsLimit(syncGwAdminUrl string, revsLimit int) (changed bool, err error) {
+	currentRevsLimit, err := GetRevsLimit(syncGwAdminUrl)
+	if err != nil {
+		return false, fmt.Errorf("Error getting revs_limit: %v", err)
+	}
+	if currentRevsLimit == revsLimit {
+		return false, nil
+	}
+	log.Printf("Changing revs_limit from %v to %v", currentRevsLimit, revsLimit)
+	if err := SetRevsLimit(syncGwAdminUrl, revsLimit); err != nil {
+		return false, fmt.Errorf("Error setting revs_limit: %v", err)
+	}
+	return true, nil
+}
+
+func CompactDatabase(syncGwAdminUrl string) error {
+	compactUrl := fmt.Sprintf("%v/_compact", strings.TrimSuffix(syncGwAdminUrl, "/"))
+	return adminRequest("POST", compactUrl, nil, nil)
+}
+
+// Kept in MaintenanceStatusDocId
+type maintenanceStatus struct {
+	Revision        string `json:"_rev,omitempty"`
+	LastCompactedAt string `json:"last_compacted_at"` // RFC3339Nano, as history timestamps in the completed_jobs view
+}
+
+// Compact the database if any jobs have completed since the last time this
+// did.  Returns whether it compacted.
+func CompactAfterCompletedJobs(syncGwAdminUrl string) (compacted bool, err error) {
+
+	statusUrl := fmt.Sprintf("%v/%v", strings.TrimSuffix(syncGwAdminUrl, "/"), MaintenanceStatusDocId)
+	status := maintenanceStatus{}
+	if err := adminRequest("GET", statusUrl, nil, &status); err != nil && !isNotFound(err) {
+		return false, fmt.Errorf("Error getting %v: %v", MaintenanceStatusDocId, err)
+	}
+
+	viewResults := struct {
+		Rows []struct {
+			Id string `json:"id"`
+		} `json:"rows"`
+	}{}
+	options := map[string]interface{}{
+		"stale": "false",
+		"limit": 1,
+	}
+	if status.LastCompactedAt != "" {
+		options["startkey"] = status.LastCompactedAt
+	}
+	err = queryViewInstallIfMissing(
+		syncGwAdminUrl,
+		MaintenanceDesignDocName,
+		CompletedJobsViewName,
+		options,
+		&viewResults,
+		installMaintenanceViews,
+	)
+	if err != nil {
+		return false, err
+	}
+	if len(viewResults.Rows) == 0 {
+		return false, nil
+	}
+
+	// jobs completing while it runs are picked up next time
+	startedAt := time.Now().UTC().Format(time.RFC3339Nano)
+	if err := CompactDatabase(syncGwAdminUrl); err != nil {
+		return false, err
+	}
+
+	status.LastCompactedAt = startedAt
+	if err := adminRequest("PUT", statusUrl, status, nil); err != nil {
+		// it compacts again next time, which is harmless
+		log.Printf("Error saving %v: %v", MaintenanceStatusDocId, err)
+	}
+	return true, nil
+
+}
+
+func installMaintenanceViews(syncGwAdminUrl string) error {
+
+	typeField := storedFieldName("type")
+	stateField := storedFieldName("state")
+	historyField := storedFieldName("history")
+
+	viewJson := fmt.Sprintf(`
+{
+    "views":{
+        "%v":{
+            "map":"function (doc, meta) { if (doc.%v != '%v') { return; } emit(doc.%v, null); }"
+        },
+        "%v":{
+            "map":"function (doc, meta) { if (doc.%v != '%v') { return; } if (doc.%v != '%v' && doc.%v != '%v') { return; } var history = doc.%v || []; if (history.length == 0) { return; } emit(history[history.length - 1].%v, null); }"
+        }
+    }
+}
+`,
+		JobLogsViewName, typeField, JobLog, storedFieldName("job_id"),
+		CompletedJobsViewName, typeField, Job, stateField, StateProcessingSuccessful, stateField, StateProcessingFailed, historyField, storedFieldName("timestamp"),
+	)
+
+	log.Printf("installMaintenanceViews called")
+
+	return putDesignDoc(syncGwAdminUrl, MaintenanceDesignDocName, []byte(viewJson))
+
+}
+
+// Delete the job_log docs of jobs that have succeeded or failed.  Readers fall
+// back to the job's std_out_and_err once the log doc is gone.
+func DeleteCompletedJobLogs(syncGwAdminUrl string) (deleted int, err error) {
+
+	db, err := GetDbConnection(syncGwAdminUrl)
+	if err != nil {
+		return 0, fmt.Errorf("Error connecting to db: %v.  Err: %v", syncGwAdminUrl, err)
+	}
+
+	viewResults := struct {
+		Rows []struct {
+			Id  string `json:"id"`
+			Key string `json:"key"`
+		} `json:"rows"`
+	}{}
+	options := map[string]interface{}{"stale": "false"}
+	err = queryViewInstallIfMissing(
+		syncGwAdminUrl,
+		MaintenanceDesignDocName,
+		JobLogsViewName,
+		options,
+		&viewResults,
+		installMaintenanceViews,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, row := range viewResults.Rows {
+		jobDoc := JobDocument{}
+		if err := db.Retrieve(row.Key, &jobDoc); err != nil {
+			if !isNotFound(err) {
+				log.Printf("Error retrieving job %v, not deleting its log: %v", row.Key, err)
+				continue
+			}
+			// the job is gone, so is the need for its log
+		} else if !jobDoc.IsProcessingSuccessful() && !jobDoc.IsProcessingFailed() {
+			continue
+		}
+
+		logDoc := JobLogDocument{}
+		if err := db.Retrieve(row.Id, &logDoc); err != nil {
+			log.Printf("Error retrieving job log %v, not deleting it: %v", row.Id, err)
+			continue
+		}
+		if err := db.Delete(row.Id, logDoc.Revision); err != nil {
+			// eg a conflict with a late append, the next run gets it
+			log.Printf("Error deleting job log %v: %v", row.Id, err)
+			continue
+		}
+		deleted++
+	}
+
+	return deleted, nil
+
+}
+
+func runMaintenance(syncGwAdminUrl string, options MaintenanceOptions) error {
+
+	if options.RevsLimit > 0 {
+		if _, err := EnforceRevsLimit(syncGwAdminUrl, options.RevsLimit); err != nil {
+			return err
+		}
+	}
+
+	if options.DeleteJobLogs {
+		deleted, err := DeleteCompletedJobLogs(syncGwAdminUrl)
+		if err != nil {
+			return fmt.Errorf("Error deleting job logs: %v", err)
+		}
+		log.Printf("Deleted %v job logs of completed jobs", deleted)
+	}
+
+	if options.Compact {
+		compacted, err := CompactAfterCompletedJobs(syncGwAdminUrl)
+		if err != nil {
+			return fmt.Errorf("Error compacting: %v", err)
+		}
+		if compacted {
+			log.Printf("Compacted database")
+		} else {
+			log.Printf("No jobs completed since the last compaction, not compacting")
+		}
+	}
+
+	return nil
+
+}
+
+// Run maintenance once, or every options.Interval if it's set
+func RunMaintenance(syncGwAdminUrl string, options MaintenanceOptions) error {
+
+	for {
+
+		err := runMaintenance(syncGwAdminUrl, options)
+		if options.Interval == 0 {
+			return err
+		}
+		if err != nil {
+			log.Printf("Error running maintenance: %v", err)
+		}
+
+		log.Printf("Sleeping %v", options.Interval)
+		<-time.After(options.Interval)
+
+	}
+
+}
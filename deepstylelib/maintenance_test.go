@@ -0,0 +1,185 @@
+package deepstylelib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnforceRevsLimit(t *testing.T) {
+
+	config := map[string]interface{}{"bucket": "deepstyle"}
+	version := "Couchbase Sync Gateway/3.1.0(592;2e8c5b4) EE"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"version": version})
+			return
+		}
+		assert.Equal(t, "/deepstyle/_config", r.URL.Path)
+		switch r.Method {
+		case "GET":
+			json.NewEncoder(w).Encode(config)
+		case "POST":
+			update := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&update)
+			for key, value := range update {
+				config[key] = value
+			}
+		}
+	}))
+	defer server.Close()
+
+	adminUrl := server.URL + "/deepstyle/"
+
+	revsLimit, err := GetRevsLimit(adminUrl)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultRevsLimit, revsLimit)
+
+	changed, err := EnforceRevsLimit(adminUrl, 20)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "deepstyle", config["bucket"])
+
+	changed, err = EnforceRevsLimit(adminUrl, 20)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// older versions would replace the whole config with the partial one
+	version = "Couchbase Sync Gateway/2.8.3(1;8aac2b0) EE"
+	_, err = EnforceRevsLimit(adminUrl, 30)
+	assert.Error(t, err)
+	assert.Equal(t, float64(20), config["revs_limit"])
+	assert.Equal(t, "deepstyle", config["bucket"])
+
+}
+
+func TestSyncGatewayMajorVersion(t *testing.T) {
+
+	version := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/", r.URL.Path)
+		json.NewEncoder(w).Encode(map[string]interface{}{"version": version})
+	}))
+	defer server.Close()
+
+	version = "Couchbase Sync Gateway/3.1.0(592;2e8c5b4) EE"
+	majorVersion, err := SyncGatewayMajorVersion(server.URL + "/deepstyle/")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, majorVersion)
+
+	version = "Couchbase Sync Gateway/1.4.1(3;ddffdb0)"
+	majorVersion, err = SyncGatewayMajorVersion(server.URL + "/deepstyle/")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, majorVersion)
+
+	version = "CouchDB"
+	_, err = SyncGatewayMajorVersion(server.URL + "/deepstyle/")
+	assert.Error(t, err)
+
+}
+
+func TestDeleteCompletedJobLogs(t *testing.T) {
+
+	sg := newFakeSyncGateway(t)
+
+	jobs := map[string]string{
+		"succeeded": StateProcessingSuccessful,
+		"failed":    StateProcessingFailed,
+		"running":   StateBeingProcessed,
+	}
+	rows := []map[string]string{}
+	for jobId, state := range jobs {
+		jobDoc := JobDocument{State: state}
+		jobDoc.Type = Job
+		sg.put(t, jobId, jobDoc)
+	}
+	// the job of the last one has been deleted
+	for _, jobId := range []string{"succeeded", "failed", "running", "deleted"} {
+		logDoc := JobLogDocument{JobId: jobId, Output: "Iteration 1 / 1000"}
+		logDoc.Type = JobLog
+		sg.put(t, JobLogDocId(jobId), logDoc)
+		rows = append(rows, map[string]string{"id": JobLogDocId(jobId), "key": jobId})
+	}
+
+	sg.handle("GET", "/_design/maintenance/_view/job_logs", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"rows": rows})
+	})
+
+	deleted, err := DeleteCompletedJobLogs(sg.DBURL())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, deleted)
+
+	logDoc := JobLogDocument{}
+	assert.False(t, sg.get(t, JobLogDocId("succeeded"), &logDoc))
+	assert.False(t, sg.get(t, JobLogDocId("failed"), &logDoc))
+	assert.False(t, sg.get(t, JobLogDocId("deleted"), &logDoc))
+	assert.True(t, sg.get(t, JobLogDocId("running"), &logDoc))
+
+	// the jobs themselves are left alone
+	jobDoc := JobDocument{}
+	assert.True(t, sg.get(t, "succeeded", &jobDoc))
+
+}
+
+func TestCompactAfterCompletedJobs(t *testing.T) {
+
+	sg := newFakeSyncGateway(t)
+
+	completedAt := []string{}
+	compactions := 0
+	var status []byte
+
+	sg.handle("GET", "/_design/maintenance/_view/completed_jobs", func(w http.ResponseWriter, r *http.Request) {
+		startkey := ""
+		json.Unmarshal([]byte(r.URL.Query().Get("startkey")), &startkey)
+		rows := []map[string]string{}
+		for _, timestamp := range completedAt {
+			if timestamp >= startkey {
+				rows = append(rows, map[string]string{"key": timestamp})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"rows": rows})
+	})
+	sg.handle("POST", "/_compact", func(w http.ResponseWriter, r *http.Request) {
+		compactions++
+	})
+	sg.handle("GET", "/_local/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		if status == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(status)
+	})
+	sg.handle("PUT", "/_local/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		status, _ = ioutil.ReadAll(r.Body)
+	})
+
+	// nothing has completed yet
+	compacted, err := CompactAfterCompletedJobs(sg.DBURL())
+	assert.NoError(t, err)
+	assert.False(t, compacted)
+
+	completedAt = append(completedAt, time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano))
+	compacted, err = CompactAfterCompletedJobs(sg.DBURL())
+	assert.NoError(t, err)
+	assert.True(t, compacted)
+	assert.Equal(t, 1, compactions)
+
+	// no more jobs completed since
+	compacted, err = CompactAfterCompletedJobs(sg.DBURL())
+	assert.NoError(t, err)
+	assert.False(t, compacted)
+	assert.Equal(t, 1, compactions)
+
+	completedAt = append(completedAt, time.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano))
+	compacted, err = CompactAfterCompletedJobs(sg.DBURL())
+	assert.NoError(t, err)
+	assert.True(t, compacted)
+	assert.Equal(t, 2, compactions)
+
+}
@@ -0,0 +1,149 @@
+package deepstylelib
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Messages shown to users are looked up in this locale when there is no
+// translation for theirs.
+const DefaultLocale = "en"
+
+// Push notification messages
+const (
+	MessageJobReady              = "JOB_READY"
+	MessageJobFailed             = "JOB_FAILED"
+	MessageDigestReady           = "DIGEST_READY"             // params: count
+	MessageDigestReadySomeFailed = "DIGEST_READY_SOME_FAILED" // params: count, failed
+	MessageDigestFailed          = "DIGEST_FAILED"            // params: failed
+)
+
+// User facing messages by locale and error code (or Message* key).  {name}
+// is replaced by the param of that name.
+var (
+	messageCatalog = map[string]map[string]string{
+		"en": {
+			ErrorCodePhotoTooLarge:    "Your photo was too large (max {max_megapixels}MP)",
+			ErrorCodeUnsupportedImage: "We couldn't read your photo, try a JPEG or PNG",
+			ErrorCodeMissingImage:     "Your photo didn't finish uploading, please try again",
+			ErrorCodeOutOfMemory:      "Your photo was too big to process, try a smaller one",
+			ErrorCodeEngineHung:       "Your work of art took too long to make, please try again",
+			ErrorCodeResultTooLarge:   "Your work of art was too large to save, try a smaller photo",
+			ErrorCodeInternal:         "Something went wrong making your work of art, please try again",
+
+			MessageJobReady:              "Your DeepStyle work of art is ready!",
+			MessageJobFailed:             "Oops, something went wrong making your DeepStyle work of art!",
+			MessageDigestReady:           "{count} of your images are ready",
+			MessageDigestReadySomeFailed: "{count} of your images are ready, {failed} failed",
+			MessageDigestFailed:          "Oops, {failed} of your images failed",
+		},
+		"es": {
+			ErrorCodePhotoTooLarge:    "Tu foto es demasiado grande (máx. {max_megapixels}MP)",
+			ErrorCodeUnsupportedImage: "No pudimos leer tu foto, prueba con un JPEG o PNG",
+			ErrorCodeMissingImage:     "Tu foto no terminó de subirse, inténtalo de nuevo",
+			ErrorCodeOutOfMemory:      "Tu foto es demasiado grande para procesarla, prueba con una más pequeña",
+			ErrorCodeEngineHung:       "Tu obra de arte tardó demasiado, inténtalo de nuevo",
+			ErrorCodeResultTooLarge:   "Tu obra de arte es demasiado grande para guardarla, prueba con una foto más pequeña",
+			ErrorCodeInternal:         "Algo salió mal al crear tu obra de arte, inténtalo de nuevo",
+
+			MessageJobReady:              "¡Tu obra de arte DeepStyle está lista!",
+			MessageJobFailed:             "¡Uy, algo salió mal al crear tu obra de arte DeepStyle!",
+			MessageDigestReady:           "{count} de tus imágenes están listas",
+			MessageDigestReadySomeFailed: "{count} de tus imágenes están listas, {failed} fallaron",
+			MessageDigestFailed:          "Uy, {failed} de tus imágenes fallaron",
+		},
+	}
+	messageCatalogMutex sync.RWMutex
+)
+
+// Add (or override) the messages for a locale, eg RegisterMessages("fr", ...)
+func RegisterMessages(locale string, messages map[string]string) {
+	messageCatalogMutex.Lock()
+	defer messageCatalogMutex.Unlock()
+	locale = strings.ToLower(locale)
+	if messageCatalog[locale] == nil {
+		messageCatalog[locale] = map[string]string{}
+	}
+	for code, message := range messages {
+		messageCatalog[locale][code] = message
+	}
+}
+
+// The message for an error code in the first of the locales that has one,
+// falling back to the generic INTERNAL_ERROR message for unknown codes.
+func UserErrorMessage(code string, params map[string]string, locales ...string) string {
+	if message, ok := UserMessage(code, params, locales...); ok {
+		return message
+	}
+	message, _ := UserMessage(ErrorCodeInternal, params, locales...)
+	return message
+}
+
+// The message for a key (error code or one of the Message* keys) in the
+// first of the locales that has one, trying the language without its region
+// (es-MX -> es) before moving on, and falling back to DefaultLocale.
+func UserMessage(key string, params map[string]string, locales ...string) (message string, ok bool) {
+
+	messageCatalogMutex.RLock()
+	defer messageCatalogMutex.RUnlock()
+
+	candidates := []string{}
+	for _, locale := range locales {
+		locale = strings.ToLower(strings.Replace(locale, "_", "-", -1))
+		candidates = append(candidates, locale)
+		if i := strings.Index(locale, "-"); i > 0 {
+			candidates = append(candidates, locale[:i])
+		}
+	}
+	candidates = append(candidates, DefaultLocale)
+
+	for _, locale := range candidates {
+		if message, ok := messageCatalog[locale][key]; ok {
+			for name, value := range params {
+				message = strings.Replace(message, "{"+name+"}", value, -1)
+			}
+			return message, true
+		}
+	}
+	return "", false
+
+}
+
+// The locales in an Accept-Language header, most preferred first
+func ParseAcceptLanguage(acceptLanguage string) []string {
+
+	type weightedLocale struct {
+		locale  string
+		quality float64
+	}
+	weightedLocales := []weightedLocale{}
+
+	for _, languageRange := range strings.Split(acceptLanguage, ",") {
+		params := strings.Split(languageRange, ";")
+		locale := strings.TrimSpace(params[0])
+		if locale == "" || locale == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				quality, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		weightedLocales = append(weightedLocales, weightedLocale{locale, quality})
+	}
+
+	sort.SliceStable(weightedLocales, func(i, j int) bool {
+		return weightedLocales[i].quality > weightedLocales[j].quality
+	})
+
+	locales := []string{}
+	for _, weighted := range weightedLocales {
+		locales = append(locales, weighted.locale)
+	}
+	return locales
+
+}
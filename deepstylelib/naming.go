@@ -0,0 +1,106 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+How files made from a job's attachments are named wherever they leave Sync
+Gateway: result sinks (S3 keys, SFTP and local files), and the filename the
+API suggests for downloads (Content-Disposition).  The attachment names
+themselves (result_image etc) are what the apps read, so they don't change.
+
+The template can use:
+
+    {job_id}      the job's doc id
+    {attachment}  eg result_image or result_image_thumbnail
+    {style_name}  the job's style_name, or "style" if it has none
+    {timestamp}   when the job was created, eg 20160102T150405Z
+
+and the extension is added to it, eg "{style_name}/{job_id}" gives
+starry_night/1234.jpg.  Values are cleaned up so they're safe in filenames
+and urls.
+*/
+
+const DefaultFilenameTemplate = "{job_id}_{attachment}"
+
+var (
+	filenameTemplate      = DefaultFilenameTemplate
+	filenameTemplateMutex sync.RWMutex
+
+	filenamePlaceholder   = regexp.MustCompile(`\{[^}]*\}`)
+	unsafeFilenameChars   = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+	filenamePlaceholders  = map[string]bool{"{job_id}": true, "{attachment}": true, "{style_name}": true, "{timestamp}": true}
+	filenameTimestampForm = "20060102T150405Z"
+)
+
+// Use template (see above) for filenames from now on.  It must include
+// {job_id}, so that different jobs' files don't overwrite each other.
+func SetFilenameTemplate(template string) error {
+
+	for _, placeholder := range filenamePlaceholder.FindAllString(template, -1) {
+		if !filenamePlaceholders[placeholder] {
+			return fmt.Errorf("Unknown placeholder %v in filename template %v", placeholder, template)
+		}
+	}
+	if !strings.Contains(template, "{job_id}") {
+		return fmt.Errorf("Filename template %v must include {job_id}", template)
+	}
+	for _, segment := range strings.Split(template, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("Invalid path in filename template %v", template)
+		}
+	}
+
+	filenameTemplateMutex.Lock()
+	defer filenameTemplateMutex.Unlock()
+	filenameTemplate = template
+	return nil
+
+}
+
+func sanitizeFilename(value string) string {
+	return strings.Trim(unsafeFilenameChars.ReplaceAllString(value, "_"), "_.")
+}
+
+// The filename (possibly with / separated directories) for one of a job's
+// attachments, with extension (eg "jpg") added.
+func AttachmentFilename(jobDoc JobDocument, attachment, extension string) string {
+
+	filenameTemplateMutex.RLock()
+	template := filenameTemplate
+	filenameTemplateMutex.RUnlock()
+
+	styleName := sanitizeFilename(jobDoc.StyleName)
+	if styleName == "" {
+		styleName = "style"
+	}
+	timestamp := jobDoc.CreatedAt
+	if createdAt, err := time.Parse(time.RFC3339, jobDoc.CreatedAt); err == nil {
+		timestamp = createdAt.UTC().Format(filenameTimestampForm)
+	}
+
+	values := map[string]string{
+		"{job_id}":     sanitizeFilename(jobDoc.Id),
+		"{attachment}": sanitizeFilename(attachment),
+		"{style_name}": styleName,
+		"{timestamp}":  sanitizeFilename(timestamp),
+	}
+	filename := filenamePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		return values[placeholder]
+	})
+	return fmt.Sprintf("%v.%v", filename, extension)
+
+}
+
+// A Content-Disposition header suggesting the attachment's filename, without
+// any directories.
+func contentDisposition(jobDoc JobDocument, attachment, extension string) string {
+	filename := AttachmentFilename(jobDoc, attachment, extension)
+	filename = filename[strings.LastIndex(filename, "/")+1:]
+	return fmt.Sprintf(`inline; filename="%v"`, filename)
+}
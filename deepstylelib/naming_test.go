@@ -0,0 +1,31 @@
+package deepstylelib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttachmentFilename(t *testing.T) {
+
+	defer SetFilenameTemplate(DefaultFilenameTemplate)
+
+	jobDoc := JobDocument{StyleName: "Starry Night", CreatedAt: "2016-01-02T15:04:05Z"}
+	jobDoc.Id = "job1"
+
+	assert.Equal(t, "job1_result_image.jpg", AttachmentFilename(jobDoc, ResultImageAttachment, "jpg"))
+
+	assert.NoError(t, SetFilenameTemplate("{style_name}/{timestamp}-{job_id}"))
+	assert.Equal(t, "Starry_Night/20160102T150405Z-job1.png", AttachmentFilename(jobDoc, ResultImageAttachment, "png"))
+	assert.Equal(t, `inline; filename="20160102T150405Z-job1.png"`, contentDisposition(jobDoc, ResultImageAttachment, "png"))
+
+	// no style name, and an id that isn't safe in a filename
+	jobDoc.StyleName = ""
+	jobDoc.Id = "../job 2"
+	assert.Equal(t, "style/20160102T150405Z-job_2.jpg", AttachmentFilename(jobDoc, ResultImageAttachment, "jpg"))
+
+	assert.Error(t, SetFilenameTemplate("{attachment}"))
+	assert.Error(t, SetFilenameTemplate("{job_id}_{owner}"))
+	assert.Error(t, SetFilenameTemplate("../{job_id}"))
+
+}
@@ -0,0 +1,132 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Sends a push notification to a device
+type pushFunc func(owner, deviceToken, message string) error
+
+/*
+Coalesces completion notifications for each device over a window, so someone
+who submits a batch of jobs gets "12 of your images are ready" rather than 12
+notifications.  The window starts at the first completed job, so nobody waits
+longer than the window.  A lone job still gets its usual message.
+*/
+type notificationDigester struct {
+	window  time.Duration
+	push    pushFunc
+	mutex   sync.Mutex
+	pending map[string]*notificationDigest // by owner and device token
+}
+
+type notificationDigest struct {
+	owner       string
+	deviceToken string
+	locale      string
+	succeeded   map[string]bool // job ids
+	failed      map[string]bool
+	lastMessage string // the message for a single job
+}
+
+func newNotificationDigester(window time.Duration, push pushFunc) *notificationDigester {
+	return &notificationDigester{
+		window:  window,
+		push:    push,
+		pending: map[string]*notificationDigest{},
+	}
+}
+
+// Add a completed job to its owner's digest, which is sent at the end of
+// the window.  Jobs added more than once in a window are only counted once.
+func (d *notificationDigester) Add(jobDoc JobDocument, message string) {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	key := fmt.Sprintf("%v/%v", jobDoc.Owner, jobDoc.OwnerDeviceToken)
+	digest, ok := d.pending[key]
+	if !ok {
+		digest = &notificationDigest{
+			owner:       jobDoc.Owner,
+			deviceToken: jobDoc.OwnerDeviceToken,
+			succeeded:   map[string]bool{},
+			failed:      map[string]bool{},
+		}
+		d.pending[key] = digest
+		time.AfterFunc(d.window, func() { d.flush(key) })
+	}
+
+	digest.locale = jobDoc.Locale
+	digest.lastMessage = message
+	if jobDoc.IsProcessingSuccessful() {
+		digest.succeeded[jobDoc.Id] = true
+	} else {
+		digest.failed[jobDoc.Id] = true
+	}
+
+}
+
+// Send all the pending digests now, eg before the worker restarts or exits.
+// Their changes are already behind the changes feed position, so they'd
+// never be sent otherwise.
+func (d *notificationDigester) Flush() {
+
+	d.mutex.Lock()
+	keys := []string{}
+	for key := range d.pending {
+		keys = append(keys, key)
+	}
+	d.mutex.Unlock()
+
+	for _, key := range keys {
+		d.flush(key)
+	}
+
+}
+
+func (d *notificationDigester) flush(key string) {
+
+	d.mutex.Lock()
+	digest := d.pending[key]
+	delete(d.pending, key)
+	d.mutex.Unlock()
+
+	if digest == nil {
+		return
+	}
+
+	message := digest.message()
+	if err := d.push(digest.owner, digest.deviceToken, message); err != nil {
+		log.Printf("Error sending notification digest to %v: %v", digest.owner, err)
+		return
+	}
+	log.Printf("Sent notification digest to %v: %v", digest.owner, message)
+
+}
+
+func (digest notificationDigest) message() string {
+
+	numSucceeded, numFailed := len(digest.succeeded), len(digest.failed)
+	if numSucceeded+numFailed == 1 {
+		return digest.lastMessage
+	}
+
+	params := map[string]string{
+		"count":  fmt.Sprintf("%v", numSucceeded),
+		"failed": fmt.Sprintf("%v", numFailed),
+	}
+	key := MessageDigestReady
+	switch {
+	case numSucceeded == 0:
+		key = MessageDigestFailed
+	case numFailed > 0:
+		key = MessageDigestReadySomeFailed
+	}
+	message, _ := UserMessage(key, params, digest.locale)
+	return message
+
+}
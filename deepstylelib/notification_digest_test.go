@@ -0,0 +1,78 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotificationDigester(t *testing.T) {
+
+	var mutex sync.Mutex
+	sent := []string{}
+	done := make(chan struct{}, 2)
+	push := func(owner, deviceToken, message string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sent = append(sent, fmt.Sprintf("%v: %v", owner, message))
+		done <- struct{}{}
+		return nil
+	}
+
+	digester := newNotificationDigester(50*time.Millisecond, push)
+
+	for i := 0; i < 12; i++ {
+		jobDoc := JobDocument{Owner: "alice", OwnerDeviceToken: "a", State: StateProcessingSuccessful}
+		jobDoc.Id = fmt.Sprintf("job%v", i)
+		digester.Add(jobDoc, "ready")
+		// duplicate changes for the same job are only counted once
+		digester.Add(jobDoc, "ready")
+	}
+	failed := JobDocument{Owner: "alice", OwnerDeviceToken: "a", State: StateProcessingFailed}
+	failed.Id = "job12"
+	digester.Add(failed, "failed")
+
+	lone := JobDocument{Owner: "bob", OwnerDeviceToken: "b", State: StateProcessingSuccessful}
+	lone.Id = "job13"
+	digester.Add(lone, "Your DeepStyle work of art is ready!")
+
+	<-done
+	<-done
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.ElementsMatch(t, []string{
+		"alice: 12 of your images are ready, 1 failed",
+		"bob: Your DeepStyle work of art is ready!",
+	}, sent)
+
+}
+
+func TestNotificationDigesterFlush(t *testing.T) {
+
+	sent := make(chan string, 2)
+	push := func(owner, deviceToken, message string) error {
+		sent <- fmt.Sprintf("%v: %v", owner, message)
+		return nil
+	}
+
+	// a window that won't end during the test, as if the worker restarted
+	digester := newNotificationDigester(time.Hour, push)
+
+	for i := 0; i < 2; i++ {
+		jobDoc := JobDocument{Owner: "alice", OwnerDeviceToken: "a", State: StateProcessingSuccessful}
+		jobDoc.Id = fmt.Sprintf("job%v", i)
+		digester.Add(jobDoc, "ready")
+	}
+
+	digester.Flush()
+	assert.Equal(t, "alice: 2 of your images are ready", <-sent)
+
+	// nothing left to send
+	digester.Flush()
+	assert.Len(t, sent, 0)
+
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package deepstylelib
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Run cmd in its own process group, so that cancelling its context kills
+// th along with anything it started.  Otherwise children left holding the
+// output pipe keep Run waiting (and the GPU busy) after th is killed.
+func runProcessGroup(cmd *exec.Cmd) error {
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		// a negative pid signals the whole group
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = processGroupWaitDelay
+
+	err := cmd.Run()
+	if cmd.Process != nil {
+		// clean up any stragglers, fails harmlessly if there are none
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return err
+
+}
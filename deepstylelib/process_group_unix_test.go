@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package deepstylelib
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunProcessGroupKillsChildren(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// the backgrounded sleep holds on to the output pipe, like a child
+	// of th would
+	cmd := exec.CommandContext(ctx, "sh", "-c", "sleep 60 & sleep 60")
+	cmd.Stdout = &bytes.Buffer{}
+
+	start := time.Now()
+	err := runProcessGroup(cmd)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < processGroupWaitDelay/2, "Took %v to return", time.Since(start))
+
+}
@@ -87,22 +87,37 @@ func getJobsReadyOrBeingProcessed(syncGwAdminUrl string) (viewResults map[string
 
 	output := map[string]interface{}{}
 
+	options := map[string]interface{}{}
+	options["stale"] = "false"
+
+	err = queryViewInstallIfMissing(
+		syncGwAdminUrl,
+		DesignDocName,
+		ViewName,
+		options,
+		&output,
+		installView,
+	)
+	return output, err
+
+}
+
+func queryViewInstallIfMissing(syncGwAdminUrl, designDocName, viewName string, options map[string]interface{}, output interface{}, install func(syncGwAdminUrl string) error) error {
+
 	db, err := GetDbConnection(syncGwAdminUrl)
 	if err != nil {
-		return output, fmt.Errorf("Error connecting to db: %v.  Err: %v", syncGwAdminUrl, err)
+		return fmt.Errorf("Error connecting to db: %v.  Err: %v", syncGwAdminUrl, err)
 	}
 
-	viewUrl := fmt.Sprintf("_design/%v/_view/%v", DesignDocName, ViewName)
-	options := map[string]interface{}{}
-	options["stale"] = "false"
+	viewUrl := fmt.Sprintf("_design/%v/_view/%v", designDocName, viewName)
 
-	err = db.Query(viewUrl, options, &output)
+	err = db.Query(viewUrl, options, output)
 	if err != nil {
 		if strings.Contains(err.Error(), "404") || strings.Contains(err.Error(), "not_found") {
 			// the view doesn't exist yet, attempt to install view
-			if errInstallView := installView(syncGwAdminUrl); errInstallView != nil {
+			if errInstallView := install(syncGwAdminUrl); errInstallView != nil {
 				// failed to install view, give up
-				return output, errInstallView
+				return errInstallView
 
 			}
 
@@ -114,20 +129,22 @@ func getJobsReadyOrBeingProcessed(syncGwAdminUrl string) (viewResults map[string
 			log.Printf("Done sleeping 10s to wait for view to be ready")
 
 			// now retry
-			errInner := db.Query(viewUrl, options, &output)
+			errInner := db.Query(viewUrl, options, output)
 			if errInner != nil {
 				// failed again, give up
-				return output, errInner
+				return errInner
 			}
 		} else {
-			return output, err
+			return err
 		}
 	}
-	return output, nil
+	return nil
 
 }
 
 type ViewParams struct {
+	TypeField  string // As stored, see storedFieldName
+	StateField string
 	JobDocType string
 	JobState1  string
 	JobState2  string
@@ -136,20 +153,19 @@ type ViewParams struct {
 
 func installView(syncGwAdminUrl string) error {
 
-	// if url has a trailing slash, remove it
-	syncGwAdminUrl = strings.TrimSuffix(syncGwAdminUrl, "/")
-
 	viewJsonTemplate := `
 {
     "views":{
         "unprocessed_jobs":{
-            "map":"function (doc, meta) { if (doc.type != '{{.JobDocType}}') { return; } if (doc.state == '{{.JobState1}}' || doc.state == '{{.JobState2}}' || doc.state == '{{.JobState3}}') { emit(doc.state, meta.id); }}"
+            "map":"function (doc, meta) { if (doc.{{.TypeField}} != '{{.JobDocType}}') { return; } if (doc.{{.StateField}} == '{{.JobState1}}' || doc.{{.StateField}} == '{{.JobState2}}' || doc.{{.StateField}} == '{{.JobState3}}') { emit(doc.{{.StateField}}, meta.id); }}"
         }
     }
 }
 `
 
 	viewParams := ViewParams{
+		TypeField:  storedFieldName("type"),
+		StateField: storedFieldName("state"),
 		JobDocType: Job,
 		JobState1:  StateNotReadyToProcess,
 		JobState2:  StateReadyToProcess,
@@ -169,10 +185,18 @@ func installView(syncGwAdminUrl string) error {
 
 	log.Printf("installView called")
 
+	return putDesignDoc(syncGwAdminUrl, DesignDocName, buffer.Bytes())
+
+}
+
+func putDesignDoc(syncGwAdminUrl, designDocName string, bufferBytes []byte) error {
+
+	// if url has a trailing slash, remove it
+	syncGwAdminUrl = strings.TrimSuffix(syncGwAdminUrl, "/")
+
 	// curl -X PUT -H "Content-type: application/json" localhost:4985/todolite/_design/all_lists --data @testview
-	viewUrl := fmt.Sprintf("%v/_design/%v", syncGwAdminUrl, DesignDocName)
+	viewUrl := fmt.Sprintf("%v/_design/%v", syncGwAdminUrl, designDocName)
 
-	bufferBytes := buffer.Bytes()
 	log.Printf("view: %v", string(bufferBytes))
 
 	req, err := http.NewRequest("PUT", viewUrl, bytes.NewReader(bufferBytes))
@@ -229,6 +253,11 @@ func resetStuckJobs(jobs []JobDocument) error {
 			// remove the job from the job tracker map since state changed
 			delete(trackedJobs, job.Id)
 
+			details := fmt.Sprintf("Stuck in %v for %v", StateBeingProcessed, duration)
+			if err := RecordAudit(job.config.Database, AuditActionResetStuckJob, []string{job.Id}, details); err != nil {
+				log.Printf("%v", err)
+			}
+
 		} else {
 			log.Printf("Job %v has been processing for %v minutes", job.Id, duration.Minutes())
 		}
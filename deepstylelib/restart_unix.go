@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package deepstylelib
+
+import (
+	"os"
+	"syscall"
+)
+
+// Replace this process with the binary at executablePath, keeping the pid so
+// that supervisors (systemd, upstart, etc) don't notice.
+func restartWorker(executablePath string) error {
+	return syscall.Exec(executablePath, os.Args, os.Environ())
+}
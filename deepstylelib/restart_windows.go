@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package deepstylelib
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Windows has no exec, so start the new binary with the same args and exit.
+func restartWorker(executablePath string) error {
+	cmd := exec.Command(executablePath, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
@@ -0,0 +1,288 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+/*
+Result sinks deliver the finished result image somewhere in addition to the
+result_image attachment.  They are configured per deployment by name:
+
+    --result-sink archive=s3://my-bucket/deepstyle/results?region=us-west-2
+    --result-sink cdn=s3://my-cdn-bucket/results?immutable=true
+    --result-sink archive=s3://my-bucket/results?glacier_days=90&expire_days=365
+    --result-sink pipeline=sftp://deepstyle@ingest.example.com:22/incoming?key=/home/ubuntu/.ssh/id_rsa
+    --result-sink local=file:///mnt/results
+
+Every job is delivered to all configured sinks, unless the job doc has a
+result_sinks field listing the names of the sinks it wants (which can be
+empty to opt out).
+*/
+
+type ResultSink interface {
+	Deliver(jobDoc JobDocument, resultFilePath string) error
+}
+
+type ResultSinks map[string]ResultSink
+
+// Parse a name=url sink spec as passed to --result-sink
+func ParseResultSinkSpec(spec string) (name string, sink ResultSink, err error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", nil, fmt.Errorf("Invalid result sink %v, expected name=url", spec)
+	}
+	sink, err = NewResultSink(parts[1])
+	return parts[0], sink, err
+}
+
+func NewResultSink(sinkUrl string) (ResultSink, error) {
+
+	parsedUrl, err := url.Parse(sinkUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsedUrl.Scheme {
+	case "s3":
+		region := parsedUrl.Query().Get("region")
+		if region == "" {
+			region = "us-east-1"
+		}
+		lifecycle, err := parseS3LifecyclePolicy(parsedUrl.Query())
+		if err != nil {
+			return nil, err
+		}
+		return s3ResultSink{
+			bucket:    parsedUrl.Host,
+			prefix:    strings.TrimPrefix(parsedUrl.Path, "/"),
+			region:    region,
+			immutable: parsedUrl.Query().Get("immutable") == "true",
+			lifecycle: lifecycle,
+		}, nil
+	case "sftp":
+		return sftpResultSink{
+			sinkUrl: parsedUrl,
+		}, nil
+	case "file":
+		return localDirResultSink{
+			dir: localPath(parsedUrl),
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported result sink: %v.  Expected s3://, sftp:// or file://", sinkUrl)
+	}
+
+}
+
+// The local path of a file:// url.  On Windows file:///C:/out has the path
+// /C:/out, the leading slash has to go.
+func localPath(fileUrl *url.URL) string {
+	p := fileUrl.Path
+	if len(p) >= 3 && p[0] == '/' && p[2] == ':' && unicode.IsLetter(rune(p[1])) {
+		p = p[1:]
+	}
+	return filepath.FromSlash(p)
+}
+
+// The sinks a job should be delivered to
+func (sinks ResultSinks) forJob(jobDoc JobDocument) ResultSinks {
+
+	if jobDoc.ResultSinks == nil {
+		return sinks
+	}
+
+	selected := ResultSinks{}
+	for _, name := range jobDoc.ResultSinks {
+		sink, ok := sinks[name]
+		if !ok {
+			log.Printf("Job %v wants unknown result sink %v, ignoring", jobDoc.Id, name)
+			continue
+		}
+		selected[name] = sink
+	}
+	return selected
+
+}
+
+// Deliver the result to each sink, continuing past failures so that one
+// broken destination doesn't prevent delivery to the others.
+func (sinks ResultSinks) Deliver(jobDoc JobDocument, resultFilePath string) error {
+
+	failed := []string{}
+	for name, sink := range sinks.forJob(jobDoc) {
+		if err := sink.Deliver(jobDoc, resultFilePath); err != nil {
+			log.Printf("Error delivering result of job %v to sink %v: %v", jobDoc.Id, name, err)
+			failed = append(failed, name)
+			continue
+		}
+		log.Printf("Delivered result of job %v to sink %v", jobDoc.Id, name)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to deliver result to sinks: %v", strings.Join(failed, ", "))
+	}
+	return nil
+
+}
+
+type localDirResultSink struct {
+	dir string
+}
+
+// The name of the delivered result, see AttachmentFilename
+func resultFilename(jobDoc JobDocument, resultFilePath string) string {
+	return AttachmentFilename(jobDoc, ResultImageAttachment, strings.TrimPrefix(filepath.Ext(resultFilePath), "."))
+}
+
+func (s localDirResultSink) Deliver(jobDoc JobDocument, resultFilePath string) error {
+	destPath := filepath.Join(s.dir, filepath.FromSlash(resultFilename(jobDoc, resultFilePath)))
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return err
+	}
+	return cp(destPath, resultFilePath)
+}
+
+// AWS keys will be taken from environment variables or ~/.aws/.  With
+// immutable=true objects are named after the hash of the result and get
+// long lived cache headers, so the bucket can be fronted by a CDN.
+type s3ResultSink struct {
+	bucket    string
+	prefix    string
+	region    string
+	immutable bool
+	lifecycle S3LifecyclePolicy // See s3_lifecycle.go
+}
+
+func (s s3ResultSink) Deliver(jobDoc JobDocument, resultFilePath string) error {
+
+	f, err := os.Open(resultFilePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	uploadInput := &s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(path.Join(s.prefix, resultFilename(jobDoc, resultFilePath))),
+		Body:        f,
+		ContentType: aws.String("image/jpeg"),
+	}
+
+	if s.immutable {
+		if jobDoc.ResultHash == "" {
+			return fmt.Errorf("Job has no result hash, can't use an immutable name")
+		}
+		uploadInput.Key = aws.String(path.Join(s.prefix, jobDoc.ResultHash+".jpg"))
+		uploadInput.CacheControl = aws.String(immutableCacheControl)
+	}
+
+	uploader := s3manager.NewUploader(session.New(&aws.Config{Region: aws.String(s.region)}))
+	_, err = uploader.Upload(uploadInput)
+	return err
+
+}
+
+// Authenticates with the password in the url, or the private key given
+// by the key query param.  Host keys are verified against known_hosts
+// (~/.ssh/known_hosts unless overridden with the known_hosts query param).
+type sftpResultSink struct {
+	sinkUrl *url.URL
+}
+
+func (s sftpResultSink) clientConfig() (*ssh.ClientConfig, error) {
+
+	query := s.sinkUrl.Query()
+
+	knownHostsPath := query.Get("known_hosts")
+	if knownHostsPath == "" {
+		knownHostsPath = filepath.Join(homeDir(), ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading known hosts from %v: %v", knownHostsPath, err)
+	}
+
+	authMethods := []ssh.AuthMethod{}
+	if password, ok := s.sinkUrl.User.Password(); ok {
+		authMethods = append(authMethods, ssh.Password(password))
+	}
+	if keyPath := query.Get("key"); keyPath != "" {
+		keyBytes, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			return nil, err
+		}
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	}
+
+	return &ssh.ClientConfig{
+		User:            s.sinkUrl.User.Username(),
+		Auth:            authMethods,
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+
+}
+
+func (s sftpResultSink) Deliver(jobDoc JobDocument, resultFilePath string) error {
+
+	clientConfig, err := s.clientConfig()
+	if err != nil {
+		return err
+	}
+
+	host := s.sinkUrl.Host
+	if s.sinkUrl.Port() == "" {
+		host = host + ":22"
+	}
+
+	sshClient, err := ssh.Dial("tcp", host, clientConfig)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return err
+	}
+	defer sftpClient.Close()
+
+	src, err := os.Open(resultFilePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	destPath := path.Join(s.sinkUrl.Path, resultFilename(jobDoc, resultFilePath))
+	if err := sftpClient.MkdirAll(path.Dir(destPath)); err != nil {
+		return err
+	}
+	dst, err := sftpClient.Create(destPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+
+}
@@ -0,0 +1,94 @@
+package deepstylelib
+
+import (
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseResultSinkSpec(t *testing.T) {
+
+	name, sink, err := ParseResultSinkSpec("archive=s3://my-bucket/deepstyle/results?region=us-west-2")
+	assert.NoError(t, err)
+	assert.Equal(t, "archive", name)
+	s3Sink, ok := sink.(s3ResultSink)
+	assert.True(t, ok)
+	assert.Equal(t, "my-bucket", s3Sink.bucket)
+	assert.Equal(t, "deepstyle/results", s3Sink.prefix)
+	assert.Equal(t, "us-west-2", s3Sink.region)
+
+	_, sink, err = ParseResultSinkSpec("cdn=s3://my-bucket/results?immutable=true")
+	assert.NoError(t, err)
+	assert.True(t, sink.(s3ResultSink).immutable)
+	assert.Equal(t, "us-east-1", sink.(s3ResultSink).region)
+
+	name, sink, err = ParseResultSinkSpec("local=file:///mnt/results")
+	assert.NoError(t, err)
+	assert.Equal(t, "local", name)
+	assert.Equal(t, filepath.FromSlash("/mnt/results"), sink.(localDirResultSink).dir)
+
+	_, sink, err = ParseResultSinkSpec("pipeline=sftp://deepstyle@ingest.example.com:22/incoming")
+	assert.NoError(t, err)
+	assert.IsType(t, sftpResultSink{}, sink)
+
+	for _, spec := range []string{"s3://my-bucket", "=s3://my-bucket", "archive=ftp://example.com/results"} {
+		_, _, err = ParseResultSinkSpec(spec)
+		assert.Error(t, err, spec)
+	}
+
+}
+
+func TestLocalPath(t *testing.T) {
+	for fileUrl, expected := range map[string]string{
+		"file:///mnt/results": "/mnt/results",
+		"file:///C:/out":      "C:/out",
+		"file:///c:/out/dir":  "c:/out/dir",
+	} {
+		parsedUrl, err := url.Parse(fileUrl)
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.FromSlash(expected), localPath(parsedUrl), fileUrl)
+	}
+}
+
+func TestResultSinksForJob(t *testing.T) {
+
+	sinks := ResultSinks{
+		"archive": localDirResultSink{dir: "/archive"},
+		"cdn":     localDirResultSink{dir: "/cdn"},
+	}
+
+	// all of them by default
+	assert.Equal(t, sinks, sinks.forJob(JobDocument{}))
+
+	// none if the job opts out
+	assert.Equal(t, ResultSinks{}, sinks.forJob(JobDocument{ResultSinks: []string{}}))
+
+	// unknown names are ignored
+	selected := sinks.forJob(JobDocument{ResultSinks: []string{"cdn", "missing"}})
+	assert.Equal(t, ResultSinks{"cdn": sinks["cdn"]}, selected)
+
+}
+
+func TestLocalDirResultSinkDeliver(t *testing.T) {
+
+	dir := t.TempDir()
+	resultPath := filepath.Join(t.TempDir(), "job1_result_image.jpg")
+	assert.NoError(t, ioutil.WriteFile(resultPath, []byte("result"), 0644))
+
+	jobDoc := JobDocument{}
+	jobDoc.Id = "job1"
+	sink := localDirResultSink{dir: filepath.Join(dir, "results")}
+	assert.NoError(t, sink.Deliver(jobDoc, resultPath))
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "results", resultFilename(jobDoc, resultPath)))
+	assert.NoError(t, err)
+	assert.Equal(t, "result", string(contents))
+
+	// failures are reported, after trying every sink
+	sinks := ResultSinks{"local": sink}
+	assert.Error(t, sinks.Deliver(jobDoc, filepath.Join(dir, "missing.jpg")))
+
+}
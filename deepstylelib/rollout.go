@@ -0,0 +1,500 @@
+package deepstylelib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tleyden/go-couch"
+)
+
+/*
+Workers can update themselves to a new version, a few at a time.
+
+An operator builds the new binaries and publishes a worker_rollout doc with
+the version, where to download the binary for each platform, its sha256 and
+an ed25519 signature of the two (see `deepstyle publish_rollout`).
+
+Workers started with --rollout-public-key notice the doc on the changes feed.
+Jobs are processed one at a time between reads of the changes feed, so a
+worker is drained whenever it checks.  Before updating it claims one of the
+rollout's max_unavailable slots in the updating field, then downloads the
+binary, checks the checksum and signature, swaps it in and restarts.  Once
+the new version is running it releases its slot (moving itself to updated),
+letting the next worker go.
+
+A worker that doesn't come back within RolloutClaimTimeout (eg the new
+binary crashes on startup) pauses the rollout rather than passing its slot
+on, so a broken build takes out max_unavailable workers rather than the
+whole fleet.  Publishing the rollout again resumes it.
+*/
+
+// Set at build time with
+// -ldflags "-X github.com/tleyden/deepstyle/deepstylelib.Version=1.2.0"
+var Version = "dev"
+
+const (
+	WorkerRolloutDocId = "worker_rollout"
+
+	// Claims older than this are assumed to be from workers that died
+	// part way through updating (or with the new version), and pause the
+	// rollout.
+	RolloutClaimTimeout = 30 * time.Minute
+
+	// Max time to download a binary, so a stalled download doesn't hold
+	// on to the update slot (and the worker) forever.
+	RolloutDownloadTimeout = 10 * time.Minute
+
+	// How often workers check for a rollout when nothing on the changes
+	// feed prompts them to.
+	WorkerUpdateCheckInterval = 5 * time.Minute
+
+	// Passes the changes feed position to the restarted worker
+	restartSinceEnvVar = "DEEPSTYLE_RESTART_SINCE"
+)
+
+type RolloutBinary struct {
+	Url       string `json:"url"`
+	Sha256    string `json:"sha256"`
+	Signature string `json:"signature"` // base64 ed25519 signature, see rolloutSigningMessage
+}
+
+type WorkerRolloutDocument struct {
+	TypedDocument
+	Version        string                   `json:"version"`
+	Binaries       map[string]RolloutBinary `json:"binaries"` // by GOOS/GOARCH, eg linux/amd64
+	MaxUnavailable int                      `json:"max_unavailable"`
+	Updating       map[string]time.Time     `json:"updating"` // worker id -> when it claimed its slot
+	Updated        []string                 `json:"updated"`
+	Paused         string                   `json:"paused,omitempty"` // Why the rollout stopped, if it did
+}
+
+var rolloutDownloadClient = &http.Client{Timeout: RolloutDownloadTimeout}
+
+func RolloutPlatform() string {
+	return fmt.Sprintf("%v/%v", runtime.GOOS, runtime.GOARCH)
+}
+
+// The version and platform are signed along with the checksum, so an old
+// (or other platform's) signed binary can't be passed off as this one.
+func rolloutSigningMessage(version, platform, sha256Hex string) []byte {
+	return []byte(fmt.Sprintf("deepstyle %v %v %v", version, platform, sha256Hex))
+}
+
+func GenerateRolloutKeys() (publicKey, privateKey string, err error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(public), base64.StdEncoding.EncodeToString(private), nil
+}
+
+func ParseRolloutPublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid rollout public key, expected base64 encoded ed25519 key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func ParseRolloutSigningKey(encoded string) (ed25519.PrivateKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("Invalid rollout signing key, expected base64 encoded ed25519 key")
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// Hash and sign a locally built binary that will be served from binaryUrl
+func SignRolloutBinary(signingKey ed25519.PrivateKey, version, platform, binaryPath, binaryUrl string) (RolloutBinary, error) {
+	sha256Hex, err := sha256File(binaryPath)
+	if err != nil {
+		return RolloutBinary{}, err
+	}
+	signature := ed25519.Sign(signingKey, rolloutSigningMessage(version, platform, sha256Hex))
+	return RolloutBinary{
+		Url:       binaryUrl,
+		Sha256:    sha256Hex,
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	}, nil
+}
+
+func (b RolloutBinary) Verify(publicKey ed25519.PublicKey, version, platform string) error {
+	signature, err := base64.StdEncoding.DecodeString(b.Signature)
+	if err != nil {
+		return fmt.Errorf("Invalid rollout signature: %v", err)
+	}
+	if !ed25519.Verify(publicKey, rolloutSigningMessage(version, platform, b.Sha256), signature) {
+		return fmt.Errorf("Rollout signature for %v %v doesn't match the public key", version, platform)
+	}
+	return nil
+}
+
+func (r WorkerRolloutDocument) maxUnavailable() int {
+	if r.MaxUnavailable < 1 {
+		return 1
+	}
+	return r.MaxUnavailable
+}
+
+// Try to claim one of the max_unavailable update slots for workerId, first
+// pausing the rollout if any claim expired.  Returns whether the doc was
+// changed, and whether the worker has a slot.
+func (r *WorkerRolloutDocument) claimUpdateSlot(workerId string, now time.Time) (changed, claimed bool) {
+
+	for claimant, claimedAt := range r.Updating {
+		if r.Paused == "" && claimant != workerId && now.Sub(claimedAt) > RolloutClaimTimeout {
+			log.Printf("Rollout claim by %v expired, it has been updating since %v.  Pausing the rollout.", claimant, claimedAt)
+			r.Paused = fmt.Sprintf("%v claimed a slot at %v and didn't come back running %v", claimant, claimedAt.UTC().Format(time.RFC3339), r.Version)
+			changed = true
+		}
+	}
+	if r.Paused != "" {
+		return changed, false
+	}
+
+	if _, ok := r.Updating[workerId]; ok {
+		return changed, true
+	}
+	if len(r.Updating) >= r.maxUnavailable() {
+		return changed, false
+	}
+
+	if r.Updating == nil {
+		r.Updating = map[string]time.Time{}
+	}
+	r.Updating[workerId] = now
+	return true, true
+
+}
+
+// Give up the worker's update slot, and if it's running the rollout's
+// version, record it as updated.  Returns whether the doc was changed.
+func (r *WorkerRolloutDocument) releaseUpdateSlot(workerId string, updated bool) (changed bool) {
+
+	if _, ok := r.Updating[workerId]; ok {
+		delete(r.Updating, workerId)
+		changed = true
+	}
+
+	if updated {
+		for _, updatedWorkerId := range r.Updated {
+			if updatedWorkerId == workerId {
+				return changed
+			}
+		}
+		r.Updated = append(r.Updated, workerId)
+		sort.Strings(r.Updated)
+		changed = true
+	}
+	return changed
+
+}
+
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), "404")
+}
+
+// Apply update to the rollout doc and save it (if update says it changed
+// anything), getting the latest and re-applying it on conflicts.
+func editWorkerRollout(db couch.Database, rollout *WorkerRolloutDocument, update func(r *WorkerRolloutDocument) bool) error {
+
+	for i := 1; i <= 10; i++ {
+
+		updated := *rollout
+		updated.Updating = map[string]time.Time{}
+		for workerId, claimedAt := range rollout.Updating {
+			updated.Updating[workerId] = claimedAt
+		}
+		updated.Updated = append([]string{}, rollout.Updated...)
+
+		if !update(&updated) {
+			return nil
+		}
+
+		rev, err := db.Edit(updated)
+		if err == nil {
+			updated.Revision = rev
+			*rollout = updated
+			return nil
+		}
+		if !isConflict(err) {
+			return err
+		}
+
+		log.Printf("Conflict updating worker rollout, retrying attempt #%v", i+1)
+		*rollout = WorkerRolloutDocument{}
+		if err := db.Retrieve(WorkerRolloutDocId, rollout); err != nil {
+			return err
+		}
+
+	}
+
+	return fmt.Errorf("Tried to update worker rollout 10 times, giving up")
+
+}
+
+// Publish the desired worker version, replacing any previous rollout.
+func PublishWorkerRollout(db couch.Database, version string, binaries map[string]RolloutBinary, maxUnavailable int) (*WorkerRolloutDocument, error) {
+
+	rollout := &WorkerRolloutDocument{}
+	if err := db.Retrieve(WorkerRolloutDocId, rollout); err != nil {
+		if !isNotFound(err) {
+			return nil, err
+		}
+		rollout = &WorkerRolloutDocument{
+			TypedDocument: TypedDocument{Type: WorkerRollout},
+		}
+		rollout.Id = WorkerRolloutDocId
+		rollout.Version = version
+		rollout.Binaries = binaries
+		rollout.MaxUnavailable = maxUnavailable
+		_, rev, err := db.InsertWith(rollout, WorkerRolloutDocId)
+		if err != nil {
+			return nil, err
+		}
+		rollout.Revision = rev
+	} else {
+		err := editWorkerRollout(db, rollout, func(r *WorkerRolloutDocument) bool {
+			if r.Version != version || r.Paused != "" {
+				// a new (or resumed) rollout starts from scratch, a
+				// resumed one keeps the workers that did update
+				r.Updating = map[string]time.Time{}
+				r.Paused = ""
+			}
+			if r.Version != version {
+				r.Updated = []string{}
+			}
+			r.Version = version
+			r.Binaries = binaries
+			r.MaxUnavailable = maxUnavailable
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	platforms := []string{}
+	for platform := range binaries {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	details := fmt.Sprintf("version %v for %v, max unavailable %v", version, strings.Join(platforms, ", "), maxUnavailable)
+	if err := RecordAudit(db, AuditActionWorkerRollout, []string{WorkerRolloutDocId}, details); err != nil {
+		log.Printf("Error recording audit entry for worker rollout: %v", err)
+	}
+
+	return rollout, nil
+
+}
+
+type WorkerUpdater struct {
+	Database       couch.Database
+	WorkerId       string
+	PublicKey      ed25519.PublicKey
+	ExecutablePath string // The binary to replace, defaults to the running one
+}
+
+func NewWorkerUpdater(db couch.Database, workerId string, publicKey ed25519.PublicKey) (*WorkerUpdater, error) {
+	executablePath, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if executablePath, err = filepath.EvalSymlinks(executablePath); err != nil {
+		return nil, err
+	}
+	return &WorkerUpdater{
+		Database:       db,
+		WorkerId:       workerId,
+		PublicKey:      publicKey,
+		ExecutablePath: executablePath,
+	}, nil
+}
+
+// Check the rollout doc, and if there's a new version and a free slot,
+// install it.  Returns true if the worker needs to restart to run it.
+// Must only be called when the worker isn't processing a job.
+func (u *WorkerUpdater) CheckForUpdate() (installed bool, err error) {
+
+	rollout := &WorkerRolloutDocument{}
+	if err := u.Database.Retrieve(WorkerRolloutDocId, rollout); err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if rollout.Version == "" {
+		return false, nil
+	}
+
+	if rollout.Version == Version {
+		// up to date, release the slot if this worker just updated
+		return false, editWorkerRollout(u.Database, rollout, func(r *WorkerRolloutDocument) bool {
+			return r.Version == Version && r.releaseUpdateSlot(u.WorkerId, true)
+		})
+	}
+
+	platform := RolloutPlatform()
+	binary, ok := rollout.Binaries[platform]
+	if !ok {
+		log.Printf("Worker rollout of %v has no binary for %v, not updating", rollout.Version, platform)
+		return false, nil
+	}
+	if err := binary.Verify(u.PublicKey, rollout.Version, platform); err != nil {
+		return false, err
+	}
+
+	if u.isRunning(binary) {
+		// otherwise it would reinstall the same binary and restart forever
+		log.Printf("WARNING: already running the %v binary but Version is %v, was it built without -X deepstylelib.Version?", rollout.Version, Version)
+		return false, editWorkerRollout(u.Database, rollout, func(r *WorkerRolloutDocument) bool {
+			return r.Version == rollout.Version && r.releaseUpdateSlot(u.WorkerId, true)
+		})
+	}
+
+	claimed := false
+	err = editWorkerRollout(u.Database, rollout, func(r *WorkerRolloutDocument) bool {
+		var changed bool
+		changed, claimed = r.claimUpdateSlot(u.WorkerId, time.Now())
+		return changed
+	})
+	if err != nil {
+		return false, err
+	}
+	if !claimed && rollout.Paused != "" {
+		log.Printf("Worker rollout of %v is paused, not updating: %v", rollout.Version, rollout.Paused)
+		return false, nil
+	}
+	if !claimed {
+		log.Printf("Waiting for a free slot to update to %v, %v workers are updating", rollout.Version, len(rollout.Updating))
+		return false, nil
+	}
+
+	log.Printf("Updating worker %v from %v to %v", u.WorkerId, Version, rollout.Version)
+	if err := u.install(binary); err != nil {
+		u.release(rollout)
+		return false, fmt.Errorf("Error installing %v: %v", rollout.Version, err)
+	}
+	return true, nil
+
+}
+
+// Whether the running executable is binary, whatever its Version says
+func (u *WorkerUpdater) isRunning(binary RolloutBinary) bool {
+	sha256Hex, err := sha256File(u.ExecutablePath)
+	if err != nil {
+		log.Printf("Error hashing %v: %v", u.ExecutablePath, err)
+		return false
+	}
+	return sha256Hex == binary.Sha256
+}
+
+// Give up the update slot without updating, eg if the install failed
+func (u *WorkerUpdater) release(rollout *WorkerRolloutDocument) {
+	err := editWorkerRollout(u.Database, rollout, func(r *WorkerRolloutDocument) bool {
+		return r.releaseUpdateSlot(u.WorkerId, false)
+	})
+	if err != nil {
+		log.Printf("Error releasing worker rollout slot: %v", err)
+	}
+}
+
+// Download the binary next to the current one, check its checksum and swap
+// it in.  The running binary is moved aside rather than overwritten, which
+// Windows doesn't allow.
+func (u *WorkerUpdater) install(binary RolloutBinary) error {
+
+	resp, err := rolloutDownloadClient.Get(binary.Url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Unexpected status downloading %v: %v", binary.Url, resp.Status)
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(u.ExecutablePath), ".deepstyle-update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tempFile, hash), resp.Body); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	if sha256Hex := hex.EncodeToString(hash.Sum(nil)); sha256Hex != binary.Sha256 {
+		return fmt.Errorf("Checksum of %v is %v, expected %v", binary.Url, sha256Hex, binary.Sha256)
+	}
+	if err := os.Chmod(tempFile.Name(), 0755); err != nil {
+		return err
+	}
+
+	return swapExecutable(tempFile.Name(), u.ExecutablePath)
+
+}
+
+// Move newPath to executablePath, keeping the old one as .previous, and
+// putting it back if that fails.
+func swapExecutable(newPath, executablePath string) error {
+	previousPath := executablePath + ".previous"
+	os.Remove(previousPath)
+	if err := os.Rename(executablePath, previousPath); err != nil {
+		return err
+	}
+	if err := os.Rename(newPath, executablePath); err != nil {
+		if errRollback := os.Rename(previousPath, executablePath); errRollback != nil {
+			return fmt.Errorf("Error %v swapping in %v, and %v putting back %v", err, newPath, errRollback, executablePath)
+		}
+		return err
+	}
+	return nil
+}
+
+// Check for a rollout and if a new version was installed, restart into it,
+// continuing from the since value of the changes feed.  beforeRestart (if
+// not nil) is called first, to finish anything that wouldn't survive it.
+func (u *WorkerUpdater) UpdateAndRestart(since interface{}, beforeRestart func()) {
+
+	installed, err := u.CheckForUpdate()
+	if err != nil {
+		log.Printf("Error checking for worker update: %v", err)
+		return
+	}
+	if !installed {
+		return
+	}
+
+	if beforeRestart != nil {
+		beforeRestart()
+	}
+
+	log.Printf("Restarting worker %v", u.WorkerId)
+	os.Setenv(restartSinceEnvVar, fmt.Sprint(since))
+	if err := restartWorker(u.ExecutablePath); err != nil {
+		// the new binary will be picked up the next time the worker
+		// is started, until then the slot times out
+		log.Printf("Error restarting worker: %v", err)
+	}
+
+}
@@ -0,0 +1,253 @@
+package deepstylelib
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignAndVerifyRolloutBinary(t *testing.T) {
+
+	publicKeyStr, signingKeyStr, err := GenerateRolloutKeys()
+	assert.NoError(t, err)
+	publicKey, err := ParseRolloutPublicKey(publicKeyStr)
+	assert.NoError(t, err)
+	signingKey, err := ParseRolloutSigningKey(signingKeyStr)
+	assert.NoError(t, err)
+
+	binaryFile, err := ioutil.TempFile("", "deepstyle-rollout-test")
+	assert.NoError(t, err)
+	defer os.Remove(binaryFile.Name())
+	binaryFile.WriteString("not really a binary")
+	binaryFile.Close()
+
+	binary, err := SignRolloutBinary(signingKey, "1.2.0", "linux/amd64", binaryFile.Name(), "https://example.com/deepstyle")
+	assert.NoError(t, err)
+	assert.NoError(t, binary.Verify(publicKey, "1.2.0", "linux/amd64"))
+
+	// can't be reused for another version or platform
+	assert.Error(t, binary.Verify(publicKey, "1.3.0", "linux/amd64"))
+	assert.Error(t, binary.Verify(publicKey, "1.2.0", "linux/arm64"))
+
+	tampered := binary
+	tampered.Sha256 = "0000"
+	assert.Error(t, tampered.Verify(publicKey, "1.2.0", "linux/amd64"))
+
+}
+
+func TestWorkerUpdaterIsRunning(t *testing.T) {
+
+	binaryFile, err := ioutil.TempFile("", "deepstyle-rollout-test")
+	assert.NoError(t, err)
+	defer os.Remove(binaryFile.Name())
+	binaryFile.WriteString("not really a binary")
+	binaryFile.Close()
+
+	sha256Hex, err := sha256File(binaryFile.Name())
+	assert.NoError(t, err)
+
+	updater := WorkerUpdater{ExecutablePath: binaryFile.Name()}
+	assert.True(t, updater.isRunning(RolloutBinary{Sha256: sha256Hex}))
+	assert.False(t, updater.isRunning(RolloutBinary{Sha256: "0000"}))
+
+	updater.ExecutablePath = binaryFile.Name() + ".missing"
+	assert.False(t, updater.isRunning(RolloutBinary{Sha256: sha256Hex}))
+
+}
+
+func TestClaimUpdateSlot(t *testing.T) {
+
+	now := time.Now()
+	rollout := WorkerRolloutDocument{MaxUnavailable: 1}
+
+	changed, claimed := rollout.claimUpdateSlot("worker1", now)
+	assert.True(t, changed)
+	assert.True(t, claimed)
+
+	// already has it
+	changed, claimed = rollout.claimUpdateSlot("worker1", now)
+	assert.False(t, changed)
+	assert.True(t, claimed)
+
+	changed, claimed = rollout.claimUpdateSlot("worker2", now)
+	assert.False(t, changed)
+	assert.False(t, claimed)
+
+	assert.True(t, rollout.releaseUpdateSlot("worker1", true))
+	assert.Equal(t, 0, len(rollout.Updating))
+	assert.Equal(t, []string{"worker1"}, rollout.Updated)
+	assert.False(t, rollout.releaseUpdateSlot("worker1", true))
+
+	changed, claimed = rollout.claimUpdateSlot("worker2", now)
+	assert.True(t, changed)
+	assert.True(t, claimed)
+
+	// worker2 never came back, which pauses the rollout rather than letting
+	// the next worker have a go
+	changed, claimed = rollout.claimUpdateSlot("worker3", now.Add(RolloutClaimTimeout+time.Minute))
+	assert.True(t, changed)
+	assert.False(t, claimed)
+	assert.Contains(t, rollout.Paused, "worker2")
+
+	changed, claimed = rollout.claimUpdateSlot("worker3", now.Add(RolloutClaimTimeout+time.Hour))
+	assert.False(t, changed)
+	assert.False(t, claimed)
+
+}
+
+// A signed rollout of version 1.2.0 for this platform, served by sg
+func publishTestRollout(t *testing.T, sg *fakeSyncGateway, binaryContents string) (ed25519.PublicKey, *WorkerRolloutDocument) {
+
+	publicKeyStr, signingKeyStr, err := GenerateRolloutKeys()
+	assert.NoError(t, err)
+	publicKey, _ := ParseRolloutPublicKey(publicKeyStr)
+	signingKey, _ := ParseRolloutSigningKey(signingKeyStr)
+
+	binaryPath := filepath.Join(t.TempDir(), "deepstyle")
+	assert.NoError(t, ioutil.WriteFile(binaryPath, []byte(binaryContents), 0755))
+	binary, err := SignRolloutBinary(signingKey, "1.2.0", RolloutPlatform(), binaryPath, sg.URL+"/binaries/deepstyle")
+	assert.NoError(t, err)
+
+	rollout, err := PublishWorkerRollout(sg.database(t), "1.2.0", map[string]RolloutBinary{RolloutPlatform(): binary}, 1)
+	assert.NoError(t, err)
+	return publicKey, rollout
+
+}
+
+func newTestWorkerUpdater(t *testing.T, sg *fakeSyncGateway, workerId string, publicKey ed25519.PublicKey) *WorkerUpdater {
+	executablePath := filepath.Join(t.TempDir(), "deepstyle")
+	assert.NoError(t, ioutil.WriteFile(executablePath, []byte("old binary"), 0755))
+	return &WorkerUpdater{
+		Database:       sg.database(t),
+		WorkerId:       workerId,
+		PublicKey:      publicKey,
+		ExecutablePath: executablePath,
+	}
+}
+
+func TestCheckForUpdate(t *testing.T) {
+
+	sg := newFakeSyncGateway(t)
+	served := "new binary"
+	sg.handle("GET", "/binaries/deepstyle", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(served))
+	})
+	publicKey, _ := publishTestRollout(t, sg, "new binary")
+
+	// no free slot while worker1 is updating
+	updater1 := newTestWorkerUpdater(t, sg, "worker1", publicKey)
+	updater2 := newTestWorkerUpdater(t, sg, "worker2", publicKey)
+	installed, err := updater1.CheckForUpdate()
+	assert.NoError(t, err)
+	assert.True(t, installed)
+	contents, _ := ioutil.ReadFile(updater1.ExecutablePath)
+	assert.Equal(t, "new binary", string(contents))
+	contents, _ = ioutil.ReadFile(updater1.ExecutablePath + ".previous")
+	assert.Equal(t, "old binary", string(contents))
+
+	installed, err = updater2.CheckForUpdate()
+	assert.NoError(t, err)
+	assert.False(t, installed)
+
+	// worker1 restarts into the new version, freeing its slot
+	Version = "1.2.0"
+	installed, err = updater1.CheckForUpdate()
+	Version = "dev"
+	assert.NoError(t, err)
+	assert.False(t, installed)
+	rollout := WorkerRolloutDocument{}
+	sg.get(t, WorkerRolloutDocId, &rollout)
+	assert.Equal(t, 0, len(rollout.Updating))
+	assert.Equal(t, []string{"worker1"}, rollout.Updated)
+
+	// a download that doesn't match the signed checksum isn't installed,
+	// and gives the slot back
+	served = "tampered binary"
+	installed, err = updater2.CheckForUpdate()
+	assert.Error(t, err)
+	assert.False(t, installed)
+	contents, _ = ioutil.ReadFile(updater2.ExecutablePath)
+	assert.Equal(t, "old binary", string(contents))
+	sg.get(t, WorkerRolloutDocId, &rollout)
+	assert.Equal(t, 0, len(rollout.Updating))
+
+}
+
+func TestCheckForUpdatePaused(t *testing.T) {
+
+	sg := newFakeSyncGateway(t)
+	sg.handle("GET", "/binaries/deepstyle", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new binary"))
+	})
+	publicKey, rollout := publishTestRollout(t, sg, "new binary")
+
+	// worker1 claimed a slot long ago and never came back
+	rollout.Updating = map[string]time.Time{"worker1": time.Now().Add(-RolloutClaimTimeout - time.Minute)}
+	sg.put(t, WorkerRolloutDocId, rollout)
+
+	updater := newTestWorkerUpdater(t, sg, "worker2", publicKey)
+	installed, err := updater.CheckForUpdate()
+	assert.NoError(t, err)
+	assert.False(t, installed)
+	sg.get(t, WorkerRolloutDocId, rollout)
+	assert.Contains(t, rollout.Paused, "worker1")
+
+	// publishing again resumes it
+	_, err = PublishWorkerRollout(sg.database(t), rollout.Version, rollout.Binaries, 1)
+	assert.NoError(t, err)
+	installed, err = updater.CheckForUpdate()
+	assert.NoError(t, err)
+	assert.True(t, installed)
+
+}
+
+func TestEditWorkerRolloutConflict(t *testing.T) {
+
+	sg := newFakeSyncGateway(t)
+	db := sg.database(t)
+	_, rollout := publishTestRollout(t, sg, "new binary")
+
+	// someone else updates it first
+	latest := *rollout
+	latest.Updated = []string{"worker1"}
+	sg.put(t, WorkerRolloutDocId, latest)
+
+	err := editWorkerRollout(db, rollout, func(r *WorkerRolloutDocument) bool {
+		return r.releaseUpdateSlot("worker2", true)
+	})
+	assert.NoError(t, err)
+
+	stored := WorkerRolloutDocument{}
+	sg.get(t, WorkerRolloutDocId, &stored)
+	assert.Equal(t, []string{"worker1", "worker2"}, stored.Updated)
+	assert.Equal(t, stored.Revision, rollout.Revision)
+
+}
+
+func TestSwapExecutable(t *testing.T) {
+
+	dir := t.TempDir()
+	executablePath := filepath.Join(dir, "deepstyle")
+	newPath := filepath.Join(dir, "new")
+	assert.NoError(t, ioutil.WriteFile(executablePath, []byte("old"), 0755))
+
+	// the new binary can't be moved in, so the old one is put back
+	assert.Error(t, swapExecutable(newPath, executablePath))
+	contents, err := ioutil.ReadFile(executablePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(contents))
+
+	assert.NoError(t, ioutil.WriteFile(newPath, []byte("new"), 0755))
+	assert.NoError(t, swapExecutable(newPath, executablePath))
+	contents, _ = ioutil.ReadFile(executablePath)
+	assert.Equal(t, "new", string(contents))
+	contents, _ = ioutil.ReadFile(executablePath + ".previous")
+	assert.Equal(t, "old", string(contents))
+
+}
@@ -0,0 +1,264 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+Lifecycle policies for results archived to S3, so old results move to
+cheaper storage and eventually get deleted without separate Terraform:
+
+    --result-sink archive=s3://my-bucket/deepstyle/results?ia_days=30&glacier_days=90&expire_days=365
+
+The policy becomes a rule (with the id deepstyle:<prefix>) in the bucket's
+lifecycle configuration, scoped to the sink's prefix.  Any other rules in
+the bucket are left alone.  deepstyle s3_lifecycle puts the rule in place
+and reads it back to check it took.  Workers only check it's there when they
+start.
+*/
+
+// S3 won't move objects to infrequent access any sooner, or on from it
+// (eg to Glacier) until they've been there this long either
+const MinInfrequentAccessDays = 30
+
+type S3LifecyclePolicy struct {
+	InfrequentAccessDays int // Move to STANDARD_IA after this many days, 0 for never
+	GlacierDays          int // Move to GLACIER after this many days, 0 for never
+	ExpireDays           int // Delete after this many days, 0 for never
+}
+
+func (p S3LifecyclePolicy) IsZero() bool {
+	return p == S3LifecyclePolicy{}
+}
+
+func (p S3LifecyclePolicy) Validate() error {
+	if p.InfrequentAccessDays < 0 || p.GlacierDays < 0 || p.ExpireDays < 0 {
+		return fmt.Errorf("Lifecycle days can't be negative: %+v", p)
+	}
+	if p.InfrequentAccessDays > 0 && p.InfrequentAccessDays < MinInfrequentAccessDays {
+		return fmt.Errorf("S3 requires at least %v days before moving to infrequent access, got %v", MinInfrequentAccessDays, p.InfrequentAccessDays)
+	}
+	if p.InfrequentAccessDays > 0 && p.GlacierDays > 0 && p.GlacierDays < p.InfrequentAccessDays+MinInfrequentAccessDays {
+		return fmt.Errorf("S3 requires at least %v days in infrequent access before moving to Glacier, got glacier days %v after infrequent access days %v", MinInfrequentAccessDays, p.GlacierDays, p.InfrequentAccessDays)
+	}
+	if p.ExpireDays > 0 && (p.ExpireDays <= p.InfrequentAccessDays || p.ExpireDays <= p.GlacierDays) {
+		return fmt.Errorf("Expire days (%v) must be after the transitions", p.ExpireDays)
+	}
+	return nil
+}
+
+// Parse the ia_days, glacier_days and expire_days query params of a sink url
+func parseS3LifecyclePolicy(query url.Values) (S3LifecyclePolicy, error) {
+
+	policy := S3LifecyclePolicy{}
+	params := map[string]*int{
+		"ia_days":      &policy.InfrequentAccessDays,
+		"glacier_days": &policy.GlacierDays,
+		"expire_days":  &policy.ExpireDays,
+	}
+	for name, days := range params {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return policy, fmt.Errorf("Invalid %v: %v", name, value)
+		}
+		*days = parsed
+	}
+	return policy, policy.Validate()
+
+}
+
+func s3LifecycleRuleId(prefix string) string {
+	return fmt.Sprintf("deepstyle:%v", prefix)
+}
+
+func (p S3LifecyclePolicy) rule(prefix string) *s3.LifecycleRule {
+
+	rule := &s3.LifecycleRule{
+		ID:     aws.String(s3LifecycleRuleId(prefix)),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{Prefix: aws.String(prefix)},
+	}
+	if p.InfrequentAccessDays > 0 {
+		rule.Transitions = append(rule.Transitions, &s3.Transition{
+			Days:         aws.Int64(int64(p.InfrequentAccessDays)),
+			StorageClass: aws.String(s3.TransitionStorageClassStandardIa),
+		})
+	}
+	if p.GlacierDays > 0 {
+		rule.Transitions = append(rule.Transitions, &s3.Transition{
+			Days:         aws.Int64(int64(p.GlacierDays)),
+			StorageClass: aws.String(s3.TransitionStorageClassGlacier),
+		})
+	}
+	if p.ExpireDays > 0 {
+		rule.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(int64(p.ExpireDays))}
+	}
+	return rule
+
+}
+
+func lifecycleRulesEqual(a, b *s3.LifecycleRule) bool {
+
+	if aws.StringValue(a.ID) != aws.StringValue(b.ID) || aws.StringValue(a.Status) != aws.StringValue(b.Status) {
+		return false
+	}
+
+	prefixOf := func(rule *s3.LifecycleRule) string {
+		if rule.Filter != nil {
+			return aws.StringValue(rule.Filter.Prefix)
+		}
+		return aws.StringValue(rule.Prefix)
+	}
+	if prefixOf(a) != prefixOf(b) {
+		return false
+	}
+
+	if len(a.Transitions) != len(b.Transitions) {
+		return false
+	}
+	for i := range a.Transitions {
+		if aws.Int64Value(a.Transitions[i].Days) != aws.Int64Value(b.Transitions[i].Days) ||
+			aws.StringValue(a.Transitions[i].StorageClass) != aws.StringValue(b.Transitions[i].StorageClass) {
+			return false
+		}
+	}
+
+	expireDays := func(rule *s3.LifecycleRule) int64 {
+		if rule.Expiration == nil {
+			return 0
+		}
+		return aws.Int64Value(rule.Expiration.Days)
+	}
+	return expireDays(a) == expireDays(b)
+
+}
+
+// Put rule in place of the existing rule with the same id (or add it),
+// keeping the rest.  Returns whether anything changed.
+func mergeLifecycleRule(existing []*s3.LifecycleRule, rule *s3.LifecycleRule) (rules []*s3.LifecycleRule, changed bool) {
+
+	found := false
+	for _, existingRule := range existing {
+		if aws.StringValue(existingRule.ID) != aws.StringValue(rule.ID) {
+			rules = append(rules, existingRule)
+			continue
+		}
+		found = true
+		rules = append(rules, rule)
+		if !lifecycleRulesEqual(existingRule, rule) {
+			changed = true
+		}
+	}
+	if !found {
+		rules = append(rules, rule)
+		changed = true
+	}
+	return rules, changed
+
+}
+
+func getLifecycleRules(client *s3.S3, bucket string) ([]*s3.LifecycleRule, error) {
+	output, err := client.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoSuchLifecycleConfiguration" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return output.Rules, nil
+}
+
+// Put the policy's rule for prefix in the bucket's lifecycle configuration
+// if it isn't there already, then read it back to verify it.
+func EnsureS3LifecyclePolicy(bucket, prefix, region string, policy S3LifecyclePolicy) error {
+
+	client := s3.New(session.New(&aws.Config{Region: aws.String(region)}))
+	rule := policy.rule(prefix)
+
+	existing, err := getLifecycleRules(client, bucket)
+	if err != nil {
+		return fmt.Errorf("Error getting lifecycle configuration of %v: %v", bucket, err)
+	}
+
+	rules, changed := mergeLifecycleRule(existing, rule)
+	if !changed {
+		return nil
+	}
+
+	log.Printf("Setting lifecycle rule %v on %v: %+v", aws.StringValue(rule.ID), bucket, policy)
+	_, err = client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(bucket),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: rules},
+	})
+	if err != nil {
+		return fmt.Errorf("Error setting lifecycle configuration of %v: %v", bucket, err)
+	}
+
+	return VerifyS3LifecyclePolicy(bucket, prefix, region, policy)
+
+}
+
+// Check the bucket has the policy's rule for prefix
+func VerifyS3LifecyclePolicy(bucket, prefix, region string, policy S3LifecyclePolicy) error {
+
+	client := s3.New(session.New(&aws.Config{Region: aws.String(region)}))
+	rule := policy.rule(prefix)
+
+	rules, err := getLifecycleRules(client, bucket)
+	if err != nil {
+		return fmt.Errorf("Error getting lifecycle configuration of %v: %v", bucket, err)
+	}
+	for _, existingRule := range rules {
+		if lifecycleRulesEqual(existingRule, rule) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Lifecycle rule %v on %v doesn't match %+v", aws.StringValue(rule.ID), bucket, policy)
+
+}
+
+// Put the lifecycle policies of the S3 sinks that have one in place.  This
+// rewrites the bucket's whole lifecycle configuration, so it's done once by
+// an operator (deepstyle s3_lifecycle) rather than by every worker, which
+// would overwrite each other's rules when started together.
+func (sinks ResultSinks) EnsureLifecyclePolicies() error {
+	for name, sink := range sinks {
+		s3Sink, ok := sink.(s3ResultSink)
+		if !ok || s3Sink.lifecycle.IsZero() {
+			continue
+		}
+		if err := EnsureS3LifecyclePolicy(s3Sink.bucket, s3Sink.prefix, s3Sink.region, s3Sink.lifecycle); err != nil {
+			return fmt.Errorf("Result sink %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Check the lifecycle policies of the S3 sinks that have one, logging any
+// that are missing or can't be checked.  Workers only read the
+// configuration, so they don't need permission to change it.
+func (sinks ResultSinks) VerifyLifecyclePolicies() {
+	for name, sink := range sinks {
+		s3Sink, ok := sink.(s3ResultSink)
+		if !ok || s3Sink.lifecycle.IsZero() {
+			continue
+		}
+		if err := VerifyS3LifecyclePolicy(s3Sink.bucket, s3Sink.prefix, s3Sink.region, s3Sink.lifecycle); err != nil {
+			log.Printf("WARNING: Result sink %v: %v.  Run deepstyle s3_lifecycle to set it.", name, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package deepstylelib
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseS3LifecyclePolicy(t *testing.T) {
+
+	query, _ := url.ParseQuery("ia_days=30&glacier_days=90&expire_days=365")
+	policy, err := parseS3LifecyclePolicy(query)
+	assert.NoError(t, err)
+	assert.Equal(t, S3LifecyclePolicy{30, 90, 365}, policy)
+
+	policy, err = parseS3LifecyclePolicy(url.Values{})
+	assert.NoError(t, err)
+	assert.True(t, policy.IsZero())
+
+	for _, invalid := range []string{"ia_days=10", "ia_days=60&glacier_days=30", "ia_days=30&glacier_days=59", "glacier_days=90&expire_days=30", "expire_days=soon"} {
+		query, _ := url.ParseQuery(invalid)
+		_, err := parseS3LifecyclePolicy(query)
+		assert.Error(t, err, invalid)
+	}
+
+	// exactly the minimum time in infrequent access
+	query, _ = url.ParseQuery("ia_days=30&glacier_days=60")
+	_, err = parseS3LifecyclePolicy(query)
+	assert.NoError(t, err)
+
+	sink, err := NewResultSink("s3://bucket/results?glacier_days=90")
+	assert.NoError(t, err)
+	assert.Equal(t, 90, sink.(s3ResultSink).lifecycle.GlacierDays)
+
+}
+
+func TestMergeLifecycleRule(t *testing.T) {
+
+	otherRule := &s3.LifecycleRule{ID: aws.String("logs"), Status: aws.String("Enabled")}
+	policy := S3LifecyclePolicy{InfrequentAccessDays: 30, ExpireDays: 365}
+
+	rules, changed := mergeLifecycleRule([]*s3.LifecycleRule{otherRule}, policy.rule("results"))
+	assert.True(t, changed)
+	assert.Equal(t, 2, len(rules))
+
+	// already in place
+	rules, changed = mergeLifecycleRule(rules, policy.rule("results"))
+	assert.False(t, changed)
+	assert.Equal(t, 2, len(rules))
+
+	// policy changed, the rule is replaced and the other one kept
+	policy.ExpireDays = 180
+	rules, changed = mergeLifecycleRule(rules, policy.rule("results"))
+	assert.True(t, changed)
+	assert.Equal(t, 2, len(rules))
+	assert.Equal(t, "logs", aws.StringValue(rules[0].ID))
+	assert.Equal(t, int64(180), aws.Int64Value(rules[1].Expiration.Days))
+
+}
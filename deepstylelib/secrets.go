@@ -0,0 +1,215 @@
+package deepstylelib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+/*
+Configuration values can be secret references of the form <provider>:<ref>
+instead of plaintext values, for example:
+
+    env:SG_URL
+    file:/run/secrets/uniqush_url
+    vault:secret/data/deepstyle#sync_gateway_url
+    awssm:deepstyle/prod#sync_gateway_url
+    awssm:deepstyle/prod?region=eu-west-1#sync_gateway_url
+
+Anything that doesn't start with a registered provider name is used as-is.
+*/
+
+// A SecretProvider resolves the part of a secret reference after the
+// "<provider>:" prefix into the secret value.
+type SecretProvider interface {
+	Resolve(ref string) (string, error)
+}
+
+var secretProviders = map[string]SecretProvider{
+	"env":   envSecretProvider{},
+	"file":  fileSecretProvider{},
+	"vault": vaultSecretProvider{},
+	"awssm": awsSecretsManagerProvider{},
+}
+
+// Register an additional secret provider, or replace one of the builtin ones.
+func RegisterSecretProvider(name string, provider SecretProvider) {
+	secretProviders[name] = provider
+}
+
+func splitSecretReference(value string) (provider SecretProvider, ref string, ok bool) {
+	i := strings.Index(value, ":")
+	if i <= 0 {
+		return nil, "", false
+	}
+	provider, ok = secretProviders[value[:i]]
+	return provider, value[i+1:], ok
+}
+
+func IsSecretReference(value string) bool {
+	_, _, ok := splitSecretReference(value)
+	return ok
+}
+
+// Resolve a configuration value that might be a secret reference.
+func ResolveSecret(value string) (string, error) {
+	provider, ref, ok := splitSecretReference(value)
+	if !ok {
+		return value, nil
+	}
+	secret, err := provider.Resolve(ref)
+	if err != nil {
+		// don't include the secret, but the reference is fine to log
+		return "", fmt.Errorf("Error resolving secret %v: %v", value, err)
+	}
+	return secret, nil
+}
+
+// Secrets stored as JSON objects can be narrowed down to a single
+// field with a "#field" suffix on the reference.
+func splitSecretField(ref string) (name, field string) {
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func secretField(fields map[string]interface{}, field string) (string, error) {
+	value, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("No field named %v", field)
+	}
+	valueStr, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("Field %v is a %T, expected a string", field, value)
+	}
+	return valueStr, nil
+}
+
+type envSecretProvider struct{}
+
+func (p envSecretProvider) Resolve(ref string) (string, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("Environment variable %v is not set", ref)
+	}
+	return value, nil
+}
+
+type fileSecretProvider struct{}
+
+func (p fileSecretProvider) Resolve(ref string) (string, error) {
+	contents, err := ioutil.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// Reads from Vault's HTTP api using VAULT_ADDR and VAULT_TOKEN.  Works with
+// both v1 and v2 of the KV secrets engine.
+type vaultSecretProvider struct{}
+
+func (p vaultSecretProvider) Resolve(ref string) (string, error) {
+
+	path, field := splitSecretField(ref)
+	if field == "" {
+		return "", fmt.Errorf("Vault references need a #field suffix")
+	}
+
+	vaultAddr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if vaultAddr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v/v1/%v", vaultAddr, path), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("Unexpected status code from vault: %v", resp.StatusCode)
+	}
+
+	secret := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+
+	// KV v2 nests the actual secret under data.data
+	if nested, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, hasMetadata := secret.Data["metadata"]; hasMetadata {
+			return secretField(nested, field)
+		}
+	}
+	return secretField(secret.Data, field)
+
+}
+
+// Reads from AWS Secrets Manager.  AWS keys will be taken from environment
+// variables or ~/.aws/, same as the CloudWatch metrics.  The region is the
+// one in the secret's ARN or a ?region= suffix, otherwise AWS_REGION (or
+// us-east-1 if that isn't set either).
+type awsSecretsManagerProvider struct{}
+
+// Split the region off a secret id, eg deepstyle/prod?region=eu-west-1 or
+// arn:aws:secretsmanager:eu-west-1:123456789012:secret:deepstyle/prod
+func awsSecretRegion(secretId string) (id, region string) {
+	if i := strings.Index(secretId, "?region="); i >= 0 {
+		return secretId[:i], secretId[i+len("?region="):]
+	}
+	if arnParts := strings.Split(secretId, ":"); len(arnParts) > 3 && arnParts[0] == "arn" {
+		return secretId, arnParts[3]
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return secretId, region
+	}
+	return secretId, "us-east-1"
+}
+
+func (p awsSecretsManagerProvider) Resolve(ref string) (string, error) {
+
+	secretId, field := splitSecretField(ref)
+	secretId, region := awsSecretRegion(secretId)
+
+	svc := secretsmanager.New(session.New(), &aws.Config{Region: aws.String(region)})
+	output, err := svc.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretId),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	secretString := aws.StringValue(output.SecretString)
+	if secretString == "" {
+		secretString = string(output.SecretBinary)
+	}
+	if field == "" {
+		return secretString, nil
+	}
+
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(secretString), &fields); err != nil {
+		return "", fmt.Errorf("Secret is not a JSON object, cannot get field %v", field)
+	}
+	return secretField(fields, field)
+
+}
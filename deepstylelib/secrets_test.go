@@ -0,0 +1,59 @@
+package deepstylelib
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveSecret(t *testing.T) {
+
+	// plain values and urls are passed through untouched
+	value, err := ResolveSecret("http://localhost:4985/deepstyle")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:4985/deepstyle", value)
+
+	os.Setenv("DEEPSTYLE_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("DEEPSTYLE_TEST_SECRET")
+	value, err = ResolveSecret("env:DEEPSTYLE_TEST_SECRET")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", value)
+
+	_, err = ResolveSecret("env:DEEPSTYLE_TEST_SECRET_MISSING")
+	assert.Error(t, err)
+
+	f, err := ioutil.TempFile("", "deepstyle_secret")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("from-file\n")
+	f.Close()
+	value, err = ResolveSecret("file:" + f.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "from-file", value)
+
+}
+
+func TestAwsSecretRegion(t *testing.T) {
+
+	t.Setenv("AWS_REGION", "ap-southeast-2")
+
+	id, region := awsSecretRegion("deepstyle/prod?region=eu-west-1")
+	assert.Equal(t, "deepstyle/prod", id)
+	assert.Equal(t, "eu-west-1", region)
+
+	arn := "arn:aws:secretsmanager:us-west-2:123456789012:secret:deepstyle/prod-AbCdEf"
+	id, region = awsSecretRegion(arn)
+	assert.Equal(t, arn, id)
+	assert.Equal(t, "us-west-2", region)
+
+	id, region = awsSecretRegion("deepstyle/prod")
+	assert.Equal(t, "deepstyle/prod", id)
+	assert.Equal(t, "ap-southeast-2", region)
+
+	t.Setenv("AWS_REGION", "")
+	_, region = awsSecretRegion("deepstyle/prod")
+	assert.Equal(t, "us-east-1", region)
+
+}
@@ -0,0 +1,247 @@
+package deepstylelib
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+/*
+Documents are stored as json with snake_case field names by default.
+Deployments whose sync function expects something else can register hooks
+that rewrite the top level fields of every document on its way to Sync
+Gateway (marshal) and back (unmarshal), eg:
+
+	RegisterDocumentHooks(CamelCaseFieldNameHooks())
+	RegisterDocumentHooks(EnvelopeHooks(map[string]interface{}{"app": "deepstyle"}))
+
+Marshal hooks run in the order they were registered and unmarshal hooks in
+the reverse order.  Fields starting with _ (_id, _rev, _attachments) belong
+to Sync Gateway and should be left alone.  The views deepstyle installs use
+storedFieldName to follow the hooks, but the sync function has to be updated
+to match by hand.
+*/
+type DocumentHook func(fields map[string]json.RawMessage) error
+
+var (
+	marshalHooks      []DocumentHook
+	unmarshalHooks    []DocumentHook
+	documentHookMutex sync.RWMutex
+)
+
+// Register a marshal hook and the unmarshal hook that undoes it (either can be nil)
+func RegisterDocumentHooks(marshal, unmarshal DocumentHook) {
+	documentHookMutex.Lock()
+	defer documentHookMutex.Unlock()
+	if marshal != nil {
+		marshalHooks = append(marshalHooks, marshal)
+	}
+	if unmarshal != nil {
+		unmarshalHooks = append([]DocumentHook{unmarshal}, unmarshalHooks...)
+	}
+}
+
+func resetDocumentHooks() {
+	documentHookMutex.Lock()
+	defer documentHookMutex.Unlock()
+	marshalHooks = nil
+	unmarshalHooks = nil
+}
+
+func runDocumentHooks(hooks []DocumentHook, data []byte) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for _, hook := range hooks {
+		if err := hook(fields); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// The name a top level field is stored under once the marshal hooks have
+// run, for views that read the stored json.  Returns name if the hooks drop
+// the field.
+func storedFieldName(name string) string {
+
+	documentHookMutex.RLock()
+	hooks := marshalHooks
+	documentHookMutex.RUnlock()
+
+	// follow a placeholder value through the hooks
+	const placeholder = `"deepstyle:stored-field-name"`
+	fields := map[string]json.RawMessage{name: json.RawMessage(placeholder)}
+	for _, hook := range hooks {
+		if err := hook(fields); err != nil {
+			return name
+		}
+	}
+	for storedName, value := range fields {
+		if string(value) == placeholder {
+			return storedName
+		}
+	}
+	return name
+
+}
+
+// Marshal a document, v must be a type without a MarshalJSON method (eg,
+// an alias of the document type) to avoid recursing.
+func marshalDocument(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	documentHookMutex.RLock()
+	defer documentHookMutex.RUnlock()
+	if len(marshalHooks) == 0 {
+		return data, nil
+	}
+	return runDocumentHooks(marshalHooks, data)
+}
+
+// The counterpart of marshalDocument
+func unmarshalDocument(data []byte, v interface{}) error {
+	documentHookMutex.RLock()
+	hooks := unmarshalHooks
+	documentHookMutex.RUnlock()
+	if len(hooks) > 0 {
+		var err error
+		if data, err = runDocumentHooks(hooks, data); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (doc JobDocument) MarshalJSON() ([]byte, error) {
+	type plain JobDocument
+	return marshalDocument(plain(doc))
+}
+
+func (doc *JobDocument) UnmarshalJSON(data []byte) error {
+	type plain JobDocument
+	return unmarshalDocument(data, (*plain)(doc))
+}
+
+func (logDoc JobLogDocument) MarshalJSON() ([]byte, error) {
+	type plain JobLogDocument
+	return marshalDocument(plain(logDoc))
+}
+
+func (logDoc *JobLogDocument) UnmarshalJSON(data []byte) error {
+	type plain JobLogDocument
+	return unmarshalDocument(data, (*plain)(logDoc))
+}
+
+func (auditDoc AuditDocument) MarshalJSON() ([]byte, error) {
+	type plain AuditDocument
+	return marshalDocument(plain(auditDoc))
+}
+
+func (auditDoc *AuditDocument) UnmarshalJSON(data []byte) error {
+	type plain AuditDocument
+	return unmarshalDocument(data, (*plain)(auditDoc))
+}
+
+func (r WorkerRolloutDocument) MarshalJSON() ([]byte, error) {
+	type plain WorkerRolloutDocument
+	return marshalDocument(plain(r))
+}
+
+func (r *WorkerRolloutDocument) UnmarshalJSON(data []byte) error {
+	type plain WorkerRolloutDocument
+	return unmarshalDocument(data, (*plain)(r))
+}
+
+func (c WorkerCapacityDocument) MarshalJSON() ([]byte, error) {
+	type plain WorkerCapacityDocument
+	return marshalDocument(plain(c))
+}
+
+func (c *WorkerCapacityDocument) UnmarshalJSON(data []byte) error {
+	type plain WorkerCapacityDocument
+	return unmarshalDocument(data, (*plain)(c))
+}
+
+// Hooks that rename the top level fields (except the _ ones), rename on the
+// way out and unrename on the way back in.
+func FieldNameHooks(rename, unrename func(string) string) (marshal, unmarshal DocumentHook) {
+	renameFields := func(convert func(string) string) DocumentHook {
+		return func(fields map[string]json.RawMessage) error {
+			renamed := map[string]json.RawMessage{}
+			for name, value := range fields {
+				if strings.HasPrefix(name, "_") {
+					continue
+				}
+				delete(fields, name)
+				renamed[convert(name)] = value
+			}
+			for name, value := range renamed {
+				fields[name] = value
+			}
+			return nil
+		}
+	}
+	return renameFields(rename), renameFields(unrename)
+}
+
+// Store fields as camelCase, eg owner_devicetoken as ownerDevicetoken
+func CamelCaseFieldNameHooks() (marshal, unmarshal DocumentHook) {
+	return FieldNameHooks(snakeToCamelCase, camelToSnakeCase)
+}
+
+func snakeToCamelCase(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func camelToSnakeCase(name string) string {
+	var converted strings.Builder
+	for _, r := range name {
+		if unicode.IsUpper(r) {
+			converted.WriteRune('_')
+			r = unicode.ToLower(r)
+		}
+		converted.WriteRune(r)
+	}
+	return converted.String()
+}
+
+// Hooks that add fixed fields to every document, eg ones the sync function
+// requires, and strip them when reading documents back.
+func EnvelopeHooks(envelope map[string]interface{}) (marshal, unmarshal DocumentHook) {
+
+	marshal = func(fields map[string]json.RawMessage) error {
+		for name, value := range envelope {
+			if _, ok := fields[name]; ok {
+				return fmt.Errorf("Envelope field %v clashes with a document field", name)
+			}
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			fields[name] = encoded
+		}
+		return nil
+	}
+
+	unmarshal = func(fields map[string]json.RawMessage) error {
+		for name := range envelope {
+			delete(fields, name)
+		}
+		return nil
+	}
+
+	return marshal, unmarshal
+
+}
@@ -0,0 +1,75 @@
+package deepstylelib
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDocumentHooks(t *testing.T) {
+
+	defer resetDocumentHooks()
+	RegisterDocumentHooks(CamelCaseFieldNameHooks())
+	RegisterDocumentHooks(EnvelopeHooks(map[string]interface{}{"app": "deepstyle"}))
+
+	jobDoc := JobDocument{
+		Owner:            "foo@bar.com",
+		OwnerDeviceToken: "abc",
+		State:            StateReadyToProcess,
+	}
+	jobDoc.Id = "job1"
+	jobDoc.Revision = "1-abc"
+	jobDoc.Type = Job
+
+	data, err := json.Marshal(jobDoc)
+	assert.NoError(t, err)
+
+	fields := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(data, &fields))
+	assert.Equal(t, "abc", fields["ownerDevicetoken"])
+	assert.Equal(t, "deepstyle", fields["app"])
+	assert.Equal(t, "job1", fields["_id"])
+	_, ok := fields["owner_devicetoken"]
+	assert.False(t, ok)
+
+	// and back again
+	decoded := JobDocument{}
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.True(t, decoded.IsJob())
+	assert.Equal(t, "abc", decoded.OwnerDeviceToken)
+	assert.Equal(t, "1-abc", decoded.Revision)
+
+}
+
+func TestDocumentWithoutHooks(t *testing.T) {
+
+	logDoc := JobLogDocument{JobId: "job1", Offset: 10}
+	data, err := json.Marshal(logDoc)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"job_id":"job1"`)
+
+	decoded := JobLogDocument{}
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, logDoc, decoded)
+
+}
+
+func TestFieldNameConversion(t *testing.T) {
+	assert.Equal(t, "resultManifest", snakeToCamelCase("result_manifest"))
+	assert.Equal(t, "result_manifest", camelToSnakeCase("resultManifest"))
+	assert.Equal(t, "state", camelToSnakeCase(snakeToCamelCase("state")))
+}
+
+func TestStoredFieldName(t *testing.T) {
+
+	assert.Equal(t, "job_id", storedFieldName("job_id"))
+
+	defer resetDocumentHooks()
+	RegisterDocumentHooks(CamelCaseFieldNameHooks())
+	RegisterDocumentHooks(EnvelopeHooks(map[string]interface{}{"app": "deepstyle"}))
+
+	assert.Equal(t, "jobId", storedFieldName("job_id"))
+	assert.Equal(t, "type", storedFieldName("type"))
+
+}
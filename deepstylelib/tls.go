@@ -0,0 +1,240 @@
+package deepstylelib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig describes the certificates used for mutual TLS.  The certificate
+// and key are re-read from disk whenever either file changes, so they can be
+// rotated without restarting the process.  Each field can also be a secret
+// reference (see secrets.go) that resolves to PEM data, in which case it
+// is loaded once.
+type TLSConfig struct {
+	CertFile string // Certificate presented to the other side
+	KeyFile  string // Private key for CertFile
+	CAFile   string // CA bundle used to verify the other side
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.CAFile != ""
+}
+
+// Keeps the most recently loaded certificate and reloads it when the
+// files on disk have a newer modification time.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := reloader.maybeReload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (r *certReloader) maybeReload() error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	modTime := time.Time{}
+	for _, filename := range []string{r.certFile, r.keyFile} {
+		fileInfo, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		if fileInfo.ModTime().After(modTime) {
+			modTime = fileInfo.ModTime()
+		}
+	}
+
+	if r.cert != nil && !modTime.After(r.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading key pair %v / %v: %v", r.certFile, r.keyFile, err)
+	}
+	if r.cert != nil {
+		log.Printf("Reloaded TLS certificate from %v", r.certFile)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+
+}
+
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+
+	if err := r.maybeReload(); err != nil {
+		// keep serving the last good certificate, a rotation may be
+		// in progress and the files only partially written.
+		log.Printf("Error reloading TLS certificate, using previous one: %v", err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.cert, nil
+
+}
+
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+func readFileOrSecret(value string) ([]byte, error) {
+	if IsSecretReference(value) {
+		secret, err := ResolveSecret(value)
+		return []byte(secret), err
+	}
+	return ioutil.ReadFile(value)
+}
+
+func loadKeyPair(certFile, keyFile string) (func(*tls.CertificateRequestInfo) (*tls.Certificate, error), error) {
+
+	if !IsSecretReference(certFile) && !IsSecretReference(keyFile) {
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return reloader.GetClientCertificate, nil
+	}
+
+	certPEM, err := readFileOrSecret(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := readFileOrSecret(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading key pair %v / %v: %v", certFile, keyFile, err)
+	}
+	return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &cert, nil
+	}, nil
+
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+
+	caBytes, err := readFileOrSecret(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("No certificates found in CA file: %v", caFile)
+	}
+	return pool, nil
+
+}
+
+// Build a tls.Config for outgoing connections (eg, worker -> Sync Gateway)
+func NewClientTLSConfig(config TLSConfig) (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, fmt.Errorf("Both a TLS certificate and key are required")
+		}
+		getClientCertificate, err := loadKeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = getClientCertificate
+	}
+
+	if config.CAFile != "" {
+		pool, err := loadCertPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+
+}
+
+// Build a tls.Config for serving (eg, the API).  If a CA is given, clients
+// must present a certificate signed by it.
+func NewServerTLSConfig(config TLSConfig) (*tls.Config, error) {
+
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, fmt.Errorf("Both a TLS certificate and key are required")
+	}
+	if IsSecretReference(config.CertFile) || IsSecretReference(config.KeyFile) {
+		return nil, fmt.Errorf("Server certificates must be files so they can be reloaded")
+	}
+
+	reloader, err := newCertReloader(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.CAFile != "" {
+		pool, err := loadCertPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+
+}
+
+// Install the TLS config on the default http transport, which is used by
+// go-couch as well as the raw http requests made against Sync Gateway.
+func ConfigureTLS(config TLSConfig) error {
+
+	if !config.Enabled() {
+		return nil
+	}
+
+	tlsConfig, err := NewClientTLSConfig(config)
+	if err != nil {
+		return err
+	}
+
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("Unexpected default transport type: %T", http.DefaultTransport)
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	log.Printf("Configured mutual TLS using cert: %v", config.CertFile)
+
+	return nil
+
+}
@@ -0,0 +1,276 @@
+package deepstylelib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A throwaway CA that issues certificates into dir
+type testCA struct {
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	issued int
+}
+
+func newTestCA(t *testing.T) *testCA {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "deepstyle test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ca := &testCA{dir: t.TempDir(), cert: cert, key: key}
+	writePEM(t, ca.path("ca.pem"), "CERTIFICATE", der)
+	return ca
+
+}
+
+func (ca *testCA) path(name string) string {
+	return filepath.Join(ca.dir, name)
+}
+
+// Issue a certificate for commonName (valid for 127.0.0.1) and write it and
+// its key to <name>.pem and <name>.key, returning their paths
+func (ca *testCA) issue(t *testing.T, name, commonName string) (certFile, keyFile string) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	serialNumber, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	certFile, keyFile = ca.path(name+".pem"), ca.path(name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+
+	// make sure a rotation is newer, whatever the file system's mtime
+	// granularity
+	ca.issued++
+	modTime := time.Now().Add(time.Duration(ca.issued) * time.Minute)
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	return certFile, keyFile
+
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+// A server requiring client certificates from ca, which responds with the
+// common name of the client's certificate
+func newMutualTLSServer(t *testing.T, ca *testCA) *httptest.Server {
+
+	certFile, keyFile := ca.issue(t, "server", "server")
+	serverTLSConfig, err := NewServerTLSConfig(TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: ca.path("ca.pem")})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	// not StartTLS, its own certificate would take precedence over
+	// GetCertificate
+	server.Listener = tls.NewListener(server.Listener, serverTLSConfig)
+	server.Start()
+	server.URL = "https://" + server.Listener.Addr().String()
+	t.Cleanup(server.Close)
+	return server
+
+}
+
+// GET url on a new connection, so there's a new handshake
+func tlsGet(tlsConfig *tls.Config, url string) (body string, resp *http.Response, err error) {
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true},
+	}
+	resp, err = client.Get(url)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	return string(bodyBytes), resp, err
+}
+
+func TestMutualTLSRotation(t *testing.T) {
+
+	ca := newTestCA(t)
+	server := newMutualTLSServer(t, ca)
+
+	certFile, keyFile := ca.issue(t, "client", "worker1")
+	clientTLSConfig, err := NewClientTLSConfig(TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: ca.path("ca.pem")})
+	assert.NoError(t, err)
+
+	body, _, err := tlsGet(clientTLSConfig, server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "worker1", body)
+
+	// the client cert is rotated, the next handshake picks it up
+	ca.issue(t, "client", "worker1-rotated")
+	body, _, err = tlsGet(clientTLSConfig, server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "worker1-rotated", body)
+
+	// and so is the server's
+	ca.issue(t, "server", "server-rotated")
+	_, resp, err := tlsGet(clientTLSConfig, server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "server-rotated", resp.TLS.PeerCertificates[0].Subject.CommonName)
+
+	// a half written rotation keeps the previous cert
+	assert.NoError(t, ioutil.WriteFile(certFile, []byte("-----BEGIN CERTIFICATE-----\n"), 0600))
+	future := time.Now().Add(time.Hour)
+	assert.NoError(t, os.Chtimes(certFile, future, future))
+	body, _, err = tlsGet(clientTLSConfig, server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "worker1-rotated", body)
+
+	// without a client cert the server turns it away
+	noClientCert, err := NewClientTLSConfig(TLSConfig{CAFile: ca.path("ca.pem")})
+	assert.NoError(t, err)
+	_, _, err = tlsGet(noClientCert, server.URL)
+	assert.Error(t, err)
+
+	// nor does the client trust a server it has no CA for
+	_, _, err = tlsGet(&tls.Config{}, server.URL)
+	assert.Error(t, err)
+
+}
+
+func TestNewClientTLSConfig(t *testing.T) {
+
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "client", "worker1")
+
+	_, err := NewClientTLSConfig(TLSConfig{CertFile: certFile})
+	assert.Error(t, err)
+
+	_, err = NewClientTLSConfig(TLSConfig{CertFile: certFile, KeyFile: ca.path("missing.key")})
+	assert.Error(t, err)
+
+	// a CA file with no certificates in it
+	_, err = NewClientTLSConfig(TLSConfig{CAFile: keyFile})
+	assert.Error(t, err)
+
+	// PEM from secret references is loaded once
+	certPEM, _ := ioutil.ReadFile(certFile)
+	keyPEM, _ := ioutil.ReadFile(keyFile)
+	t.Setenv("DEEPSTYLE_TEST_TLS_CERT", string(certPEM))
+	t.Setenv("DEEPSTYLE_TEST_TLS_KEY", string(keyPEM))
+	clientTLSConfig, err := NewClientTLSConfig(TLSConfig{CertFile: "env:DEEPSTYLE_TEST_TLS_CERT", KeyFile: "env:DEEPSTYLE_TEST_TLS_KEY"})
+	assert.NoError(t, err)
+	cert, err := clientTLSConfig.GetClientCertificate(nil)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "worker1", leaf.Subject.CommonName)
+
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "server", "server")
+
+	_, err := NewServerTLSConfig(TLSConfig{CertFile: certFile})
+	assert.Error(t, err)
+
+	// can't be reloaded
+	_, err = NewServerTLSConfig(TLSConfig{CertFile: "env:DEEPSTYLE_TEST_TLS_CERT", KeyFile: keyFile})
+	assert.Error(t, err)
+
+	// without a CA, client certs aren't required
+	serverTLSConfig, err := NewServerTLSConfig(TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	assert.NoError(t, err)
+	assert.Equal(t, tls.NoClientCert, serverTLSConfig.ClientAuth)
+
+	serverTLSConfig, err = NewServerTLSConfig(TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: ca.path("ca.pem")})
+	assert.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, serverTLSConfig.ClientAuth)
+
+}
+
+func TestConfigureTLS(t *testing.T) {
+
+	transport := http.DefaultTransport.(*http.Transport)
+	defaultTLSClientConfig := transport.TLSClientConfig
+	defer func() { transport.TLSClientConfig = defaultTLSClientConfig }()
+
+	// nothing to configure
+	assert.NoError(t, ConfigureTLS(TLSConfig{}))
+	assert.Equal(t, defaultTLSClientConfig, transport.TLSClientConfig)
+
+	ca := newTestCA(t)
+	server := newMutualTLSServer(t, ca)
+	certFile, keyFile := ca.issue(t, "client", "worker1")
+	assert.NoError(t, ConfigureTLS(TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: ca.path("ca.pem")}))
+
+	// as go-couch and the raw requests to Sync Gateway would make it
+	transport.CloseIdleConnections()
+	resp, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "worker1", string(body))
+
+}
@@ -1,6 +1,8 @@
 package deepstylelib
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"net/url"
 	"os"
@@ -25,6 +27,28 @@ func GetDbConnection(syncGatewayUrl string) (db couch.Database, err error) {
 
 }
 
+// Workers are identified by hostname
+func defaultWorkerId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+func sha256File(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 func writeToFile(reader io.Reader, destFilename string) error {
 
 	destFile, err := os.Create(destFilename)
@@ -52,6 +76,19 @@ func hasGPU() bool {
 	return true
 }
 
+// Jetson (Tegra) devices don't ship nvidia-smi
+func hasTegraGPU() bool {
+	_, err := os.Stat("/etc/nv_tegra_release")
+	return err == nil
+}
+
+func homeDir() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return home
+	}
+	return "."
+}
+
 func torchInstalled() bool {
 
 	cmd := exec.Command("th", "--help")
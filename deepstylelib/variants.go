@@ -0,0 +1,178 @@
+package deepstylelib
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/image/draw"
+)
+
+// Result variants, the full size one is the result_image attachment
+const (
+	VariantFull      = "full"
+	VariantMedium    = "medium"
+	VariantThumbnail = "thumbnail"
+)
+
+// Max width/height of the resized variants
+var resultVariantSizes = map[string]int{
+	VariantMedium:    1024,
+	VariantThumbnail: 256,
+}
+
+// Describes one of the result variant attachments in the result_manifest
+type ResultVariantInfo struct {
+	Attachment  string `json:"attachment"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ContentType string `json:"content_type"`
+}
+
+func IsValidResultVariant(variant string) bool {
+	_, ok := resultVariantSizes[variant]
+	return ok || variant == VariantFull
+}
+
+func resultVariantAttachment(variant string) string {
+	if variant == VariantFull {
+		return ResultImageAttachment
+	}
+	return fmt.Sprintf("%v_%v", ResultImageAttachment, variant)
+}
+
+// The variants to produce for a job: the ones listed in the job doc, otherwise
+// the ones configured for the deployment.
+func resultVariantsForJob(jobDoc JobDocument, defaultVariants []string) []string {
+	if len(jobDoc.ResultVariants) > 0 {
+		return jobDoc.ResultVariants
+	}
+	return defaultVariants
+}
+
+func imageSize(imagePath string) (width, height int, err error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	imageConfig, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return imageConfig.Width, imageConfig.Height, nil
+}
+
+func scaleImage(src image.Image, width, height int) image.Image {
+	dest := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dest, dest.Bounds(), src, src.Bounds(), draw.Over, nil)
+	return dest
+}
+
+// Scale an image down (never up) so that it fits in maxDimension x maxDimension
+func resizeImage(srcPath, destPath string, maxDimension int) (width, height int, err error) {
+
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer srcFile.Close()
+
+	src, _, err := image.Decode(srcFile)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	bounds := src.Bounds()
+	width, height = bounds.Dx(), bounds.Dy()
+	if width > maxDimension || height > maxDimension {
+		if width >= height {
+			height = height * maxDimension / width
+			width = maxDimension
+		} else {
+			width = width * maxDimension / height
+			height = maxDimension
+		}
+	}
+	// very narrow images would otherwise round down to nothing
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	dest := scaleImage(src, width, height)
+	return width, height, writeJpeg(destPath, dest)
+
+}
+
+func writeJpeg(destPath string, img image.Image) error {
+	destFile, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(destFile, img, &jpeg.Options{Quality: 90}); err != nil {
+		destFile.Close()
+		return err
+	}
+	return destFile.Close()
+}
+
+// Generate and attach the resized variants of the result, and record them
+// all (including the full size result) in the result_manifest.
+func (d DeepStyleJob) attachResultVariants(jobDoc *JobDocument, outputFilePath string, variants []string) error {
+
+	manifest := map[string]ResultVariantInfo{}
+
+	for _, variant := range variants {
+
+		if !IsValidResultVariant(variant) {
+			log.Printf("Job %v: ignoring unknown result variant %v", jobDoc.Id, variant)
+			continue
+		}
+
+		attachmentName := resultVariantAttachment(variant)
+		info := ResultVariantInfo{
+			Attachment:  attachmentName,
+			ContentType: "image/jpeg",
+		}
+
+		if variant == VariantFull {
+			// already attached
+			width, height, err := imageSize(outputFilePath)
+			if err != nil {
+				return err
+			}
+			info.Width, info.Height = width, height
+			manifest[variant] = info
+			continue
+		}
+
+		variantFilePath := filepath.Join(
+			d.config.TempDir,
+			fmt.Sprintf("%v_%v.jpg", jobDoc.Id, attachmentName),
+		)
+		width, height, err := resizeImage(outputFilePath, variantFilePath, resultVariantSizes[variant])
+		if err != nil {
+			return fmt.Errorf("Error resizing result to %v: %v", variant, err)
+		}
+		if err := jobDoc.AddAttachment(attachmentName, variantFilePath); err != nil {
+			return err
+		}
+		info.Width, info.Height = width, height
+		manifest[variant] = info
+
+	}
+
+	if len(manifest) == 0 {
+		return nil
+	}
+	_, err := jobDoc.SetResultManifest(manifest)
+	return err
+
+}
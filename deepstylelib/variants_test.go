@@ -0,0 +1,76 @@
+package deepstylelib
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResizeImage(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "deepstyle-variants-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name                          string
+		width, height                 int
+		maxDimension                  int
+		expectedWidth, expectedHeight int
+	}{
+		{"portrait", 600, 1200, 256, 128, 256},
+		{"landscape", 1200, 600, 256, 256, 128},
+		{"square", 1000, 1000, 256, 256, 256},
+		{"already_under_the_max", 200, 100, 256, 200, 100},
+		{"exactly_the_max", 256, 100, 256, 256, 100},
+		{"very_wide", 3000, 2, 256, 256, 1},
+		{"very_tall", 2, 3000, 256, 1, 256},
+	}
+
+	for _, test := range tests {
+		srcPath := filepath.Join(dir, test.name+".png")
+		f, err := os.Create(srcPath)
+		assert.NoError(t, err)
+		assert.NoError(t, png.Encode(f, image.NewRGBA(image.Rect(0, 0, test.width, test.height))))
+		f.Close()
+
+		destPath := filepath.Join(dir, test.name+".jpg")
+		width, height, err := resizeImage(srcPath, destPath, test.maxDimension)
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, test.expectedWidth, width, test.name)
+		assert.Equal(t, test.expectedHeight, height, test.name)
+
+		// and that's what was written
+		width, height, err = imageSize(destPath)
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, test.expectedWidth, width, test.name)
+		assert.Equal(t, test.expectedHeight, height, test.name)
+	}
+
+}
+
+func TestResultVariantsForJob(t *testing.T) {
+
+	workerDefault := []string{VariantFull, VariantMedium}
+
+	tests := []struct {
+		name     string
+		variants []string
+		expected []string
+	}{
+		{"job_variants", []string{VariantThumbnail}, []string{VariantThumbnail}},
+		{"no_job_variants", nil, workerDefault},
+		{"empty_job_variants", []string{}, workerDefault},
+	}
+
+	for _, test := range tests {
+		jobDoc := JobDocument{ResultVariants: test.variants}
+		assert.Equal(t, test.expected, resultVariantsForJob(jobDoc, workerDefault), test.name)
+	}
+
+}
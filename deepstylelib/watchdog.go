@@ -0,0 +1,123 @@
+package deepstylelib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// A job that hangs this many times is marked as failed rather
+	// than being retried on another worker.
+	MaxHangRetries = 3
+
+	// How long a worker leaves a job that hung on it for other workers
+	// before trying it again itself.
+	HangRetryCooldown = 30 * time.Minute
+
+	// How long to wait for the engine's output to close once it's been
+	// killed, in case something outside its process group has it open.
+	processGroupWaitDelay = 10 * time.Second
+)
+
+// Returned when the engine was killed for not making any progress
+type EngineHungError struct {
+	Timeout time.Duration
+}
+
+func (e EngineHungError) Error() string {
+	return fmt.Sprintf("Engine produced no output for %v and was killed", e.Timeout)
+}
+
+func isEngineHung(err error) bool {
+	_, ok := err.(EngineHungError)
+	return ok
+}
+
+// Passes output through while keeping track of when the engine last wrote
+// anything.  Torch prints progress every few iterations, so silence means
+// the process is stuck (typically holding on to the GPU).
+type watchdog struct {
+	output       io.Writer
+	timeout      time.Duration
+	mutex        sync.Mutex
+	lastActivity time.Time
+	hung         bool
+}
+
+func (w *watchdog) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	w.lastActivity = time.Now()
+	w.mutex.Unlock()
+	return w.output.Write(p)
+}
+
+func (w *watchdog) watch(cancel context.CancelFunc, done <-chan struct{}) {
+
+	checkInterval := w.timeout / 10
+	if checkInterval < time.Second {
+		checkInterval = time.Second
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			w.mutex.Lock()
+			idle := time.Since(w.lastActivity)
+			if idle >= w.timeout {
+				w.hung = true
+			}
+			hung := w.hung
+			w.mutex.Unlock()
+			if hung {
+				log.Printf("Engine idle for %v, killing it", idle)
+				cancel()
+				return
+			}
+		}
+	}
+
+}
+
+func (w *watchdog) isHung() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.hung
+}
+
+// Run the engine until ctx is done, killing it if it goes hangTimeout without
+// writing any output.  A hangTimeout of 0 disables the watchdog.
+func runWithWatchdog(ctx context.Context, engine Engine, params EngineParams, output io.Writer, hangTimeout time.Duration) error {
+
+	if hangTimeout <= 0 {
+		return engine.Run(ctx, params, output)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := &watchdog{
+		output:       output,
+		timeout:      hangTimeout,
+		lastActivity: time.Now(),
+	}
+
+	done := make(chan struct{})
+	go w.watch(cancel, done)
+
+	err := engine.Run(ctx, params, w)
+	close(done)
+
+	if w.isHung() {
+		return EngineHungError{Timeout: hangTimeout}
+	}
+	return err
+
+}
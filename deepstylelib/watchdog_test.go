@@ -0,0 +1,119 @@
+package deepstylelib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Writes a line of output every interval, until it stalls (waiting to be
+// cancelled) after stallAfter or finishes after finishAfter, if set.
+type stallingEngine struct {
+	interval    time.Duration
+	stallAfter  time.Duration
+	finishAfter time.Duration
+}
+
+func (e stallingEngine) Name() string {
+	return "stalling"
+}
+
+func (e stallingEngine) Available() bool {
+	return true
+}
+
+func (e stallingEngine) Run(ctx context.Context, params EngineParams, output io.Writer) error {
+	var stall, finish <-chan time.Time
+	if e.stallAfter > 0 {
+		stall = time.After(e.stallAfter)
+	}
+	if e.finishAfter > 0 {
+		finish = time.After(e.finishAfter)
+	}
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stall:
+			<-ctx.Done()
+			return ctx.Err()
+		case <-finish:
+			return nil
+		case <-ticker.C:
+			io.WriteString(output, "Iteration\n")
+		}
+	}
+}
+
+func TestRunWithWatchdogKillsStalledEngine(t *testing.T) {
+
+	engine := stallingEngine{interval: 50 * time.Millisecond, stallAfter: 200 * time.Millisecond}
+	output := &bytes.Buffer{}
+
+	start := time.Now()
+	err := runWithWatchdog(context.Background(), engine, EngineParams{}, output, 500*time.Millisecond)
+	assert.Equal(t, EngineHungError{Timeout: 500 * time.Millisecond}, err)
+	assert.True(t, isEngineHung(err))
+	assert.True(t, time.Since(start) < 5*time.Second, "Took %v to kill the engine", time.Since(start))
+
+	// output was passed through until it stalled
+	assert.Contains(t, output.String(), "Iteration")
+
+}
+
+func TestRunWithWatchdogKeepsBusyEngine(t *testing.T) {
+
+	// runs for longer than the timeout, but keeps writing
+	engine := stallingEngine{interval: 50 * time.Millisecond, finishAfter: 1500 * time.Millisecond}
+	assert.NoError(t, runWithWatchdog(context.Background(), engine, EngineParams{}, &bytes.Buffer{}, 500*time.Millisecond))
+
+	engine = stallingEngine{interval: 50 * time.Millisecond, finishAfter: 100 * time.Millisecond}
+	assert.NoError(t, runWithWatchdog(context.Background(), engine, EngineParams{}, &bytes.Buffer{}, 0))
+
+}
+
+func TestIsEngineHung(t *testing.T) {
+	assert.True(t, isEngineHung(EngineHungError{Timeout: time.Minute}))
+	assert.False(t, isEngineHung(fmt.Errorf("Engine produced no output")))
+	assert.False(t, isEngineHung(nil))
+}
+
+func TestRecordHang(t *testing.T) {
+
+	now := time.Now()
+	hangErr := EngineHungError{Timeout: time.Minute}
+	jobDoc := JobDocument{State: StateBeingProcessed, ErrorCode: ErrorCodeInternal}
+
+	// back in the queue, with the stale error cleared
+	jobDoc.recordHang("worker1", hangErr, 1, now)
+	assert.Equal(t, StateReadyToProcess, jobDoc.State)
+	assert.Equal(t, "", jobDoc.ErrorCode)
+	assert.Equal(t, []string{"worker1"}, jobDoc.HungOnWorkers)
+
+	// worker1 leaves it for the others for a while, then tries again
+	assert.True(t, jobDoc.waitingForHangRetry("worker1", now.Add(time.Minute)))
+	assert.False(t, jobDoc.waitingForHangRetry("worker2", now.Add(time.Minute)))
+	assert.False(t, jobDoc.waitingForHangRetry("worker1", now.Add(HangRetryCooldown+time.Minute)))
+
+	// hanging on the same worker again still counts
+	jobDoc.recordHang("worker1", hangErr, 2, now)
+	assert.Equal(t, StateReadyToProcess, jobDoc.State)
+	assert.Equal(t, []string{"worker1"}, jobDoc.HungOnWorkers)
+
+	jobDoc.recordHang("worker1", hangErr, MaxHangRetries, now)
+	assert.Equal(t, StateProcessingFailed, jobDoc.State)
+	assert.Equal(t, ErrorCodeEngineHung, jobDoc.ErrorCode)
+	assert.Contains(t, jobDoc.ErrorMessage, "hung 3 times")
+
+	// jobs that hung before last_hung_at was recorded aren't skipped
+	jobDoc.LastHungAt = ""
+	assert.False(t, jobDoc.waitingForHangRetry("worker1", now))
+
+}